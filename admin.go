@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// Internal metrics of nscapi, exposed on the admin listener
+var (
+	startTime                = time.Now()
+	resultsReceived          labeledCounter
+	cacheUpdates             counter
+	workerLag                gauge
+	queueDrops               labeledCounter
+	commandFileIgnored       labeledCounter
+	commandFileRejected      labeledCounter
+	resultsRejected          labeledCounter
+	nscaPacketsRejected      labeledCounter
+	timestampsClamped        counter
+	rewriteRulesReloads      labeledCounter
+	filterRuleHits           labeledCounter
+	customFieldsLoadErrors   counter
+	customFieldsFilesLoaded  gauge
+	customFieldsLastLoadTime gauge
+	apiRequestDuration       = newHistogram([]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+)
+
+// instrumentHandler wraps a handler of the API to record the latency of its
+// requests
+func instrumentHandler(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		apiRequestDuration.observe(path, time.Since(start).Seconds())
+	}
+}
+
+// writeInternalMetrics writes the operational metrics of nscapi and the Go
+// runtime statistics
+func writeInternalMetrics(w io.Writer) {
+	writeMetricHeader(w, "nscapi_results_received_total", "Number of check results received per source.", "counter")
+	resultsReceived.write(w, "nscapi_results_received_total", "source")
+	writeMetricHeader(w, "nscapi_results_rejected_total", "Number of check results rejected per reason.", "counter")
+	resultsRejected.write(w, "nscapi_results_rejected_total", "reason")
+	writeMetricHeader(w, "nscapi_nsca_packets_rejected_total", "Number of NSCA packets dropped before being queued per reason (crc, decrypt or read).", "counter")
+	nscaPacketsRejected.write(w, "nscapi_nsca_packets_rejected_total", "reason")
+	writeMetricHeader(w, "nscapi_results_timestamp_clamped_total", "Number of check results whose timestamp in the future has been clamped to the receive time.", "counter")
+	writeMetricSample(w, "nscapi_results_timestamp_clamped_total", nil, timestampsClamped.value())
+	writeMetricHeader(w, "nscapi_rewrite_rules_reloads_total", "Number of reloads of the rewrite rules file per result.", "counter")
+	rewriteRulesReloads.write(w, "nscapi_rewrite_rules_reloads_total", "result")
+	writeMetricHeader(w, "nscapi_filter_rule_hits_total", "Number of check results matched by each filter rule.", "counter")
+	filterRuleHits.write(w, "nscapi_filter_rule_hits_total", "rule")
+	writeMetricHeader(w, "nscapi_queue_length", "Number of check results waiting to be processed by the cache worker.", "gauge")
+	writeMetricSample(w, "nscapi_queue_length", nil, float64(q.Len()))
+	writeMetricHeader(w, "nscapi_worker_lag_seconds", "Time the last check result processed by the cache worker spent in the queue.", "gauge")
+	writeMetricSample(w, "nscapi_worker_lag_seconds", nil, workerLag.value())
+	writeMetricHeader(w, "nscapi_cache_updates_total", "Number of check results processed by the cache worker.", "counter")
+	writeMetricSample(w, "nscapi_cache_updates_total", nil, cacheUpdates.value())
+
+	cacheLock.RLock()
+	hosts, checks := len(cache), 0
+	for _, svcs := range cache {
+		checks += len(svcs)
+	}
+	cacheLock.RUnlock()
+	writeMetricHeader(w, "nscapi_cache_hosts", "Number of hosts in the cache.", "gauge")
+	writeMetricSample(w, "nscapi_cache_hosts", nil, float64(hosts))
+	writeMetricHeader(w, "nscapi_cache_checks", "Number of checks in the cache.", "gauge")
+	writeMetricSample(w, "nscapi_cache_checks", nil, float64(checks))
+
+	writeMetricHeader(w, "nscapi_queue_dropped_total", "Number of items dropped because the internal queue was full.", "counter")
+	queueDrops.write(w, "nscapi_queue_dropped_total", "queue")
+
+	writeMetricHeader(w, "nscapi_command_file_unsupported_total", "Number of unsupported commands read from the external command file.", "counter")
+	commandFileIgnored.write(w, "nscapi_command_file_unsupported_total", "command")
+	writeMetricHeader(w, "nscapi_command_file_rejected_total", "Number of invalid or too long commands read from the external command file per reason.", "counter")
+	commandFileRejected.write(w, "nscapi_command_file_rejected_total", "reason")
+
+	writeMetricHeader(w, "nscapi_custom_fields_files_loaded", "Number of yaml files of the custom fields hierarchy loaded.", "gauge")
+	writeMetricSample(w, "nscapi_custom_fields_files_loaded", nil, customFieldsFilesLoaded.value())
+	writeMetricHeader(w, "nscapi_custom_fields_load_errors_total", "Number of yaml files of the custom fields hierarchy that could not be loaded.", "counter")
+	writeMetricSample(w, "nscapi_custom_fields_load_errors_total", nil, customFieldsLoadErrors.value())
+	writeMetricHeader(w, "nscapi_custom_fields_last_load_timestamp_seconds", "Time of the last load of the custom fields hierarchy.", "gauge")
+	writeMetricSample(w, "nscapi_custom_fields_last_load_timestamp_seconds", nil, customFieldsLastLoadTime.value())
+
+	writeMetricHeader(w, "nscapi_api_request_duration_seconds", "Latency of the requests handled by the API per path.", "histogram")
+	apiRequestDuration.write(w, "nscapi_api_request_duration_seconds", "path")
+
+	writeMetricHeader(w, "process_start_time_seconds", "Start time of the process since unix epoch in seconds.", "gauge")
+	writeMetricSample(w, "process_start_time_seconds", nil, float64(startTime.Unix()))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	runtimeMetrics := []struct {
+		name, help, metricType string
+		value                  float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", "gauge", float64(mem.Alloc)},
+		{"go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", "counter", float64(mem.TotalAlloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", "gauge", float64(mem.Sys)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", "gauge", float64(mem.HeapObjects)},
+		{"go_memstats_gc_cycles_total", "Number of completed GC cycles.", "counter", float64(mem.NumGC)},
+		{"go_memstats_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter", float64(mem.PauseTotalNs) / 1e9},
+		{"go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", "gauge", float64(mem.LastGC) / 1e9},
+	}
+	for _, m := range runtimeMetrics {
+		writeMetricHeader(w, m.name, m.help, m.metricType)
+		writeMetricSample(w, m.name, nil, m.value)
+	}
+	writeMetricHeader(w, "go_info", "Information about the Go environment.", "gauge")
+	writeMetricSample(w, "go_info", []metricLabel{{"version", runtime.Version()}}, 1)
+}
+
+// internalMetricsHandler exposes the internal metrics in the Prometheus text
+// format
+func internalMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeInternalMetrics(w)
+}
+
+// newAdminMux returns the routes of the admin listener. The pprof handlers are
+// only added when enabled
+func newAdminMux(enablePprof bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", internalMetricsHandler)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// initAdminServer starts the admin HTTP server exposing the internal metrics
+// and optionally the pprof handlers. It is kept separate from the API so that
+// it can listen on a private interface. A port of 0 disables it
+func initAdminServer(listenerIP string, port uint, enablePprof bool) {
+	if port == 0 {
+		return
+	}
+	http.ListenAndServe(fmt.Sprint(listenerIP, ":", port), newAdminMux(enablePprof))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/PurpureGecko/go-lfc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInternalMetricsHandler(t *testing.T) {
+	initCache()
+	q = lfc.NewQueue()
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+	updateCacheEntry("web01", "mysql", "OK", 1484527962, 0)
+	instrumentHandler("/api/reports", func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/reports", nil))
+
+	w := httptest.NewRecorder()
+	internalMetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Wrong content type: %s", ct)
+	}
+	for _, expected := range []string{
+		"nscapi_cache_hosts 1\n",
+		"nscapi_cache_checks 2\n",
+		"nscapi_queue_length 0\n",
+		"# TYPE nscapi_results_received_total counter\n",
+		"# TYPE nscapi_nsca_packets_rejected_total counter\n",
+		"# TYPE nscapi_worker_lag_seconds gauge\n",
+		`nscapi_api_request_duration_seconds_bucket{path="/api/reports",le="+Inf"}`,
+		"# TYPE process_start_time_seconds gauge\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Missing %q in the metrics:\n%s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestNewAdminMux(t *testing.T) {
+	q = lfc.NewQueue()
+	cases := []struct {
+		pprof    bool
+		path     string
+		expected int
+	}{
+		{false, "/metrics", http.StatusOK},
+		{false, "/debug/pprof/", http.StatusNotFound},
+		{true, "/debug/pprof/", http.StatusOK},
+		{true, "/debug/pprof/cmdline", http.StatusOK},
+	}
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		newAdminMux(tt.pprof).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.expected {
+			t.Errorf("Expecting status %d on %s with pprof %t. Got %d", tt.expected, tt.path, tt.pprof, w.Code)
+		}
+	}
+}
+
+func TestNewAPIMux(t *testing.T) {
+	tmplRoot = "templates"
+	w := httptest.NewRecorder()
+	newAPIMux().ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if strings.Contains(w.Body.String(), "goroutine") {
+		t.Error("The pprof handlers should not be exposed by the API")
+	}
+}
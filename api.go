@@ -7,7 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync/atomic"
 	"text/template"
 )
 
@@ -37,13 +37,6 @@ func ToJSONString(v interface{}) string {
 	return string(bytesOutput)
 }
 
-// We need to remove newline characters
-// to have valid JSON output
-// because it breaks it in other case
-func sanitizeJSONString(str string) string {
-	return strings.Replace(str, "\n", " ", -1)
-}
-
 // rootHandler just renders the root.tmpl that explains the api calls usage
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	tmplPath := filepath.Join(tmplRoot, "root.tmpl")
@@ -54,36 +47,84 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
 // reportsHandler takes care of the path /api/reports that lists all the checks
 // on all the hosts, each elements defined based on the reports_element.tmpl
-// template
+// template. The host checks are listed with an empty service name, a "host"
+// type and the host states
 func reportsHandler(w http.ResponseWriter, r *http.Request) {
 	tmplName := "reports_element.tmpl"
 	tmplPath := filepath.Join(tmplRoot, tmplName)
 	w.Header().Set("Content-Type", "application/json")
 	fMaps := template.FuncMap{"tojson": ToJSONString}
 	t := template.Must(template.New(tmplName).Funcs(fMaps).ParseFiles(tmplPath))
-	io.WriteString(w, "[")
-	i := 1
+	// The checks are copied under the cache lock, which is released before
+	// writing to the client
+	var checks []map[string]interface{}
+	cacheLock.RLock()
 	for host, svcs := range cache {
-		j := 1
+		// The hosts without host check get a host element, UP, when they have
+		// clock skew statistics
+		skew := hostClockSkew(host)
+		if _, ok := hostCache[host]; ok || skew != nil {
+			chk := hostStatus(host)
+			checks = append(checks, map[string]interface{}{"type": "host", "host": host, "name": "", "status": hostStatusString(chk.state), "message": chk.shortOutput, "longOutput": chk.longOutput, "perfdata": perfdataTemplateData(chk.perfdata), "timestamp": fmt.Sprint(chk.timestamp), "statusFirstSeen": fmt.Sprint(chk.statusFirstSeen), "clientTimestamp": fmt.Sprint(chk.clientTimestamp), "receivedAt": fmt.Sprint(chk.receivedAt), "clockSkew": skew})
+		}
 		for svc, chk := range svcs {
-			c := map[string]map[string]interface{}{
-				"check": map[string]interface{}{"host": host, "name": svc, "status": statusString(chk.state), "message": sanitizeJSONString(chk.output), "timestamp": fmt.Sprint(chk.timestamp), "statusFirstSeen": fmt.Sprint(chk.statusFirstSeen)},
-				// custom will be used to inject custom-defined fields
-				"custom": cFields.get(host, svc),
-			}
-			t.Execute(w, c)
-			// This part just takes care of adding a coma or not between the elements
-			// to have a correcly-formated json
-			if !(i == len(cache) && j == len(svcs)) {
-				io.WriteString(w, ",")
-			}
-			j++
+			checks = append(checks, map[string]interface{}{"type": "service", "host": host, "name": svc, "status": statusString(chk.state), "message": chk.shortOutput, "longOutput": chk.longOutput, "perfdata": perfdataTemplateData(chk.perfdata), "timestamp": fmt.Sprint(chk.timestamp), "statusFirstSeen": fmt.Sprint(chk.statusFirstSeen), "clientTimestamp": fmt.Sprint(chk.clientTimestamp), "receivedAt": fmt.Sprint(chk.receivedAt)})
 		}
-		i++
+	}
+	cacheLock.RUnlock()
+
+	io.WriteString(w, "[")
+	for i, chk := range checks {
+		// This part just takes care of adding a coma or not between the elements
+		// to have a correcly-formated json
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		svc := chk["name"].(string)
+		if svc == "" {
+			svc = "all"
+		}
+		t.Execute(w, map[string]map[string]interface{}{
+			"check": chk,
+			// custom will be used to inject custom-defined fields
+			"custom": cFields.get(chk["host"].(string), svc),
+		})
 	}
 	io.WriteString(w, "]\n")
 }
 
+// acknowledgeHandler takes care of the path /api/acknowledge that marks the
+// current problem of the check given by the host and service parameters as
+// acknowledged, an empty service being the host check. It only accepts
+// authenticated POST requests
+func acknowledgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizedResultsRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nscapi"`)
+		http.Error(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	if err := acknowledgeCacheEntry(r.FormValue("host"), r.FormValue("service")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventHandlersHandler takes care of the path /api/eventhandlers that lists the
+// last execution of the event handler of each check
+func eventHandlersHandler(w http.ResponseWriter, r *http.Request) {
+	runs := []*eventHandlerRun{}
+	if eventHandlers != nil {
+		runs = eventHandlers.lastRuns()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
 // setIfPathExists validates that the given path exists before assigning it to
 // the given variable
 func setIfPathExists(dir string, varToSet *string) error {
@@ -94,18 +135,56 @@ func setIfPathExists(dir string, varToSet *string) error {
 	return nil
 }
 
-// initAPIServer starts the API HTTP server. This is where the routes are
-// defined. The customFieldRoot is the root of the hierarchy of yaml files used
-// for the custom fields. The templatesRoot is the root directory where to find
-// the templates used by the API
-func initAPIServer(listenerIP string, port uint, customFieldRoot string, templatesRoot string) {
-	// Init custom fields
+// newAPIMux returns the routes of the API, each of them instrumented to record
+// its latency. The API has its own mux so that the admin routes registered on
+// the default one never end up exposed by the API
+func newAPIMux() *http.ServeMux {
+	routes := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/", rootHandler},
+		{"/api/reports", reportsHandler},
+		{"/api/acknowledge", acknowledgeHandler},
+		{"/api/results", resultsHandler},
+		{"/nrdp", nrdpHandler},
+		{"/nrdp/", nrdpHandler},
+		{"/v1/actions/process-check-result", icingaProcessCheckResultHandler},
+		{"/api/eventhandlers", eventHandlersHandler},
+		{"/api/status", statusHandler},
+		{"/metrics", metricsHandler},
+		{"/healthz", healthzHandler},
+		{"/readyz", readyzHandler},
+		{"/probe/", probeHandler},
+		{"/probe-hostgroup/", probeHostgroupHandler},
+		{"/status.dat", statusDatHandler},
+		{"/cgi-bin/statusjson.cgi", statusJSONHandler},
+		{"/nagios/cgi-bin/statusjson.cgi", statusJSONHandler},
+	}
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.HandleFunc(route.path, instrumentHandler(route.path, route.handler))
+	}
+	return mux
+}
+
+// initCustomFields loads the custom fields and sets the templates root. The
+// customFieldRoot is the root of the hierarchy of yaml files used for the
+// custom fields. The templatesRoot is the root directory where to find the
+// templates used by the API and the notifications. It must be called before
+// the cache worker, the notification sinks and the listeners start reading
+// them
+func initCustomFields(customFieldRoot string, templatesRoot string) {
 	var customFRoot string
 	setIfPathExists(customFieldRoot, &customFRoot)
 	cFields.load(customFRoot)
+	atomic.StoreInt32(&customFieldsLoaded, 1)
 
 	setIfPathExists(templatesRoot, &tmplRoot)
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/api/reports", reportsHandler)
-	http.ListenAndServe(fmt.Sprint(listenerIP, ":", port), nil)
+}
+
+// initAPIServer starts the API HTTP server. This is where the routes are
+// defined
+func initAPIServer(listenerIP string, port uint) {
+	http.ListenAndServe(fmt.Sprint(listenerIP, ":", port), newAPIMux())
 }
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -16,3 +22,131 @@ func TestStatusString(t *testing.T) {
 		}
 	}
 }
+
+func TestAcknowledgeHandler(t *testing.T) {
+	initCache()
+	resultsTokens = []string{"secret"}
+	defer func() { resultsTokens = nil }()
+	updateCacheEntry("host01", "service foo", "Critical", 1484527962, 2)
+
+	cases := []struct {
+		method string
+		query  string
+		token  string
+		code   int
+	}{
+		{"GET", "host=host01&service=service+foo", "secret", http.StatusMethodNotAllowed},
+		{"POST", "host=host01&service=service+foo", "", http.StatusUnauthorized},
+		{"POST", "host=host01&service=service+foo", "wrong", http.StatusUnauthorized},
+		{"POST", "host=host01&service=nonExisting", "secret", http.StatusBadRequest},
+		{"POST", "host=host01&service=service+foo", "secret", http.StatusNoContent},
+	}
+	for _, tt := range cases {
+		if tt.code == http.StatusNoContent && isAcknowledged("host01", "service foo") {
+			t.Errorf("service foo should not be acknowledged by the rejected requests")
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/api/acknowledge?"+tt.query, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		acknowledgeHandler(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s /api/acknowledge?%s with token %q should return %d, not %d", tt.method, tt.query, tt.token, tt.code, w.Code)
+		}
+	}
+	if !isAcknowledged("host01", "service foo") {
+		t.Errorf("service foo should be acknowledged")
+	}
+}
+
+func TestEventHandlersHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	eventHandlersHandler(w, httptest.NewRequest("GET", "/api/eventhandlers", nil))
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("Expecting an empty list when the event handlers are disabled. Got %s", body)
+	}
+
+	eventHandlers = newEventHandlerRunner(&eventHandlersConfig{})
+	defer func() { eventHandlers = nil }()
+	eventHandlers.runs[checkKey{"web01", "apache"}] = &eventHandlerRun{Host: "web01", Service: "apache", Handler: "restart_apache", Output: "restarted"}
+	w = httptest.NewRecorder()
+	eventHandlersHandler(w, httptest.NewRequest("GET", "/api/eventhandlers", nil))
+	if body := w.Body.String(); !strings.Contains(body, `"handler":"restart_apache"`) || !strings.Contains(body, `"output":"restarted"`) {
+		t.Errorf("Wrong list of event handler runs: %s", body)
+	}
+}
+
+func TestReportsHandler(t *testing.T) {
+	initCache()
+	tmplRoot = "templates"
+	updateCacheEntry("web01", "apache", "OK - 12 \"workers\"|workers=12;50;100;0\nworker 1: idle\n\tworker 2: \\busy\\", 1484527962, 0)
+	w := httptest.NewRecorder()
+	reportsHandler(w, httptest.NewRequest("GET", "/api/reports", nil))
+
+	var reports []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("/api/reports returned an invalid JSON (%s):\n%s", err, w.Body.String())
+	}
+	if len(reports) != 1 || reports[0]["hostname"] != "web01" || reports[0]["service"] != "apache" {
+		t.Fatalf("Wrong reports returned: %v", reports)
+	}
+	status := reports[0]["currentStatus"].(map[string]interface{})
+	if status["message"] != `OK - 12 "workers"` {
+		t.Errorf("Wrong message in the report: %v", status["message"])
+	}
+	if status["longOutput"] != "worker 1: idle\n\tworker 2: \\busy\\" {
+		t.Errorf("Wrong long output in the report: %q", status["longOutput"])
+	}
+	expected := []interface{}{map[string]interface{}{"label": "workers", "value": 12.0, "uom": "", "warn": "50", "crit": "100", "min": 0.0, "max": nil}}
+	if !reflect.DeepEqual(status["perfdata"], expected) {
+		t.Errorf("Wrong perfdata in the report. Expecting %v, got %v", expected, status["perfdata"])
+	}
+
+	// The host checks are listed with their own type, including for the hosts
+	// without service, and the hosts without host check get an UP host element
+	// carrying their clock skew
+	updateCacheEntry("web01", "", "PING OK", 1484527962, 0)
+	updateCacheEntry("web02", "", "PING CRITICAL - 100% loss", 1484527962, 1)
+	updateCacheEntry("web03", "disk", "DISK OK", 1484527962, 0)
+	hostClockSkews["web02"] = &clockSkew{Samples: 1, Last: 5, Min: 5, Max: 5, Mean: 5}
+	hostClockSkews["web03"] = &clockSkew{Samples: 2, Last: -3, Min: -3, Max: 1, Mean: -1}
+	w = httptest.NewRecorder()
+	reportsHandler(w, httptest.NewRequest("GET", "/api/reports", nil))
+	reports = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("/api/reports returned an invalid JSON (%s):\n%s", err, w.Body.String())
+	}
+	statuses := make(map[string]interface{})
+	for _, report := range reports {
+		key := fmt.Sprintf("%s/%s/%s", report["type"], report["hostname"], report["service"])
+		statuses[key] = report["currentStatus"].(map[string]interface{})["status"]
+	}
+	expectedStatuses := map[string]interface{}{"service/web01/apache": "OK", "host/web01/": "Up", "host/web02/": "Down",
+		"service/web03/disk": "OK", "host/web03/": "Up"}
+	if !reflect.DeepEqual(statuses, expectedStatuses) {
+		t.Errorf("Wrong reports. Expecting %v, got %v", expectedStatuses, statuses)
+	}
+	for _, report := range reports {
+		_, hasSkew := report["clockSkew"]
+		if hasSkew != (report["hostname"] != "web01" && report["type"] == "host") {
+			t.Errorf("Unexpected clock skew in the report of %s/%s: %v", report["hostname"], report["service"], report["clockSkew"])
+		}
+		if received := report["currentStatus"].(map[string]interface{})["receivedAt"]; received != "1484527962" {
+			t.Errorf("Wrong receive time in the report of %s/%s: %v", report["hostname"], report["service"], received)
+		}
+	}
+
+	// The names are escaped like the outputs
+	initCache()
+	updateCacheEntry(`web"01\`, "disk \"/var\"\n", "OK", 1484527962, 0)
+	w = httptest.NewRecorder()
+	reportsHandler(w, httptest.NewRequest("GET", "/api/reports", nil))
+	reports = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("/api/reports returned an invalid JSON (%s):\n%s", err, w.Body.String())
+	}
+	if len(reports) != 1 || reports[0]["hostname"] != `web"01\` || reports[0]["service"] != "disk \"/var\"\n" {
+		t.Errorf("Wrong names in the reports: %v", reports)
+	}
+}
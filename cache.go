@@ -1,43 +1,280 @@
 package main
 
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
 // The cache structure contains 2 layers of maps:
 // * Layer 1: the key is the hostname
 // * Layer 2: for each hostname, there's a map where the key is the service name
 var cache map[string]map[string]*serviceEntry
 
-// ServiceEntry can be found in the 2nd layer of he map and contains the details
-// of the last status of the check (timestamp, timestamp of the last status
-// change, state and plugin output)
+// hostCache contains the result of the last host check of each host, the NSCA
+// packets with an empty service name being host checks. Every host of
+// hostCache also has a map of services in the cache, which may be empty
+var hostCache map[string]*serviceEntry
+
+// cacheLock protects the cache from concurrent updates by the worker while it
+// is being read by the API and the notification sinks
+var cacheLock sync.RWMutex
+
+// ServiceEntry can be found in the 2nd layer of he map and in the host cache and
+// contains the details of the last status of the check (timestamp, timestamp of the last status
+// change, state, plugin output, whether the current problem has been
+// acknowledged and the attempt: the number of consecutive results in the
+// current state, or in any non-OK state for the problems).
+// The plugin output is also kept split into its short text, long text and
+// parsed performance data. The timestamp and the time of the last status
+// change follow the clock selected by timestampClock, the timestamp set by the
+// client and the time the result was received by nscapi being both kept
 type serviceEntry struct {
 	timestamp       uint32
+	clientTimestamp uint32
+	receivedAt      uint32
 	statusFirstSeen uint32
 	state           int16
 	output          string
+	shortOutput     string
+	longOutput      string
+	perfdata        []perfdataEntry
+	acknowledged    bool
+	attempt         uint16
 }
 
 // initCache initialize the cache object
 func initCache() {
 	cache = make(map[string]map[string]*serviceEntry)
+	hostCache = make(map[string]*serviceEntry)
+	hostClockSkews = make(map[string]*clockSkew)
 }
 
-// updateCacheEntry adds or update a given service check result in the cache map
+// newCacheEntry builds the entry of a check result from the previous entry of
+// the check, which is nil for a check seen for the first time
+func newCacheEntry(previous *serviceEntry, output string, clientTimestamp, receivedAt uint32, state int16) *serviceEntry {
+	timestamp := clientTimestamp
+	if timestampClock == clockServer {
+		timestamp = receivedAt
+	}
+	firstSeen := timestamp
+	acknowledged := false
+	attempt := uint16(1)
+	// If the entry already exists and we update it, we want the time we've seen
+	// the switch to the current status
+	// The acknowledgement only lasts until the next state change
+	if previous != nil && previous.state == state {
+		firstSeen = previous.statusFirstSeen
+		acknowledged = previous.acknowledged
+	}
+	// Like Nagios, the attempts of a problem go on when it changes from a
+	// non-OK state to another one and only restart when coming from OK
+	sameProblem := previous != nil && previous.state != 0 && state != 0
+	if previous != nil && (previous.state == state || sameProblem) && previous.attempt < ^uint16(0) {
+		attempt = previous.attempt + 1
+	}
+	shortOutput, longOutput, perfdata := splitPluginOutput(output)
+	return &serviceEntry{
+		timestamp:       timestamp,
+		clientTimestamp: clientTimestamp,
+		receivedAt:      receivedAt,
+		statusFirstSeen: firstSeen,
+		output:          output,
+		shortOutput:     shortOutput,
+		longOutput:      longOutput,
+		perfdata:        parsePerfdata(perfdata),
+		state:           state,
+		acknowledged:    acknowledged,
+		attempt:         attempt,
+	}
+}
+
+// updateCacheEntry stores a check result received at the time of its
+// timestamp. See updateCacheEntryAt
 func updateCacheEntry(hostname, servicename, output string, timestamp uint32, state int16) {
+	updateCacheEntryAt(hostname, servicename, output, timestamp, time.Unix(int64(timestamp), 0), state)
+}
+
+// updateCacheEntryAt adds or update a given service check result in the cache map,
+// queues a notification when the state of the check changes and hands the
+// result over to the event handlers. A check seen for the first time is
+// considered as coming from an OK state. The results with an empty service
+// name are host check results: they go to the host cache but are notified and
+// handed over to the event handlers like the service checks
+func updateCacheEntryAt(hostname, servicename, output string, timestamp uint32, receivedAt time.Time, state int16) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
 	svc, ok := cache[hostname]
-	firstSeen := timestamp
 	if !ok {
 		svc = make(map[string]*serviceEntry)
 		cache[hostname] = svc
-	} else if service, exists := svc[servicename]; exists {
-		// If the entry already exists and we update it, we want the time we've seen
-		// the switch to the current status
-		if service.state == state {
-			firstSeen = service.statusFirstSeen
+	}
+	received := uint32(receivedAt.Unix())
+	previousState := int16(0)
+	var entry *serviceEntry
+	if servicename == "" {
+		if host, exists := hostCache[hostname]; exists {
+			previousState = host.state
+		}
+		entry = newCacheEntry(hostCache[hostname], output, timestamp, received, hostState(state))
+		hostCache[hostname] = entry
+	} else {
+		if service, exists := svc[servicename]; exists {
+			previousState = service.state
 		}
+		entry = newCacheEntry(svc[servicename], output, timestamp, received, state)
+		svc[servicename] = entry
 	}
-	svc[servicename] = &serviceEntry{
-		timestamp:       timestamp,
-		statusFirstSeen: firstSeen,
-		output:          output,
-		state:           state,
+	if entry.state != previousState {
+		queueNotification(hostname, servicename, entry, previousState)
+	}
+	queueEventHandler(hostname, servicename, entry, previousState)
+}
+
+// hostState turns the return code of a host check into a host state. Like
+// Nagios, the codes other than UP, DOWN and UNREACHABLE are considered as DOWN
+func hostState(code int16) int16 {
+	if code < 0 || code > 2 {
+		return 1
+	}
+	return code
+}
+
+// checkStatusString returns the string corresponding to the state of a check,
+// the empty service name being the host check
+func checkStatusString(servicename string, state int16) string {
+	if servicename == "" {
+		return hostStatusString(state)
+	}
+	return statusString(state)
+}
+
+// checkName returns the name of a check used in the messages: host/service or
+// the host alone for the host check
+func checkName(hostname, servicename string) string {
+	if servicename == "" {
+		return hostname
+	}
+	return hostname + "/" + servicename
+}
+
+// hostStatusString returns the string corresponding to a host state
+func hostStatusString(state int16) string {
+	switch state {
+	case 0:
+		return "Up"
+	case 2:
+		return "Unreachable"
+	}
+	return "Down"
+}
+
+// hostStatus returns the status of a host: the result of its last host check
+// or, for the hosts without host check result, an UP state summarizing the
+// results of its services. The cache lock must be held by the caller
+func hostStatus(hostname string) *serviceEntry {
+	if entry, ok := hostCache[hostname]; ok {
+		return entry
+	}
+	entry := &serviceEntry{attempt: 1}
+	for _, service := range cache[hostname] {
+		if service.timestamp > entry.timestamp {
+			entry.timestamp = service.timestamp
+		}
+		if service.clientTimestamp > entry.clientTimestamp {
+			entry.clientTimestamp = service.clientTimestamp
+		}
+		if service.receivedAt > entry.receivedAt {
+			entry.receivedAt = service.receivedAt
+		}
+		if entry.statusFirstSeen == 0 || service.statusFirstSeen < entry.statusFirstSeen {
+			entry.statusFirstSeen = service.statusFirstSeen
+		}
+	}
+	entry.output = fmt.Sprintf("Passive results received for %d services", len(cache[hostname]))
+	entry.shortOutput = entry.output
+	return entry
+}
+
+// acknowledgeCacheEntry marks the current problem of a check as acknowledged,
+// the empty service name being the host check. It returns an error when the
+// check is unknown or in an OK state
+func acknowledgeCacheEntry(hostname, servicename string) error {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if servicename == "" {
+		host, ok := hostCache[hostname]
+		if !ok {
+			return fmt.Errorf("no host check found for host %s", hostname)
+		}
+		if host.state == 0 {
+			return fmt.Errorf("host %s is UP, nothing to acknowledge", hostname)
+		}
+		host.acknowledged = true
+		return nil
+	}
+	service, ok := cache[hostname][servicename]
+	if !ok {
+		return fmt.Errorf("no check %s found on host %s", servicename, hostname)
+	}
+	if service.state == 0 {
+		return fmt.Errorf("check %s of host %s is OK, nothing to acknowledge", servicename, hostname)
+	}
+	service.acknowledged = true
+	return nil
+}
+
+// isAcknowledged returns whether the current problem of a check has been
+// acknowledged, the empty service name being the host check
+func isAcknowledged(hostname, servicename string) bool {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	if servicename == "" {
+		host, ok := hostCache[hostname]
+		return ok && host.acknowledged
+	}
+	service, ok := cache[hostname][servicename]
+	return ok && service.acknowledged
+}
+
+// cacheProblems returns a snapshot of all the checks of the cache that are not
+// in an OK state, including the hosts that are not UP
+func cacheProblems() []*notification {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	var problems []*notification
+	for host, chk := range hostCache {
+		if chk.state == 0 {
+			continue
+		}
+		problems = append(problems, &notification{
+			host:            host,
+			hostgroup:       hostgroupOf(host),
+			state:           chk.state,
+			previousState:   chk.state,
+			output:          chk.shortOutput,
+			longOutput:      chk.longOutput,
+			timestamp:       chk.timestamp,
+			statusFirstSeen: chk.statusFirstSeen,
+		})
+	}
+	for host, svcs := range cache {
+		for svc, chk := range svcs {
+			if chk.state == 0 {
+				continue
+			}
+			problems = append(problems, &notification{
+				host:            host,
+				service:         svc,
+				hostgroup:       hostgroupOf(host),
+				state:           chk.state,
+				previousState:   chk.state,
+				output:          chk.shortOutput,
+				longOutput:      chk.longOutput,
+				timestamp:       chk.timestamp,
+				statusFirstSeen: chk.statusFirstSeen,
+			})
+		}
 	}
+	return problems
 }
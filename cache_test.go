@@ -3,9 +3,8 @@ package main
 import "testing"
 
 func TestInitCache(t *testing.T) {
-	if cache != nil {
-		t.Errorf("Already initialized cache found")
-	}
+	// Other tests may already have initialized the cache
+	cache = nil
 	initCache()
 	if cache == nil {
 		t.Errorf("Cache object still not initialized after the init")
@@ -93,3 +92,118 @@ func TestUpdateCacheEntry(t *testing.T) {
 		t.Errorf("entry '%s' has wrong statusFirstSeen upon update with no state change. Got %d, expecting %d", "service bar", s.statusFirstSeen, 1484527966)
 	}
 }
+
+func TestAcknowledgeCacheEntry(t *testing.T) {
+	initCache()
+	updateCacheEntry("host01", "service foo", "Critical", 1484527962, 2)
+	updateCacheEntry("host01", "service bar", "OK", 1484527962, 0)
+
+	if err := acknowledgeCacheEntry("host02", "service foo"); err == nil {
+		t.Errorf("Acknowledging an unknown check should fail")
+	}
+	if err := acknowledgeCacheEntry("host01", "service bar"); err == nil {
+		t.Errorf("Acknowledging an OK check should fail")
+	}
+	if isAcknowledged("host01", "service foo") {
+		t.Errorf("service foo should not be acknowledged yet")
+	}
+	if err := acknowledgeCacheEntry("host01", "service foo"); err != nil {
+		t.Errorf("acknowledgeCacheEntry returned: %s", err)
+	}
+	if !isAcknowledged("host01", "service foo") {
+		t.Errorf("service foo should be acknowledged")
+	}
+
+	// Kept until the next state change
+	updateCacheEntry("host01", "service foo", "Still critical", 1484527963, 2)
+	if !isAcknowledged("host01", "service foo") {
+		t.Errorf("The acknowledgement should be kept when the state does not change")
+	}
+	updateCacheEntry("host01", "service foo", "Warning", 1484527964, 1)
+	if isAcknowledged("host01", "service foo") {
+		t.Errorf("The acknowledgement should be removed on a state change")
+	}
+}
+
+func TestCacheEntryAttempt(t *testing.T) {
+	initCache()
+	testCases := []struct {
+		state   int16
+		attempt uint16
+	}{{0, 1}, {0, 2}, {2, 1}, {2, 2}, {2, 3}, {1, 4}, {2, 5}, {0, 1}, {1, 1}}
+	for i, tt := range testCases {
+		updateCacheEntry("host01", "service foo", "output", uint32(1484527962+i), tt.state)
+		if a := cache["host01"]["service foo"].attempt; a != tt.attempt {
+			t.Errorf("Result #%d should be attempt %d, not %d", i, tt.attempt, a)
+		}
+	}
+}
+
+func TestCacheEntryPluginOutput(t *testing.T) {
+	initCache()
+	updateCacheEntry("host01", "disk", "DISK OK | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);", 1484527962, 0)
+	s := cache["host01"]["disk"]
+	if s.output != "DISK OK | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);" {
+		t.Errorf("The plugin output should be kept verbatim. Got %q", s.output)
+	}
+	if s.shortOutput != "DISK OK" || s.longOutput != "/ 15272 MB (77%);" {
+		t.Errorf("Wrong split of the plugin output: %q, %q", s.shortOutput, s.longOutput)
+	}
+	if len(s.perfdata) != 1 || s.perfdata[0].label != "/" || s.perfdata[0].value != 2643 || s.perfdata[0].uom != "MB" {
+		t.Errorf("Wrong performance data: %v", s.perfdata)
+	}
+}
+
+func TestUpdateHostCacheEntry(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	updateCacheEntry("host01", "", "PING CRITICAL - 100% loss", 1484527962, 1)
+	updateCacheEntry("host01", "", "PING CRITICAL - 100% loss", 1484527972, 3)
+	if _, ok := cache["host01"][""]; ok {
+		t.Error("The host check should not be stored as a service")
+	}
+	if svcs, ok := cache["host01"]; !ok || len(svcs) != 0 {
+		t.Errorf("The host should be in the cache without service. Got %v", svcs)
+	}
+	h, ok := hostCache["host01"]
+	if !ok {
+		t.Fatal("host01 should have a host check entry")
+	}
+	// The unknown return code is DOWN like the previous result
+	if h.state != 1 || h.timestamp != 1484527972 || h.statusFirstSeen != 1484527962 || h.attempt != 2 {
+		t.Errorf("Wrong host check entry: %+v", h)
+	}
+	if hostStatusString(h.state) != "Down" || hostStatusString(2) != "Unreachable" || hostStatusString(0) != "Up" {
+		t.Error("Wrong host state strings")
+	}
+	if err := acknowledgeCacheEntry("host01", ""); err != nil || !isAcknowledged("host01", "") {
+		t.Errorf("The host problem should be acknowledged: %v", err)
+	}
+	updateCacheEntry("host01", "", "PING OK", 1484527982, 0)
+	if isAcknowledged("host01", "") {
+		t.Error("The acknowledgement should be removed on recovery")
+	}
+	if err := acknowledgeCacheEntry("host01", ""); err == nil {
+		t.Error("Expecting an error when acknowledging a host UP")
+	}
+	if err := acknowledgeCacheEntry("host02", ""); err == nil {
+		t.Error("Expecting an error when acknowledging a host without host check")
+	}
+
+	// The hosts without host check are UP
+	updateCacheEntry("host02", "disk", "OK", 1484527990, 0)
+	updateCacheEntry("host02", "load", "OK", 1484527995, 0)
+	if s := hostStatus("host02"); s.state != 0 || s.timestamp != 1484527995 || s.statusFirstSeen != 1484527990 || s.shortOutput != "Passive results received for 2 services" {
+		t.Errorf("Wrong status of a host without host check: %+v", s)
+	}
+	if s := hostStatus("host01"); s.shortOutput != "PING OK" {
+		t.Errorf("Wrong status of a host with a host check: %+v", s)
+	}
+
+	// The hosts not UP are problems
+	updateCacheEntry("host02", "", "PING CRITICAL - 100% loss", 1484528000, 1)
+	problems := cacheProblems()
+	if len(problems) != 1 || problems[0].host != "host02" || problems[0].service != "" || problems[0].state != 1 {
+		t.Errorf("Expecting the DOWN host as only problem. Got %v", problems)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons for which the external commands can be rejected, used as label of
+// nscapi_command_file_rejected_total
+const (
+	commandRejectedInvalid = "invalid"
+	commandRejectedTooLong = "too_long"
+)
+
+// commandFilePollInterval is the interval at which a regular command file is
+// checked for new lines
+var commandFilePollInterval = time.Second
+
+// commandFileUnescaper turns the escaped newlines and backslashes of the plugin
+// outputs back into their characters, like Nagios does
+var commandFileUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+// parseCommandState parses the return code of a check result command. The
+// hosts can be UP, DOWN or UNREACHABLE
+func parseCommandState(code string, max int64) (int16, error) {
+	state, err := strconv.ParseInt(code, 10, 16)
+	if err != nil || state < 0 || state > max {
+		return 0, fmt.Errorf("invalid return code '%s'", code)
+	}
+	return int16(state), nil
+}
+
+// unsupportedCommandError is returned for the commands nscapi doesn't handle,
+// counted apart from the invalid ones
+type unsupportedCommandError string
+
+func (e unsupportedCommandError) Error() string {
+	return "unsupported command " + string(e)
+}
+
+// processCommandLine processes a line in the Nagios external command format:
+// "[timestamp] COMMAND;arg1;arg2...". The check results and the
+// acknowledgements are fed into the same queue as the NSCA packets so that they
+// apply in the order of the file. The host check results keep an empty service
+// name like the NSCA host check packets
+func processCommandLine(line string) error {
+	err := runCommandLine(line)
+	if _, unsupported := err.(unsupportedCommandError); err != nil && !unsupported {
+		commandFileRejected.inc(commandRejectedInvalid)
+	}
+	return err
+}
+
+// runCommandLine parses and queues a command line for processCommandLine
+func runCommandLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	if !strings.HasPrefix(line, "[") || !strings.Contains(line, "]") {
+		return fmt.Errorf("missing timestamp")
+	}
+	end := strings.Index(line, "]")
+	timestamp, err := strconv.ParseUint(line[1:end], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp '%s'", line[1:end])
+	}
+	parts := strings.SplitN(strings.TrimSpace(line[end+1:]), ";", 2)
+	command, args := parts[0], ""
+	if len(parts) == 2 {
+		args = parts[1]
+	}
+
+	switch command {
+	case "PROCESS_SERVICE_CHECK_RESULT":
+		fields := strings.SplitN(args, ";", 4)
+		if len(fields) != 4 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("%s expects host;service;return code;output", command)
+		}
+		state, err := parseCommandState(fields[2], 3)
+		if err != nil {
+			return err
+		}
+		queueResult(&nsca.DataPacket{HostName: fields[0], Service: fields[1], State: state, PluginOutput: commandFileUnescaper.Replace(fields[3]), Timestamp: uint32(timestamp)}, "commandfile")
+	case "PROCESS_HOST_CHECK_RESULT":
+		fields := strings.SplitN(args, ";", 3)
+		if len(fields) != 3 || fields[0] == "" {
+			return fmt.Errorf("%s expects host;return code;output", command)
+		}
+		state, err := parseCommandState(fields[1], 2)
+		if err != nil {
+			return err
+		}
+		queueResult(&nsca.DataPacket{HostName: fields[0], State: state, PluginOutput: commandFileUnescaper.Replace(fields[2]), Timestamp: uint32(timestamp)}, "commandfile")
+	case "ACKNOWLEDGE_SVC_PROBLEM":
+		fields := strings.Split(args, ";")
+		// An empty service would acknowledge the host check
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("%s expects host;service;...", command)
+		}
+		queueAcknowledgement(fields[0], fields[1], "commandfile")
+	case "ACKNOWLEDGE_HOST_PROBLEM":
+		fields := strings.Split(args, ";")
+		if fields[0] == "" {
+			return fmt.Errorf("%s expects host;...", command)
+		}
+		queueAcknowledgement(fields[0], "", "commandfile")
+	default:
+		commandFileIgnored.inc(command)
+		return unsupportedCommandError(command)
+	}
+	return nil
+}
+
+// commandLineBuffer accumulates the fragments of a command line. The lines
+// longer than resultsMaxBodySize are skipped instead of stopping the reader
+type commandLineBuffer struct {
+	line    []byte
+	tooLong bool
+}
+
+// write appends a fragment of the line, read up to the next newline
+func (b *commandLineBuffer) write(fragment []byte) {
+	if b.tooLong {
+		return
+	}
+	if len(b.line)+len(fragment) > resultsMaxBodySize {
+		b.tooLong = true
+		b.line = b.line[:0]
+		return
+	}
+	b.line = append(b.line, fragment...)
+}
+
+// pending tells whether fragments of an unfinished line have been written
+func (b *commandLineBuffer) pending() bool {
+	return len(b.line) > 0 || b.tooLong
+}
+
+// flush processes the complete line and resets the buffer
+func (b *commandLineBuffer) flush() {
+	if b.tooLong {
+		log.Printf("Ignoring an external command longer than %d bytes", resultsMaxBodySize)
+		commandFileRejected.inc(commandRejectedTooLong)
+	} else if err := processCommandLine(string(b.line)); err != nil {
+		log.Printf("Ignoring the external command %q: %s", strings.TrimSpace(string(b.line)), err)
+	}
+	b.reset()
+}
+
+// reset drops the fragments written since the last line
+func (b *commandLineBuffer) reset() {
+	b.line, b.tooLong = b.line[:0], false
+}
+
+// readCommandLines processes the lines read until the end of the reader, the
+// last line being processed even without its newline
+func readCommandLines(r io.Reader) {
+	br := bufio.NewReader(r)
+	var buf commandLineBuffer
+	for {
+		fragment, err := br.ReadSlice('\n')
+		buf.write(fragment)
+		switch err {
+		case nil:
+			buf.flush()
+		case bufio.ErrBufferFull:
+		default:
+			if buf.pending() {
+				buf.flush()
+			}
+			return
+		}
+	}
+}
+
+// readCommandPipe reads the commands written to a named pipe. The pipe is
+// opened for writing too so that it doesn't reach its end when the writers
+// close it
+func readCommandPipe(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer f.Close()
+		readCommandLines(f)
+		log.Printf("Stopped reading the command pipe %s", path)
+	}()
+	return nil
+}
+
+// tailCommandFile reads the commands appended to a regular file, starting from
+// its end. The file is read from its beginning again when it is truncated or
+// replaced
+func tailCommandFile(path string, stop <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	poll := commandFilePollInterval
+	go func() {
+		defer func() { f.Close() }()
+		r := bufio.NewReader(f)
+		var buf commandLineBuffer
+		// drain processes the complete lines written since the last poll
+		drain := func() {
+			for {
+				fragment, err := r.ReadSlice('\n')
+				offset += int64(len(fragment))
+				buf.write(fragment)
+				if err == bufio.ErrBufferFull {
+					continue
+				}
+				if err != nil {
+					return
+				}
+				buf.flush()
+			}
+		}
+		for {
+			drain()
+			select {
+			case <-stop:
+				return
+			case <-time.After(poll):
+			}
+			current, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			opened, err := f.Stat()
+			if err == nil && os.SameFile(current, opened) && current.Size() >= offset {
+				continue
+			}
+			// The file has been truncated or replaced. The lines written to the
+			// replaced file before its replacement are processed first
+			if reopened, err := os.Open(path); err == nil {
+				drain()
+				f.Close()
+				f, offset = reopened, 0
+				buf.reset()
+				r.Reset(f)
+			}
+		}
+	}()
+	return nil
+}
+
+// initCommandFile starts reading the Nagios external commands from a named
+// pipe or a regular file. An empty path disables it
+func initCommandFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeNamedPipe != 0 {
+		return readCommandPipe(path)
+	}
+	return tailCommandFile(path, nil)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessCommandLine(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	commandFileIgnored = labeledCounter{}
+	commandFileRejected = labeledCounter{}
+	updateCacheEntry("web01", "apache", "CRITICAL - down", 1484527962, 2)
+	updateCacheEntry("web02", "", "PING CRITICAL", 1484527962, 1)
+
+	cases := []struct {
+		line        string
+		err         bool
+		expected    *nsca.DataPacket
+		acknowledge bool
+	}{
+		{"[1484527962] PROCESS_SERVICE_CHECK_RESULT;web01;disk;1;WARNING - 85% used;/var\\n/var 85%|used=85%",
+			false, &nsca.DataPacket{HostName: "web01", Service: "disk", State: 1, PluginOutput: "WARNING - 85% used;/var\n/var 85%|used=85%", Timestamp: 1484527962}, false},
+		{"[1484527963] PROCESS_HOST_CHECK_RESULT;web03;1;PING CRITICAL - C:\\\\temp",
+			false, &nsca.DataPacket{HostName: "web03", State: 1, PluginOutput: "PING CRITICAL - C:\\temp", Timestamp: 1484527963}, false},
+		{"", false, nil, false},
+		{"[1484527964] ACKNOWLEDGE_SVC_PROBLEM;web01;apache;2;1;1;admin;Working on it", false, &nsca.DataPacket{HostName: "web01", Service: "apache"}, true},
+		{"[1484527964] ACKNOWLEDGE_HOST_PROBLEM;web02;2;1;1;admin;Working on it", false, &nsca.DataPacket{HostName: "web02"}, true},
+		{"[1484527964] ACKNOWLEDGE_SVC_PROBLEM;web01", true, nil, false},
+		{"[1484527964] ACKNOWLEDGE_SVC_PROBLEM;web02;;2;1;1;admin;Working on it", true, nil, false},
+		{"[1484527964] SCHEDULE_SVC_DOWNTIME;web01;apache;1484527964;1484531564;1;0;3600;admin;Upgrade", true, nil, false},
+		{"[1484527964] PROCESS_SERVICE_CHECK_RESULT;web01;disk;4;UNKNOWN", true, nil, false},
+		{"[1484527964] PROCESS_HOST_CHECK_RESULT;web01;3;UNKNOWN", true, nil, false},
+		{"[1484527964] PROCESS_SERVICE_CHECK_RESULT;web01;disk", true, nil, false},
+		{"[now] PROCESS_HOST_CHECK_RESULT;web01;0;UP", true, nil, false},
+		{"PROCESS_HOST_CHECK_RESULT;web01;0;UP", true, nil, false},
+	}
+	for _, tt := range cases {
+		q = lfc.NewQueue()
+		if err := processCommandLine(tt.line); (err != nil) != tt.err {
+			t.Errorf("%q: expecting an error: %t. Got %v", tt.line, tt.err, err)
+		}
+		item, ok := q.Dequeue()
+		if tt.expected == nil {
+			if ok {
+				t.Errorf("%q: expecting no result in the queue", tt.line)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%q: expecting a result in the queue", tt.line)
+		} else if qp := item.(*queuedPacket); !reflect.DeepEqual(qp.packet, tt.expected) || qp.acknowledge != tt.acknowledge {
+			t.Errorf("%q: expecting %+v (acknowledgement: %t). Got %+v (acknowledgement: %t)", tt.line, tt.expected, tt.acknowledge, qp.packet, qp.acknowledge)
+		}
+	}
+
+	// The acknowledgements apply in the order of the lines, after the results
+	// queued before them
+	q = lfc.NewQueue()
+	for _, line := range []string{
+		"[1484527964] ACKNOWLEDGE_SVC_PROBLEM;web01;apache;2;1;1;admin;Working on it",
+		"[1484527964] ACKNOWLEDGE_HOST_PROBLEM;web02;2;1;1;admin;Working on it",
+		"[1484527964] PROCESS_SERVICE_CHECK_RESULT;web04;disk;2;CRITICAL - full",
+		"[1484527965] ACKNOWLEDGE_SVC_PROBLEM;web04;disk;2;1;1;admin;Working on it",
+		"[1484527965] ACKNOWLEDGE_SVC_PROBLEM;web01;nonExisting;2;1;1;admin;Working on it",
+	} {
+		if err := processCommandLine(line); err != nil {
+			t.Errorf("%q: unexpected error %s", line, err)
+		}
+	}
+	cacheWorker(false)
+	if !isAcknowledged("web01", "apache") || !isAcknowledged("web02", "") || !isAcknowledged("web04", "disk") {
+		t.Error("The service and host problems should be acknowledged")
+	}
+	if commandFileIgnored.values["SCHEDULE_SVC_DOWNTIME"] != 1 {
+		t.Errorf("Expecting the unsupported command to be counted. Got %v", commandFileIgnored.values)
+	}
+	if n := commandFileRejected.values[commandRejectedInvalid]; n != 7 {
+		t.Errorf("Expecting 7 invalid commands, got %d", n)
+	}
+}
+
+func TestReadCommandLines(t *testing.T) {
+	q = lfc.NewQueue()
+	commandFileRejected = labeledCounter{}
+
+	// The lines longer than the limit are skipped without stopping the reader,
+	// and the last line is processed without its newline
+	long := "[1484527962] PROCESS_HOST_CHECK_RESULT;web02;0;" + strings.Repeat("x", resultsMaxBodySize) + "\n"
+	readCommandLines(strings.NewReader("[1484527962] PROCESS_HOST_CHECK_RESULT;web01;0;UP\n" + long + "[1484527963] PROCESS_HOST_CHECK_RESULT;web03;0;UP"))
+	for _, host := range []string{"web01", "web03"} {
+		item, ok := q.Dequeue()
+		if !ok {
+			t.Fatalf("Expecting a result of %s", host)
+		}
+		if p := item.(*queuedPacket).packet; p.HostName != host {
+			t.Errorf("Expecting a result of %s. Got %+v", host, p)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expecting the long line to be skipped. Got %d more results", q.Len())
+	}
+	if n := commandFileRejected.values[commandRejectedTooLong]; n != 1 {
+		t.Errorf("Expecting 1 line too long, got %d", n)
+	}
+}
+
+// waitQueueLength waits for the queue to reach the given length
+func waitQueueLength(length int) bool {
+	for i := 0; i < 100; i++ {
+		if q.Len() >= length {
+			return q.Len() == length
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTailCommandFile(t *testing.T) {
+	q = lfc.NewQueue()
+	commandFilePollInterval = 10 * time.Millisecond
+	defer func() { commandFilePollInterval = time.Second }()
+	dir, err := ioutil.TempDir("", "nscapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nagios.cmd")
+	ioutil.WriteFile(path, []byte("[1484527962] PROCESS_HOST_CHECK_RESULT;old;0;UP\n"), 0644)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := tailCommandFile(path, stop); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("[1484527963] PROCESS_HOST_CHECK_RESULT;web01;0;UP\n[1484527964] PROCESS_HOST_")
+	f.Sync()
+	if !waitQueueLength(1) {
+		t.Fatalf("Expecting only the complete new line to be processed. Got %d results", q.Len())
+	}
+	f.WriteString("CHECK_RESULT;web02;0;UP\n")
+	f.Close()
+	if !waitQueueLength(2) {
+		t.Fatalf("Expecting the line to be processed once completed. Got %d results", q.Len())
+	}
+
+	// Replace the file like a rotation
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("[1484527965] PROCESS_HOST_CHECK_RESULT;web03;0;UP\n"), 0644)
+	if !waitQueueLength(3) {
+		t.Fatalf("Expecting the new file to be read. Got %d results", q.Len())
+	}
+	for _, host := range []string{"web01", "web02", "web03"} {
+		item, _ := q.Dequeue()
+		if p := item.(*queuedPacket).packet; p.HostName != host {
+			t.Errorf("Expecting a result of %s. Got %+v", host, p)
+		}
+	}
+}
+
+func TestInitCommandFile(t *testing.T) {
+	if err := initCommandFile(""); err != nil {
+		t.Errorf("An empty path should disable the command file. Got %s", err)
+	}
+	if err := initCommandFile("testData/nonExisting.cmd"); err == nil {
+		t.Error("Expecting an error for a missing command file")
+	}
+}
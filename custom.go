@@ -1,11 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 )
 
 type customFields struct {
@@ -29,8 +31,15 @@ func (f *customFields) load(rootPath string) error {
 	if _, err := os.Stat(rootPath); err != nil {
 		return err
 	}
-	// 1st common.yaml. Just ignore the errors for now
-	commonFields, _ := f.processYamlFile(filepath.Join(rootPath, "common.yaml"))
+	loaded := 0
+	// 1st common.yaml. Just ignore the errors for now, a missing file is not
+	// even counted as one
+	commonFields, err := f.processYamlFile(filepath.Join(rootPath, "common.yaml"))
+	if err == nil {
+		loaded++
+	} else if !os.IsNotExist(err) {
+		customFieldsLoadErrors.inc()
+	}
 	f.fields[fieldClassifier{"##common##", "all"}] = make(map[string]interface{})
 	if commonFields != nil {
 		f.fields[fieldClassifier{"##common##", "all"}] = commonFields
@@ -39,12 +48,19 @@ func (f *customFields) load(rootPath string) error {
 	files, _ := filepath.Glob(filepath.Join(rootPath, "service", "*", "*.yaml"))
 	for _, file := range files {
 		key := fieldClassifier{filepath.Base(filepath.Dir(file)), filepath.Base(file[:len(file)-5])}
-		fields, _ := f.processYamlFile(file)
+		fields, err := f.processYamlFile(file)
+		if err == nil {
+			loaded++
+		} else {
+			customFieldsLoadErrors.inc()
+		}
 		f.fields[key] = make(map[string]interface{})
 		if fields != nil {
 			f.fields[key] = fields
 		}
 	}
+	customFieldsFilesLoaded.set(float64(loaded))
+	customFieldsLastLoadTime.set(float64(time.Now().Unix()))
 	return nil
 }
 
@@ -70,13 +86,39 @@ func (f *customFields) lookup(reference map[string]interface{}, key *fieldClassi
 	}
 }
 
+// hostgroupRegexp matches the trailing number removed from a hostname to get
+// its hostgroup
+var hostgroupRegexp = regexp.MustCompile("[0-9]*$")
+
+// hostgroupOf returns the hostgroup of a given hostname, which is the hostname
+// minus any trailing number
+func hostgroupOf(hostname string) string {
+	return hostgroupRegexp.ReplaceAllString(hostname, "")
+}
+
 // get returns a hash containing the custom fields specific for this hostname and checkName
 func (f *customFields) get(hostname, checkName string) map[string]interface{} {
-	re, _ := regexp.Compile("[0-9]*$")
-	hostgroup := re.ReplaceAllString(hostname, "")
+	hostgroup := hostgroupOf(hostname)
 	resultFields := make(map[string]interface{})
 	f.lookup(resultFields, &fieldClassifier{"##common##", "all"})
 	f.lookup(resultFields, &fieldClassifier{hostgroup, "all"})
 	f.lookup(resultFields, &fieldClassifier{hostgroup, checkName})
 	return resultFields
 }
+
+// getStrings returns the value of the given field of an already resolved custom
+// fields map as a list of strings. Fields defined as a single value in the yaml
+// hierarchy are returned as a list of one element
+func getStrings(fields map[string]interface{}, fieldName string) []string {
+	var values []string
+	switch v := fields[fieldName].(type) {
+	case nil:
+	case []interface{}:
+		for _, elem := range v {
+			values = append(values, fmt.Sprint(elem))
+		}
+	default:
+		values = append(values, fmt.Sprint(v))
+	}
+	return values
+}
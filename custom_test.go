@@ -185,3 +185,33 @@ func TestLoad(t *testing.T) {
 		}
 	}
 }
+
+func TestHostgroupOf(t *testing.T) {
+	cases := []struct {
+		in  string
+		out string
+	}{{"web01", "web"}, {"db", "db"}, {"app2db10", "app2db"}, {"", ""}}
+	for _, tt := range cases {
+		if returned := hostgroupOf(tt.in); returned != tt.out {
+			t.Errorf("hostgroupOf(%s) should return %s, not %s", tt.in, tt.out, returned)
+		}
+	}
+}
+
+func TestGetStrings(t *testing.T) {
+	fields := map[string]interface{}{"team": []interface{}{"dba", "ops"}, "runbook": "https://wiki.example.org", "paging": true}
+	cases := []struct {
+		field    string
+		expected []string
+	}{
+		{"team", []string{"dba", "ops"}},
+		{"runbook", []string{"https://wiki.example.org"}},
+		{"paging", []string{"true"}},
+		{"nonExisting", nil},
+	}
+	for _, tt := range cases {
+		if returned := getStrings(fields, tt.field); !reflect.DeepEqual(returned, tt.expected) {
+			t.Errorf("getStrings of %s should return %v, not %v", tt.field, tt.expected, returned)
+		}
+	}
+}
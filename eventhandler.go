@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventHandlers runs the event handlers. It stays nil when they are not enabled
+var eventHandlers *eventHandlerRunner
+
+// eventHandlerMaxOutput is the number of bytes of the output of an event
+// handler kept for the API
+const eventHandlerMaxOutput = 8192
+
+// eventHandlersConfig is the content of the event handlers configuration file
+type eventHandlersConfig struct {
+	// Field is the custom field containing the name of the event handler of a
+	// check. Default to "eventHandler"
+	Field string `yaml:"field"`
+	// AttemptsField is the custom field containing the number of consecutive
+	// non-OK results after which the state of a check is considered as HARD.
+	// Default to "maxCheckAttempts". Checks without this field have a HARD state
+	// from their first result
+	AttemptsField string `yaml:"attemptsField"`
+	// MaxConcurrent is the number of event handlers that can run at the same
+	// time. Default to 4
+	MaxConcurrent int `yaml:"maxConcurrent"`
+	// Timeout after which an event handler is killed. Default to 30s
+	Timeout  time.Duration                  `yaml:"timeout"`
+	Handlers map[string]*eventHandlerConfig `yaml:"handlers"`
+}
+
+// eventHandlerConfig defines the local command of an event handler. The
+// command is not run through a shell
+type eventHandlerConfig struct {
+	Command []string `yaml:"command"`
+}
+
+// eventHandlerJob is a check result that may trigger an event handler
+type eventHandlerJob struct {
+	host          string
+	service       string
+	state         int16
+	previousState int16
+	attempt       uint16
+	output        string
+	longOutput    string
+}
+
+// eventHandlerRun is the result of the last execution of an event handler for
+// a check
+type eventHandlerRun struct {
+	Host      string    `json:"hostname"`
+	Service   string    `json:"service"`
+	Handler   string    `json:"handler"`
+	State     string    `json:"state"`
+	StateType string    `json:"stateType"`
+	Attempt   uint16    `json:"attempt"`
+	StartedAt time.Time `json:"startedAt"`
+	Duration  float64   `json:"durationSeconds"`
+	ExitCode  int       `json:"exitCode"`
+	Error     string    `json:"error,omitempty"`
+	Output    string    `json:"output"`
+}
+
+// eventHandlerRunner runs the event handlers with a limited concurrency and
+// keeps the result of the last execution per check. The jobs are sharded per
+// check over one queue per routine, so that the event handlers of a check run
+// one at a time and in the order of its results
+type eventHandlerRunner struct {
+	conf *eventHandlersConfig
+	jobs []chan *eventHandlerJob
+	mu   sync.RWMutex
+	runs map[checkKey]*eventHandlerRun
+}
+
+// loadEventHandlersConfig reads the yaml event handlers configuration file and
+// applies the defaults
+func loadEventHandlersConfig(path string) (*eventHandlersConfig, error) {
+	conf := &eventHandlersConfig{}
+	fc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	if err = yaml.Unmarshal(fc, conf); err != nil {
+		return conf, err
+	}
+	if conf.Field == "" {
+		conf.Field = "eventHandler"
+	}
+	if conf.AttemptsField == "" {
+		conf.AttemptsField = "maxCheckAttempts"
+	}
+	if conf.MaxConcurrent <= 0 {
+		conf.MaxConcurrent = 4
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 30 * time.Second
+	}
+	for name, handler := range conf.Handlers {
+		if handler == nil || len(handler.Command) == 0 {
+			return conf, fmt.Errorf("event handler %s has no command", name)
+		}
+	}
+	return conf, nil
+}
+
+// newEventHandlerRunner creates the event handler runner with one queue per
+// concurrent event handler, without starting it
+func newEventHandlerRunner(conf *eventHandlersConfig) *eventHandlerRunner {
+	shards := conf.MaxConcurrent
+	if shards <= 0 {
+		shards = 1
+	}
+	r := &eventHandlerRunner{
+		conf: conf,
+		jobs: make([]chan *eventHandlerJob, shards),
+		runs: make(map[checkKey]*eventHandlerRun),
+	}
+	for i := range r.jobs {
+		r.jobs[i] = make(chan *eventHandlerJob, notificationQueueSize)
+	}
+	return r
+}
+
+// queueFor returns the queue of the jobs of a check
+func (r *eventHandlerRunner) queueFor(hostname, servicename string) chan *eventHandlerJob {
+	h := fnv.New32a()
+	io.WriteString(h, hostname)
+	h.Write([]byte{0})
+	io.WriteString(h, servicename)
+	return r.jobs[h.Sum32()%uint32(len(r.jobs))]
+}
+
+// initEventHandlers loads the event handlers configuration and starts the
+// routines running them. Event handlers are disabled when no configuration
+// file is given
+func initEventHandlers(configPath string) error {
+	if configPath == "" {
+		return nil
+	}
+	conf, err := loadEventHandlersConfig(configPath)
+	if err != nil {
+		return err
+	}
+	runner := newEventHandlerRunner(conf)
+	for _, jobs := range runner.jobs {
+		go func(jobs chan *eventHandlerJob) {
+			for job := range jobs {
+				runner.process(job)
+			}
+		}(jobs)
+	}
+	eventHandlers = runner
+	return nil
+}
+
+// queueEventHandler hands a check result over to the event handlers. Only the
+// state changes and the non-OK results can trigger an event handler. It never
+// blocks the cache worker: the result is dropped if the queue is full
+func queueEventHandler(hostname, servicename string, entry *serviceEntry, previousState int16) {
+	if eventHandlers == nil || (entry.state == 0 && previousState == 0) {
+		return
+	}
+	job := &eventHandlerJob{
+		host:          hostname,
+		service:       servicename,
+		state:         entry.state,
+		previousState: previousState,
+		attempt:       entry.attempt,
+		output:        entry.shortOutput,
+		longOutput:    entry.longOutput,
+	}
+	select {
+	case eventHandlers.queueFor(hostname, servicename) <- job:
+	default:
+		queueDrops.inc("eventhandlers")
+		log.Printf("Event handler queue full, dropping result of %s", checkName(hostname, servicename))
+	}
+}
+
+// maxAttempts returns the number of attempts after which the state of the
+// check becomes HARD
+func (r *eventHandlerRunner) maxAttempts(custom map[string]interface{}) uint16 {
+	if values := getStrings(custom, r.conf.AttemptsField); len(values) > 0 {
+		if max, err := strconv.ParseUint(values[0], 10, 16); err == nil && max > 0 {
+			return uint16(max)
+		}
+	}
+	return 1
+}
+
+// stateType returns SOFT or HARD like Nagios does based on the attempt
+func stateType(state int16, attempt, maxAttempts uint16) string {
+	if state != 0 && attempt < maxAttempts {
+		return "SOFT"
+	}
+	return "HARD"
+}
+
+// process runs the event handler of the check if the result is a state change
+// or a soft attempt, the same way Nagios does
+func (r *eventHandlerRunner) process(job *eventHandlerJob) {
+	custom := cFields.get(job.host, job.service)
+	names := getStrings(custom, r.conf.Field)
+	if len(names) == 0 {
+		return
+	}
+	max := r.maxAttempts(custom)
+	if job.state == job.previousState && job.attempt > max {
+		return
+	}
+	handler, ok := r.conf.Handlers[names[0]]
+	if !ok {
+		log.Printf("Unknown event handler '%s' for %s", names[0], checkName(job.host, job.service))
+		return
+	}
+	run := r.execute(names[0], handler, job, stateType(job.state, job.attempt, max))
+	if run.Error != "" {
+		log.Printf("Event handler %s of %s failed: %s", run.Handler, checkName(job.host, job.service), run.Error)
+	}
+	r.mu.Lock()
+	r.runs[checkKey{job.host, job.service}] = run
+	r.mu.Unlock()
+}
+
+// eventHandlerEnv returns the environment variables describing the check
+// result passed to the event handlers. The host checks get the NSCAPI_HOST*
+// variables instead of the NSCAPI_SERVICE* ones
+func eventHandlerEnv(job *eventHandlerJob, stateType string) []string {
+	if job.service == "" {
+		return []string{
+			"NSCAPI_HOSTNAME=" + job.host,
+			"NSCAPI_HOSTSTATE=" + strings.ToUpper(hostStatusString(job.state)),
+			"NSCAPI_HOSTSTATEID=" + fmt.Sprint(job.state),
+			"NSCAPI_LASTHOSTSTATE=" + strings.ToUpper(hostStatusString(job.previousState)),
+			"NSCAPI_HOSTSTATETYPE=" + stateType,
+			"NSCAPI_HOSTATTEMPT=" + fmt.Sprint(job.attempt),
+			"NSCAPI_HOSTOUTPUT=" + job.output,
+			"NSCAPI_LONGHOSTOUTPUT=" + job.longOutput,
+		}
+	}
+	return []string{
+		"NSCAPI_HOSTNAME=" + job.host,
+		"NSCAPI_SERVICEDESC=" + job.service,
+		"NSCAPI_SERVICESTATE=" + strings.ToUpper(statusString(job.state)),
+		"NSCAPI_SERVICESTATEID=" + fmt.Sprint(job.state),
+		"NSCAPI_LASTSERVICESTATE=" + strings.ToUpper(statusString(job.previousState)),
+		"NSCAPI_SERVICESTATETYPE=" + stateType,
+		"NSCAPI_SERVICEATTEMPT=" + fmt.Sprint(job.attempt),
+		"NSCAPI_SERVICEOUTPUT=" + job.output,
+		"NSCAPI_LONGSERVICEOUTPUT=" + job.longOutput,
+	}
+}
+
+// execute runs the command of an event handler with the timeout and captures
+// its output
+func (r *eventHandlerRunner) execute(name string, handler *eventHandlerConfig, job *eventHandlerJob, stateType string) *eventHandlerRun {
+	run := &eventHandlerRun{
+		Host:      job.host,
+		Service:   job.service,
+		Handler:   name,
+		State:     checkStatusString(job.service, job.state),
+		StateType: stateType,
+		Attempt:   job.attempt,
+		StartedAt: time.Now(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.conf.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, handler.Command[0], handler.Command[1:]...)
+	cmd.Env = append(os.Environ(), eventHandlerEnv(job, stateType)...)
+	output, err := cmd.CombinedOutput()
+	run.Duration = time.Since(run.StartedAt).Seconds()
+	if len(output) > eventHandlerMaxOutput {
+		output = output[len(output)-eventHandlerMaxOutput:]
+	}
+	run.Output = string(output)
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		run.ExitCode = -1
+		run.Error = fmt.Sprintf("killed after a timeout of %s", r.conf.Timeout)
+	case err != nil:
+		run.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			run.ExitCode = exitErr.ExitCode()
+		}
+		run.Error = err.Error()
+	}
+	return run
+}
+
+// lastRuns returns the last execution of the event handler of each check,
+// sorted by host and service
+func (r *eventHandlerRunner) lastRuns() []*eventHandlerRun {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	runs := make([]*eventHandlerRun, 0, len(r.runs))
+	for _, run := range r.runs {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Host != runs[j].Host {
+			return runs[i].Host < runs[j].Host
+		}
+		return runs[i].Service < runs[j].Service
+	})
+	return runs
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadEventHandlersConfig(t *testing.T) {
+	conf, err := loadEventHandlersConfig("testData/eventhandlers.yaml")
+	if err != nil {
+		t.Fatalf("loadEventHandlersConfig returned: %s", err)
+	}
+	if conf.Field != "eventHandler" || conf.AttemptsField != "maxCheckAttempts" {
+		t.Errorf("Wrong default fields: %s, %s", conf.Field, conf.AttemptsField)
+	}
+	if conf.MaxConcurrent != 2 || conf.Timeout != 10*time.Second {
+		t.Errorf("Wrong limits loaded: %d, %s", conf.MaxConcurrent, conf.Timeout)
+	}
+	if len(conf.Handlers) != 3 || conf.Handlers["slow"].Command[0] != "sleep" {
+		t.Errorf("Wrong handlers loaded: %v", conf.Handlers)
+	}
+	if _, err = loadEventHandlersConfig("testData/nonExistingFile.yaml"); err == nil {
+		t.Errorf("loadEventHandlersConfig should fail on a non-existing file")
+	}
+}
+
+func TestStateType(t *testing.T) {
+	cases := []struct {
+		state       int16
+		attempt     uint16
+		maxAttempts uint16
+		expected    string
+	}{
+		{0, 1, 3, "HARD"},
+		{2, 1, 1, "HARD"},
+		{2, 1, 3, "SOFT"},
+		{2, 2, 3, "SOFT"},
+		{2, 3, 3, "HARD"},
+		{2, 4, 3, "HARD"},
+	}
+	for _, tt := range cases {
+		if returned := stateType(tt.state, tt.attempt, tt.maxAttempts); returned != tt.expected {
+			t.Errorf("stateType(%d, %d, %d) should return %s, not %s", tt.state, tt.attempt, tt.maxAttempts, tt.expected, returned)
+		}
+	}
+}
+
+func TestEventHandlerProcess(t *testing.T) {
+	conf, _ := loadEventHandlersConfig("testData/eventhandlers.yaml")
+	conf.Timeout = 100 * time.Millisecond
+	r := newEventHandlerRunner(conf)
+	cFields = customFields{fields: map[fieldClassifier]map[string]interface{}{
+		{hostgroup: "web", service: "apache"}: {"eventHandler": "restart_apache", "maxCheckAttempts": 3},
+		{hostgroup: "web", service: "fail"}:   {"eventHandler": "failing"},
+		{hostgroup: "web", service: "slow"}:   {"eventHandler": "slow"},
+		{hostgroup: "web", service: "other"}:  {"eventHandler": "nonExisting"},
+	}}
+	defer func() { cFields = customFields{} }()
+
+	cases := []struct {
+		job    *eventHandlerJob
+		run    bool
+		output string
+	}{
+		{&eventHandlerJob{host: "web01", service: "apache", state: 2, previousState: 0, attempt: 1, output: "down"}, true, "web01 apache CRITICAL SOFT 1 down\n"},
+		{&eventHandlerJob{host: "web01", service: "apache", state: 2, previousState: 2, attempt: 3, output: "down"}, true, "web01 apache CRITICAL HARD 3 down\n"},
+		// No more runs once the state is HARD
+		{&eventHandlerJob{host: "web02", service: "apache", state: 2, previousState: 2, attempt: 4, output: "down"}, false, ""},
+		{&eventHandlerJob{host: "web03", service: "apache", state: 0, previousState: 2, attempt: 1, output: "up"}, true, "web03 apache OK HARD 1 up\n"},
+		// No event handler or unknown one
+		{&eventHandlerJob{host: "db01", service: "disk", state: 2, previousState: 0, attempt: 1}, false, ""},
+		{&eventHandlerJob{host: "web01", service: "other", state: 2, previousState: 0, attempt: 1}, false, ""},
+	}
+	for _, tt := range cases {
+		r.process(tt.job)
+		run, ok := r.runs[checkKey{tt.job.host, tt.job.service}]
+		if ok != tt.run {
+			t.Errorf("Event handler of %s/%s attempt %d: expecting run to be %t", tt.job.host, tt.job.service, tt.job.attempt, tt.run)
+			continue
+		}
+		if ok && (run.Output != tt.output || run.ExitCode != 0 || run.Error != "") {
+			t.Errorf("Wrong run of the event handler of %s/%s: %v", tt.job.host, tt.job.service, run)
+		}
+	}
+
+	r.process(&eventHandlerJob{host: "web01", service: "fail", state: 2, previousState: 0, attempt: 1})
+	if run := r.runs[checkKey{"web01", "fail"}]; run.ExitCode != 3 || run.Output != "failed\n" || run.Error == "" {
+		t.Errorf("Wrong run of the failing event handler: %v", run)
+	}
+	r.process(&eventHandlerJob{host: "web01", service: "slow", state: 2, previousState: 0, attempt: 1})
+	if run := r.runs[checkKey{"web01", "slow"}]; run.ExitCode != -1 || !strings.HasPrefix(run.Error, "killed after a timeout") || run.Duration > 1 {
+		t.Errorf("Wrong run of the slow event handler: %v", run)
+	}
+
+	runs := r.lastRuns()
+	if len(runs) != 4 || runs[0].Host != "web01" || runs[0].Service != "apache" || runs[3].Host != "web03" {
+		t.Errorf("Wrong list of last runs: %v", runs)
+	}
+}
+
+func TestEventHandlerQueueFor(t *testing.T) {
+	r := newEventHandlerRunner(&eventHandlersConfig{MaxConcurrent: 4})
+	if len(r.jobs) != 4 {
+		t.Fatalf("Expecting one queue per concurrent event handler. Got %d", len(r.jobs))
+	}
+	used := make(map[chan *eventHandlerJob]bool)
+	for i := 0; i < 100; i++ {
+		host := fmt.Sprintf("web%02d", i)
+		if r.queueFor(host, "apache") != r.queueFor(host, "apache") {
+			t.Errorf("The jobs of %s/apache should always go to the same queue", host)
+		}
+		used[r.queueFor(host, "apache")] = true
+	}
+	if len(used) != 4 {
+		t.Errorf("Expecting the checks to be spread over the 4 queues. Got %d", len(used))
+	}
+	if r = newEventHandlerRunner(&eventHandlersConfig{}); len(r.jobs) != 1 {
+		t.Errorf("Expecting a single queue without concurrency. Got %d", len(r.jobs))
+	}
+}
+
+func TestQueueEventHandler(t *testing.T) {
+	initCache()
+	eventHandlers = newEventHandlerRunner(&eventHandlersConfig{MaxConcurrent: 4})
+	defer func() { eventHandlers = nil }()
+	jobs := eventHandlers.queueFor("web01", "apache")
+
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+	if len(jobs) != 0 {
+		t.Errorf("OK results without state change should not be queued")
+	}
+	updateCacheEntry("web01", "apache", "Critical\nport 80 closed\nport 443 closed", 1484527963, 2)
+	updateCacheEntry("web01", "apache", "Critical", 1484527964, 2)
+	updateCacheEntry("web01", "apache", "OK", 1484527965, 0)
+	if len(jobs) != 3 {
+		t.Fatalf("Expecting 3 queued results. Got %d", len(jobs))
+	}
+	if job := <-jobs; job.state != 2 || job.previousState != 0 || job.attempt != 1 || job.output != "Critical" || job.longOutput != "port 80 closed\nport 443 closed" {
+		t.Errorf("Wrong first job: %v", job)
+	}
+	if job := <-jobs; job.state != 2 || job.previousState != 2 || job.attempt != 2 {
+		t.Errorf("Wrong second job: %v", job)
+	}
+	<-jobs
+
+	// Host checks
+	updateCacheEntry("web01", "", "PING OK", 1484527970, 0)
+	updateCacheEntry("web01", "", "PING CRITICAL - 100% loss", 1484527971, 1)
+	hostJobs := eventHandlers.queueFor("web01", "")
+	if len(hostJobs) != 1 {
+		t.Fatalf("Expecting 1 queued host result. Got %d", len(hostJobs))
+	}
+	job := <-hostJobs
+	if job.host != "web01" || job.service != "" || job.state != 1 || job.previousState != 0 {
+		t.Errorf("Wrong host job: %v", job)
+	}
+	env := strings.Join(eventHandlerEnv(job, "SOFT"), "\n")
+	for _, v := range []string{"NSCAPI_HOSTSTATE=DOWN", "NSCAPI_LASTHOSTSTATE=UP", "NSCAPI_HOSTSTATETYPE=SOFT", "NSCAPI_HOSTOUTPUT=PING CRITICAL - 100% loss"} {
+		if !strings.Contains(env, v) {
+			t.Errorf("Missing %s in the host environment:\n%s", v, env)
+		}
+	}
+	if strings.Contains(env, "NSCAPI_SERVICE") {
+		t.Errorf("Unexpected service variables in the host environment:\n%s", env)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+)
+
+// Actions of the filter rules
+const (
+	filterAccept = "accept"
+	filterDeny   = "deny"
+)
+
+// filterSources are the sources of the check results passed to queueResult
+var filterSources = []string{"nsca", "http", "nrdp", "icinga", "zabbix", "commandfile", "line"}
+
+// filterConf contains the filter rules evaluated on every check result. It is
+// nil when no filter is configured
+var filterConf *filterConfig
+
+// filterConfig is the content of the filter rules file
+type filterConfig struct {
+	// Default is the action applied to the results matching no rule: accept
+	// (default) or deny
+	Default string        `yaml:"default"`
+	Rules   []*filterRule `yaml:"rules"`
+}
+
+// filterRule accepts or denies the check results matching all its conditions,
+// the conditions not set matching every result. The first matching rule
+// applies
+type filterRule struct {
+	// Name identifies the rule in the hit counters. Default to "rule <index>"
+	Name   string `yaml:"name"`
+	Action string `yaml:"action"`
+	// Host, Service and Output are regular expressions matching the host name,
+	// the service name (empty for the host checks) and the plugin output
+	Host    string `yaml:"host"`
+	Service string `yaml:"service"`
+	Output  string `yaml:"output"`
+	// States are the return codes matched by the rule
+	States []int16 `yaml:"states"`
+	// Sources are the listeners the results come from, among filterSources
+	Sources   []string `yaml:"sources"`
+	hostRe    *regexp.Regexp
+	serviceRe *regexp.Regexp
+	outputRe  *regexp.Regexp
+}
+
+// loadFilterConfig reads and checks the yaml filter rules file
+func loadFilterConfig(path string) (*filterConfig, error) {
+	fc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &filterConfig{}
+	if err = yaml.Unmarshal(fc, conf); err != nil {
+		return nil, err
+	}
+	if conf.Default == "" {
+		conf.Default = filterAccept
+	}
+	if conf.Default != filterAccept && conf.Default != filterDeny {
+		return nil, fmt.Errorf("invalid default action '%s', expecting %s or %s", conf.Default, filterAccept, filterDeny)
+	}
+	names := make(map[string]bool)
+	for i, rule := range conf.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("filter rule %d is empty", i)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("filter rule %s defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Action != filterAccept && rule.Action != filterDeny {
+			return nil, fmt.Errorf("filter rule %s: invalid action '%s', expecting %s or %s", rule.Name, rule.Action, filterAccept, filterDeny)
+		}
+		for _, source := range rule.Sources {
+			if !containsString(filterSources, source) {
+				return nil, fmt.Errorf("filter rule %s: unknown source '%s'", rule.Name, source)
+			}
+		}
+		for _, re := range []struct {
+			expr   string
+			target **regexp.Regexp
+		}{{rule.Host, &rule.hostRe}, {rule.Service, &rule.serviceRe}, {rule.Output, &rule.outputRe}} {
+			if re.expr == "" {
+				continue
+			}
+			if *re.target, err = regexp.Compile(re.expr); err != nil {
+				return nil, fmt.Errorf("filter rule %s: %s", rule.Name, err)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// matches returns whether a check result received from the given source
+// matches all the conditions of the rule
+func (rule *filterRule) matches(qp *queuedPacket) bool {
+	p := qp.packet
+	if rule.hostRe != nil && !rule.hostRe.MatchString(p.HostName) {
+		return false
+	}
+	if rule.serviceRe != nil && !rule.serviceRe.MatchString(p.Service) {
+		return false
+	}
+	if rule.outputRe != nil && !rule.outputRe.MatchString(p.PluginOutput) {
+		return false
+	}
+	if len(rule.States) > 0 && !containsState(rule.States, p.State) {
+		return false
+	}
+	if len(rule.Sources) > 0 && !containsString(rule.Sources, qp.source) {
+		return false
+	}
+	return true
+}
+
+// containsState returns whether the state is in the list
+func containsState(states []int16, state int16) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// filterResult evaluates the filter rules on a check result, counting the hits
+// of the matching rule. It returns false when the result is denied
+func filterResult(qp *queuedPacket) bool {
+	if filterConf == nil {
+		return true
+	}
+	action := filterConf.Default
+	for _, rule := range filterConf.Rules {
+		if rule.matches(qp) {
+			filterRuleHits.inc(rule.Name)
+			action = rule.Action
+			break
+		}
+	}
+	if action == filterDeny {
+		resultsRejected.inc(rejectedFilter)
+		return false
+	}
+	return true
+}
+
+// initFilter loads the filter rules file. An empty path accepts every result
+func initFilter(path string) error {
+	if path == "" {
+		return nil
+	}
+	conf, err := loadFilterConfig(path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(conf.Rules))
+	for i, rule := range conf.Rules {
+		names[i] = rule.Name
+	}
+	filterRuleHits.declare(names...)
+	filterConf = conf
+	return nil
+}
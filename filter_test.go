@@ -0,0 +1,87 @@
+package main
+
+import (
+	nsca "github.com/tubemogul/nscatools"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFilterConfig(t *testing.T) {
+	conf, err := loadFilterConfig("testData/filter.yaml")
+	if err != nil {
+		t.Fatalf("Unable to load the filter rules: %s", err)
+	}
+	if conf.Default != filterAccept || len(conf.Rules) != 4 || conf.Rules[3].Name != "rule 3" || conf.Rules[0].hostRe == nil {
+		t.Errorf("Wrong filter rules loaded: %+v", conf)
+	}
+
+	dir, _ := ioutil.TempDir("", "nscapi")
+	defer os.RemoveAll(dir)
+	invalid := []string{
+		"default: drop\n",
+		"rules:\n  - action: drop\n",
+		"rules:\n  - action: deny\n    host: '('\n",
+		"rules:\n  - action: deny\n    output: '('\n",
+		"rules:\n  - action: deny\n    sources: [snmp]\n",
+		"rules:\n  - name: a\n    action: deny\n  - name: a\n    action: accept\n",
+		"rules:\n  -\n",
+		"rules: [",
+	}
+	for _, content := range invalid {
+		path := filepath.Join(dir, "filter.yaml")
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err := loadFilterConfig(path); err == nil {
+			t.Errorf("Expecting an error for the rules %q", content)
+		}
+	}
+}
+
+func TestFilterResult(t *testing.T) {
+	defer func() { filterConf = nil }()
+	if !filterResult(&queuedPacket{packet: &nsca.DataPacket{HostName: "test-web01"}, source: "nsca"}) {
+		t.Error("Every result should be accepted without filter")
+	}
+
+	filterRuleHits = labeledCounter{}
+	resultsRejected = labeledCounter{}
+	if err := initFilter("testData/filter.yaml"); err != nil {
+		t.Fatalf("Unable to init the filter: %s", err)
+	}
+	cases := []struct {
+		host, service, output string
+		state                 int16
+		source                string
+		accepted              bool
+	}{
+		{"test-web01", "apache", "OK", 0, "nsca", false},
+		{"web01", "apache", "OK", 0, "nsca", true},
+		{"web01", "apache", "CRITICAL", 2, "zabbix", true},
+		{"web01", "apache", "OK", 0, "zabbix", false},
+		{"web01", "ntp", "NTP OK: offset 0.01s", 0, "http", false},
+		{"web01", "ntp", "NTP WARNING: offset 2s", 1, "http", true},
+		{"web01", "", "PING OK", 0, "line", true},
+	}
+	for _, tt := range cases {
+		qp := &queuedPacket{packet: &nsca.DataPacket{HostName: tt.host, Service: tt.service, PluginOutput: tt.output, State: tt.state}, source: tt.source}
+		if accepted := filterResult(qp); accepted != tt.accepted {
+			t.Errorf("%s/%s from %s: expecting accepted to be %t", tt.host, tt.service, tt.source, tt.accepted)
+		}
+	}
+	expected := map[string]uint64{"test hosts": 1, "keep zabbix problems": 1, "noisy zabbix": 1, "rule 3": 1}
+	for rule, hits := range expected {
+		if filterRuleHits.values[rule] != hits {
+			t.Errorf("Expecting %d hits for the rule %s, got %d", hits, rule, filterRuleHits.values[rule])
+		}
+	}
+	if n := resultsRejected.values[rejectedFilter]; n != 3 {
+		t.Errorf("Expecting 3 denied results, got %d", n)
+	}
+
+	// The results matching no rule get the default action
+	filterConf = &filterConfig{Default: filterDeny}
+	if filterResult(&queuedPacket{packet: &nsca.DataPacket{HostName: "web01"}, source: "nsca"}) {
+		t.Error("Expecting the default action to deny the result")
+	}
+}
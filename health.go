@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// version of nscapi, overridden at build time with
+// -ldflags "-X main.version=x.y.z"
+var version = "dev"
+
+var (
+	// nscaListening is set to 1 once the NSCA server has bound its listener
+	nscaListening int32
+	// customFieldsLoaded is set to 1 once the custom fields hierarchy has been
+	// loaded at startup
+	customFieldsLoaded int32
+	// readyMaxQueueLength is the length of the queue above which nscapi is not
+	// ready anymore
+	readyMaxQueueLength uint = 10000
+	// statusConfig is the summary of the configuration reported on /api/status
+	statusConfig map[string]interface{}
+	// lastIngestion is the time the cache worker processed its last check result
+	lastIngestion gauge
+)
+
+// readinessCheck is the result of one of the conditions of the readiness
+type readinessCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// configSummary returns the configuration reported on /api/status. The
+// secrets are left out
+func configSummary(conf *cfg) map[string]interface{} {
+	return map[string]interface{}{
+		"api":                 fmt.Sprint(conf.apiIP, ":", conf.apiPort),
+		"nsca":                fmt.Sprint(conf.nscaIP, ":", conf.nscaPort),
+		"nscaEncryption":      conf.nscaEncryption,
+		"customFieldsRoot":    conf.apiCustomFieldRoot,
+		"templatesRoot":       conf.apiTemplatesRoot,
+		"notificationsConfig": conf.notificationsCfg,
+		"eventHandlersConfig": conf.eventHandlersCfg,
+		"metricsCustomLabels": metricsCustomLabels,
+		"adminPort":           conf.adminPort,
+		"readyMaxQueueLength": conf.readyMaxQueue,
+		"statusDatPath":       conf.statusDatPath,
+		"livestatusListen":    conf.livestatusListen,
+		"resultsTokens":       len(parseResultsTokens(conf.resultsTokens)),
+		"zabbixListen":        conf.zabbixListen,
+		"zabbixMapping":       conf.zabbixMapping,
+		"commandFile":         conf.commandFile,
+		"lineListen":          conf.lineListen,
+		"lineSecret":          conf.lineSecret != "",
+		"icingaAPIUsers":      len(parseResultsTokens(conf.icingaAPIUsers)),
+		"rejectOutOfOrder":    conf.rejectOutOfOrder,
+		"maxPacketAge":        conf.maxPacketAge,
+		"maxFutureSkew":       conf.maxFutureSkew,
+		"futureTimestamps":    conf.futureTimestamps,
+		"timestampClock":      conf.timestampClock,
+		"rewriteRules":        conf.rewriteRules,
+		"filterRules":         conf.filterRules,
+	}
+}
+
+// checkNSCAListener checks that the NSCA server of this process has bound its
+// listener
+func checkNSCAListener() readinessCheck {
+	check := readinessCheck{Name: "nsca"}
+	if atomic.LoadInt32(&nscaListening) == 0 {
+		check.Message = "NSCA server not started"
+		return check
+	}
+	check.OK = true
+	return check
+}
+
+// checkCustomFields checks that the custom fields hierarchy has been loaded
+func checkCustomFields() readinessCheck {
+	check := readinessCheck{Name: "customFields"}
+	if atomic.LoadInt32(&customFieldsLoaded) == 0 {
+		check.Message = "custom fields not loaded yet"
+		return check
+	}
+	check.OK = true
+	if errs := customFieldsLoadErrors.value(); errs > 0 {
+		check.Message = fmt.Sprintf("%v files could not be loaded", errs)
+	}
+	return check
+}
+
+// checkTemplates checks that the templates of the API can be parsed
+func checkTemplates() readinessCheck {
+	check := readinessCheck{Name: "templates"}
+	fMaps := template.FuncMap{"tojson": ToJSONString}
+	for _, name := range []string{"root.tmpl", "reports_element.tmpl"} {
+		if _, err := template.New(name).Funcs(fMaps).ParseFiles(filepath.Join(tmplRoot, name)); err != nil {
+			check.Message = err.Error()
+			return check
+		}
+	}
+	check.OK = true
+	return check
+}
+
+// checkQueue checks that the cache worker keeps up with the check results
+func checkQueue() readinessCheck {
+	check := readinessCheck{Name: "queue", OK: true}
+	if l := q.Len(); uint(l) >= readyMaxQueueLength {
+		check.OK = false
+		check.Message = fmt.Sprintf("%d check results waiting, the limit is %d", l, readyMaxQueueLength)
+	}
+	return check
+}
+
+// readinessChecks runs all the conditions of the readiness and returns whether
+// they all passed. nscapi does not persist its cache, so there is no snapshot
+// restoration to wait for
+func readinessChecks() ([]readinessCheck, bool) {
+	checks := []readinessCheck{checkNSCAListener(), checkCustomFields(), checkTemplates(), checkQueue()}
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return checks, ready
+}
+
+// healthzHandler takes care of the path /healthz that only tells the process is
+// alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler takes care of the path /readyz that returns a 503 when nscapi
+// is not ready to receive check results and serve them
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks, ready := readinessChecks()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, c := range checks {
+		status := "ok"
+		if !c.OK {
+			status = "failed"
+		}
+		if c.Message != "" {
+			status += ": " + c.Message
+		}
+		fmt.Fprintf(w, "%s %s\n", c.Name, status)
+	}
+}
+
+// statusHandler takes care of the path /api/status that reports the state of
+// nscapi itself. It returns a 503 when one of the readiness checks fails
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	checks, ready := readinessChecks()
+	cacheLock.RLock()
+	hosts, services := len(cache), 0
+	for _, svcs := range cache {
+		services += len(svcs)
+	}
+	cacheLock.RUnlock()
+	var last interface{}
+	if ts := lastIngestion.value(); ts > 0 {
+		last = time.Unix(int64(ts), 0).UTC()
+	}
+	status := map[string]interface{}{
+		"status":        "ok",
+		"version":       version,
+		"startedAt":     startTime.UTC(),
+		"uptimeSeconds": time.Since(startTime).Seconds(),
+		"lastIngestion": last,
+		"queueLength":   q.Len(),
+		"cache":         map[string]int{"hosts": hosts, "checks": services},
+		"checks":        checks,
+		"config":        statusConfig,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status["status"] = "degraded"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/PurpureGecko/go-lfc"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	initCache()
+	q = lfc.NewQueue()
+	tmplRoot = "templates"
+	atomic.StoreInt32(&customFieldsLoaded, 1)
+	readyMaxQueueLength = 2
+
+	cases := []struct {
+		name     string
+		setup    func()
+		expected int
+		contains string
+	}{
+		{"ready", func() { atomic.StoreInt32(&nscaListening, 1) }, http.StatusOK, "nsca ok\n"},
+		{"nsca not started", func() { atomic.StoreInt32(&nscaListening, 0) }, http.StatusServiceUnavailable, "nsca failed: NSCA server not started\n"},
+		{"missing templates", func() { atomic.StoreInt32(&nscaListening, 1); tmplRoot = "nonExisting" }, http.StatusServiceUnavailable, "templates failed"},
+		{"queue full", func() {
+			tmplRoot = "templates"
+			q.Enqueue(1)
+			q.Enqueue(2)
+		}, http.StatusServiceUnavailable, "queue failed: 2 check results waiting, the limit is 2\n"},
+	}
+	for _, tt := range cases {
+		tt.setup()
+		w := httptest.NewRecorder()
+		readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tt.expected {
+			t.Errorf("%s: expecting status %d. Got %d", tt.name, tt.expected, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s: expecting %q in:\n%s", tt.name, tt.contains, w.Body.String())
+		}
+	}
+	q = lfc.NewQueue()
+	readyMaxQueueLength = 10000
+	atomic.StoreInt32(&nscaListening, 0)
+}
+
+func TestStatusHandler(t *testing.T) {
+	initCache()
+	q = lfc.NewQueue()
+	tmplRoot = "templates"
+	atomic.StoreInt32(&customFieldsLoaded, 1)
+	atomic.StoreInt32(&nscaListening, 0)
+	statusConfig = configSummary(&cfg{nscaIP: "0.0.0.0", nscaPort: 5667, nscaPassword: "secret"})
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/api/status", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expecting a 503 as the NSCA server is not started. Got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Error("The NSCA password should not be reported")
+	}
+	var status struct {
+		Status  string `json:"status"`
+		Version string `json:"version"`
+		Cache   struct {
+			Hosts  int `json:"hosts"`
+			Checks int `json:"checks"`
+		} `json:"cache"`
+		Config map[string]interface{} `json:"config"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	if status.Status != "degraded" || status.Version != version || status.Cache.Hosts != 1 || status.Cache.Checks != 1 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if status.Config["nsca"] != "0.0.0.0:5667" {
+		t.Errorf("Unexpected config summary: %v", status.Config)
+	}
+}
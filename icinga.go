@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icingaAPIUsers are the users accepted by the Icinga 2 API emulation with their
+// password. The endpoint rejects every request when no user is configured
+var icingaAPIUsers map[string]string
+
+// icingaObject is a host or a service targeted by a process-check-result
+// action. The service is empty for the hosts
+type icingaObject struct {
+	host    string
+	service string
+}
+
+// name returns the name of the object the way Icinga 2 does
+func (o icingaObject) name() string {
+	if o.service == "" {
+		return o.host
+	}
+	return o.host + "!" + o.service
+}
+
+// icingaError is the error returned by the Icinga 2 API emulation
+type icingaError struct {
+	code   int
+	status string
+}
+
+func (e *icingaError) Error() string {
+	return e.status
+}
+
+// parseIcingaAPIUsers parses the comma-separated list of 'user:password'
+func parseIcingaAPIUsers(list string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid Icinga API user '%s', expecting 'user:password'", entry)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, nil
+}
+
+// authorizedIcingaRequest returns whether the request carries the basic auth
+// credentials of one of the accepted users
+func authorizedIcingaRequest(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	expected, found := icingaAPIUsers[user]
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && found
+}
+
+// icingaParams merges the parameters of the query string and of the JSON body
+// like Icinga 2 does. The body takes precedence
+func icingaParams(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	params := make(map[string]interface{})
+	for key, values := range r.URL.Query() {
+		params[key] = values[len(values)-1]
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, resultsMaxBodySize)); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body.Bytes())) == 0 {
+		return params, nil
+	}
+	var fromBody map[string]interface{}
+	if err := json.Unmarshal(body.Bytes(), &fromBody); err != nil {
+		return nil, err
+	}
+	for key, value := range fromBody {
+		params[key] = value
+	}
+	return params, nil
+}
+
+// icingaStringParam returns a string parameter
+func icingaStringParam(params map[string]interface{}, key string) string {
+	if s, ok := params[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// icingaNumberParam returns a numeric parameter that can be sent as a JSON
+// number or, in the query string, as a string
+func icingaNumberParam(params map[string]interface{}, key string) (float64, bool) {
+	switch value := params[key].(type) {
+	case float64:
+		return value, true
+	case string:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// parseIcingaFilter parses the subset of the Icinga 2 filter language used to
+// target the checks: equality conditions on the host and service names
+// combined with '&&'. The values are either quoted strings or variables of
+// filter_vars. It returns the host and service names required by the filter,
+// empty when not restricted
+func parseIcingaFilter(filter string, vars map[string]interface{}) (host, service string, err error) {
+	for _, term := range strings.Split(filter, "&&") {
+		term = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(term), "("), ")"))
+		parts := strings.SplitN(term, "==", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("unsupported condition '%s'", term)
+		}
+		attr, raw := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var value string
+		if strings.HasPrefix(raw, `"`) {
+			if value, err = strconv.Unquote(raw); err != nil {
+				return "", "", fmt.Errorf("invalid string %s", raw)
+			}
+		} else if v, ok := vars[raw].(string); ok {
+			value = v
+		} else {
+			return "", "", fmt.Errorf("unknown variable '%s'", raw)
+		}
+		switch attr {
+		case "host.name", "service.host_name":
+			host = value
+		case "service.name":
+			service = value
+		case "service.__name":
+			parts := strings.SplitN(value, "!", 2)
+			if len(parts) != 2 {
+				return "", "", fmt.Errorf("invalid service name '%s'", value)
+			}
+			host, service = parts[0], parts[1]
+		default:
+			return "", "", fmt.Errorf("unsupported attribute '%s'", attr)
+		}
+	}
+	return host, service, nil
+}
+
+// icingaTargets returns the objects targeted by the request. A fully
+// qualified service or host is accepted even when not in the cache yet, the
+// partial filters only match the checks present in the cache
+func icingaTargets(params map[string]interface{}) ([]icingaObject, error) {
+	objType := strings.ToLower(icingaStringParam(params, "type"))
+	if name := icingaStringParam(params, "service"); name != "" && (objType == "" || objType == "service") {
+		parts := strings.SplitN(name, "!", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, &icingaError{http.StatusBadRequest, fmt.Sprintf("Invalid service name '%s'.", name)}
+		}
+		return []icingaObject{{parts[0], parts[1]}}, nil
+	}
+	if name := icingaStringParam(params, "host"); name != "" && (objType == "" || objType == "host") {
+		return []icingaObject{{host: name}}, nil
+	}
+	if objType != "host" && objType != "service" {
+		return nil, &icingaError{http.StatusBadRequest, "Invalid type specified."}
+	}
+	filter := icingaStringParam(params, "filter")
+	if filter == "" {
+		return nil, &icingaError{http.StatusBadRequest, "Invalid request: no object or filter specified."}
+	}
+	vars, _ := params["filter_vars"].(map[string]interface{})
+	host, service, err := parseIcingaFilter(filter, vars)
+	if err != nil {
+		return nil, &icingaError{http.StatusBadRequest, fmt.Sprintf("Invalid filter: %s.", err)}
+	}
+	if objType == "host" {
+		if host == "" || service != "" {
+			return nil, &icingaError{http.StatusBadRequest, "Invalid filter: the host filters must only set host.name."}
+		}
+		return []icingaObject{{host: host}}, nil
+	}
+	if host != "" && service != "" {
+		return []icingaObject{{host, service}}, nil
+	}
+
+	var targets []icingaObject
+	cacheLock.RLock()
+	for h, services := range cache {
+		if host != "" && h != host {
+			continue
+		}
+		for s := range services {
+			if service == "" || s == service {
+				targets = append(targets, icingaObject{h, s})
+			}
+		}
+	}
+	cacheLock.RUnlock()
+	if len(targets) == 0 {
+		return nil, &icingaError{http.StatusNotFound, "No objects found."}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name() < targets[j].name() })
+	return targets, nil
+}
+
+// icingaPluginOutput builds the plugin output in the Nagios format: the
+// performance data follows the first line of the output
+func icingaPluginOutput(output string, perfdata interface{}) string {
+	var perf []string
+	switch value := perfdata.(type) {
+	case string:
+		perf = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				perf = append(perf, s)
+			}
+		}
+	}
+	joined := strings.TrimSpace(strings.Join(perf, " "))
+	if joined == "" {
+		return output
+	}
+	lines := strings.SplitN(output, "\n", 2)
+	lines[0] += "|" + joined
+	return strings.Join(lines, "\n")
+}
+
+// writeIcingaError writes an error in the format of the Icinga 2 API
+func writeIcingaError(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": code, "status": status})
+}
+
+// icingaProcessCheckResultHandler emulates the process-check-result action of
+// the Icinga 2 API so that the Icinga 2 agents and scripts can submit their
+// check results to nscapi. The targeted checks are given by the host or
+// service parameters or by a filter on their names. The results are fed into
+// the same queue as the NSCA packets. The host results keep an empty service
+// name like the NSCA host check packets
+func icingaProcessCheckResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeIcingaError(w, http.StatusMethodNotAllowed, "Invalid request method. Must be POST.")
+		return
+	}
+	if !authorizedIcingaRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Icinga 2"`)
+		writeIcingaError(w, http.StatusUnauthorized, "Unauthorized. Please check your user credentials.")
+		return
+	}
+	params, err := icingaParams(w, r)
+	if err != nil {
+		writeIcingaError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %s", err))
+		return
+	}
+	exitStatus, ok := icingaNumberParam(params, "exit_status")
+	if !ok {
+		writeIcingaError(w, http.StatusBadRequest, "Parameter 'exit_status' is required.")
+		return
+	}
+	if _, ok := params["plugin_output"]; !ok {
+		writeIcingaError(w, http.StatusBadRequest, "Parameter 'plugin_output' is required.")
+		return
+	}
+	targets, err := icingaTargets(params)
+	if err != nil {
+		e := err.(*icingaError)
+		writeIcingaError(w, e.code, e.status)
+		return
+	}
+
+	max := 3.0
+	if targets[0].service == "" {
+		max = 1
+	}
+	if exitStatus != float64(int16(exitStatus)) || exitStatus < 0 || exitStatus > max {
+		writeIcingaError(w, http.StatusBadRequest, fmt.Sprintf("Invalid 'exit_status' %v, expecting 0 to %v.", exitStatus, max))
+		return
+	}
+
+	timestamp := uint32(time.Now().Unix())
+	if end, ok := icingaNumberParam(params, "execution_end"); ok && end > 0 {
+		timestamp = uint32(end)
+	}
+	output := icingaPluginOutput(icingaStringParam(params, "plugin_output"), params["performance_data"])
+	results := make([]map[string]interface{}, 0, len(targets))
+	for _, target := range targets {
+		queueResult(&nsca.DataPacket{HostName: target.host, Service: target.service, State: int16(exitStatus), PluginOutput: output, Timestamp: timestamp}, "icinga")
+		results = append(results, map[string]interface{}{"code": 200, "status": fmt.Sprintf("Successfully processed check result for object '%s'.", target.name())})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIcingaAPIUsers(t *testing.T) {
+	users, err := parseIcingaAPIUsers(" root:secret, ,agent:pass:word ")
+	if err != nil || !reflect.DeepEqual(users, map[string]string{"root": "secret", "agent": "pass:word"}) {
+		t.Errorf("Unexpected users %v: %v", users, err)
+	}
+	if _, err := parseIcingaAPIUsers("root"); err == nil {
+		t.Error("Expecting an error for a user without password")
+	}
+}
+
+func TestParseIcingaFilter(t *testing.T) {
+	cases := []struct {
+		filter  string
+		vars    map[string]interface{}
+		host    string
+		service string
+		err     bool
+	}{
+		{`host.name=="web01" && service.name=="apache"`, nil, "web01", "apache", false},
+		{`(host.name==h) && (service.name==s)`, map[string]interface{}{"h": "web01", "s": "apache"}, "web01", "apache", false},
+		{`service.__name=="web01!apache"`, nil, "web01", "apache", false},
+		{`service.name=="apache"`, nil, "", "apache", false},
+		{`host.name==h`, nil, "", "", true},
+		{`host.name!="web01"`, nil, "", "", true},
+		{`host.address=="10.0.0.1"`, nil, "", "", true},
+		{`match("web*", host.name)`, nil, "", "", true},
+	}
+	for _, tt := range cases {
+		host, service, err := parseIcingaFilter(tt.filter, tt.vars)
+		if (err != nil) != tt.err || host != tt.host || service != tt.service {
+			t.Errorf("%s: expecting %q, %q (error: %t). Got %q, %q, %v", tt.filter, tt.host, tt.service, tt.err, host, service, err)
+		}
+	}
+}
+
+func TestIcingaPluginOutput(t *testing.T) {
+	cases := []struct {
+		output   string
+		perfdata interface{}
+		expected string
+	}{
+		{"OK", nil, "OK"},
+		{"OK", "time=1s", "OK|time=1s"},
+		{"OK - 2 disks\n/ 10%\n/var 20%", []interface{}{"/=10%", "/var=20%"}, "OK - 2 disks|/=10% /var=20%\n/ 10%\n/var 20%"},
+	}
+	for _, tt := range cases {
+		if out := icingaPluginOutput(tt.output, tt.perfdata); out != tt.expected {
+			t.Errorf("Expecting %q. Got %q", tt.expected, out)
+		}
+	}
+}
+
+func TestIcingaProcessCheckResultHandler(t *testing.T) {
+	icingaAPIUsers = map[string]string{"root": "secret"}
+	defer func() { icingaAPIUsers = nil }()
+	initCache()
+	eventHandlers = nil
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+	updateCacheEntry("web01", "disk", "OK", 1484527962, 0)
+	updateCacheEntry("web02", "apache", "OK", 1484527962, 0)
+
+	cases := []struct {
+		name     string
+		query    string
+		user     string
+		body     string
+		code     int
+		statuses []string
+		packets  []nsca.DataPacket
+	}{
+		{"service filter", "", "root", `{"type": "Service", "filter": "host.name==\"db01\" && service.name==\"mysql\"", "exit_status": 2, "plugin_output": "CRITICAL - down", "performance_data": ["conn=0"], "execution_end": 1484527963.5}`,
+			http.StatusOK, []string{"Successfully processed check result for object 'db01!mysql'."},
+			[]nsca.DataPacket{{HostName: "db01", Service: "mysql", State: 2, PluginOutput: "CRITICAL - down|conn=0", Timestamp: 1484527963}}},
+		{"service parameter", "?service=web01!disk", "root", `{"exit_status": 1, "plugin_output": "WARNING - 85%", "execution_end": 1484527964}`,
+			http.StatusOK, []string{"Successfully processed check result for object 'web01!disk'."},
+			[]nsca.DataPacket{{HostName: "web01", Service: "disk", State: 1, PluginOutput: "WARNING - 85%", Timestamp: 1484527964}}},
+		{"partial filter", "", "root", `{"type": "Service", "filter": "service.name==svc", "filter_vars": {"svc": "apache"}, "exit_status": 0, "plugin_output": "OK", "execution_end": 1484527965}`,
+			http.StatusOK, []string{"Successfully processed check result for object 'web01!apache'.", "Successfully processed check result for object 'web02!apache'."},
+			[]nsca.DataPacket{
+				{HostName: "web01", Service: "apache", State: 0, PluginOutput: "OK", Timestamp: 1484527965},
+				{HostName: "web02", Service: "apache", State: 0, PluginOutput: "OK", Timestamp: 1484527965},
+			}},
+		{"host", "", "root", `{"type": "Host", "filter": "host.name==\"web03\"", "exit_status": 1, "plugin_output": "PING CRITICAL", "execution_end": 1484527966}`,
+			http.StatusOK, []string{"Successfully processed check result for object 'web03'."},
+			[]nsca.DataPacket{{HostName: "web03", Service: "", State: 1, PluginOutput: "PING CRITICAL", Timestamp: 1484527966}}},
+		{"no object found", "", "root", `{"type": "Service", "filter": "host.name==\"db02\"", "exit_status": 0, "plugin_output": "OK"}`, http.StatusNotFound, nil, nil},
+		{"invalid host exit status", "?host=web01", "root", `{"exit_status": 2, "plugin_output": "DOWN"}`, http.StatusBadRequest, nil, nil},
+		{"invalid service exit status", "?service=web01!apache", "root", `{"exit_status": 1.5, "plugin_output": "OK"}`, http.StatusBadRequest, nil, nil},
+		{"missing exit status", "?service=web01!apache", "root", `{"plugin_output": "OK"}`, http.StatusBadRequest, nil, nil},
+		{"missing plugin output", "?service=web01!apache&exit_status=0", "root", "", http.StatusBadRequest, nil, nil},
+		{"invalid service name", "?service=web01", "root", `{"exit_status": 0, "plugin_output": "OK"}`, http.StatusBadRequest, nil, nil},
+		{"invalid filter", "", "root", `{"type": "Service", "filter": "match(\"web*\", host.name)", "exit_status": 0, "plugin_output": "OK"}`, http.StatusBadRequest, nil, nil},
+		{"invalid type", "", "root", `{"type": "User", "filter": "host.name==\"web01\"", "exit_status": 0, "plugin_output": "OK"}`, http.StatusBadRequest, nil, nil},
+		{"invalid JSON", "", "root", `{"type": `, http.StatusBadRequest, nil, nil},
+		{"bad credentials", "?host=web01", "other", `{"exit_status": 0, "plugin_output": "UP"}`, http.StatusUnauthorized, nil, nil},
+	}
+	for _, tt := range cases {
+		q = lfc.NewQueue()
+		req := httptest.NewRequest("POST", "/v1/actions/process-check-result"+tt.query, strings.NewReader(tt.body))
+		req.SetBasicAuth(tt.user, "secret")
+		w := httptest.NewRecorder()
+		icingaProcessCheckResultHandler(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expecting status %d. Got %d: %s", tt.name, tt.code, w.Code, w.Body.String())
+			continue
+		}
+		if tt.statuses != nil {
+			var resp struct {
+				Results []struct {
+					Code   int    `json:"code"`
+					Status string `json:"status"`
+				} `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("%s: invalid response: %s", tt.name, err)
+			}
+			var statuses []string
+			for _, res := range resp.Results {
+				statuses = append(statuses, res.Status)
+			}
+			if !reflect.DeepEqual(statuses, tt.statuses) {
+				t.Errorf("%s: expecting %v. Got %v", tt.name, tt.statuses, statuses)
+			}
+		}
+		if q.Len() != len(tt.packets) {
+			t.Errorf("%s: expecting %d results in the queue. Got %d", tt.name, len(tt.packets), q.Len())
+		}
+		for _, expected := range tt.packets {
+			item, _ := q.Dequeue()
+			if p := item.(*queuedPacket).packet; !reflect.DeepEqual(*p, expected) {
+				t.Errorf("%s: expecting %+v in the queue. Got %+v", tt.name, expected, *p)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	icingaProcessCheckResultHandler(w, httptest.NewRequest("GET", "/v1/actions/process-check-result", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expecting a 405 for a GET request. Got %d", w.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lineIdleTimeout is the time after which an idle TCP connection of the line
+// protocol is closed
+const lineIdleTimeout = time.Minute
+
+// lineMaxDatagramSize is the maximum size of a UDP datagram of the line
+// protocol
+const lineMaxDatagramSize = 65535
+
+// lineSecret is the shared secret that prefixes the lines. No prefix is
+// expected when it is empty
+var lineSecret string
+
+// parseResultLine parses a check result in the tab-delimited format of
+// send_nsca: "host\tservice\tstate\toutput" or "host\tstate\toutput" for the host
+// checks, optionally prefixed by the shared secret and a tab. The host check
+// results keep an empty service name like the NSCA host check packets. The
+// output can contain tabs: a line is a host check when its third field is not a
+// state
+func parseResultLine(line string, now time.Time) (*nsca.DataPacket, error) {
+	if lineSecret != "" {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(lineSecret)) != 1 {
+			return nil, fmt.Errorf("missing or invalid secret")
+		}
+		line = parts[1]
+	}
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) == 4 {
+		if _, err := parseLineState(fields[2]); err != nil {
+			fields = strings.SplitN(line, "\t", 3)
+		}
+	}
+	var host, service, state, output string
+	switch len(fields) {
+	case 3:
+		host, state, output = fields[0], fields[1], fields[2]
+	case 4:
+		host, service, state, output = fields[0], fields[1], fields[2], fields[3]
+		if service == "" {
+			return nil, fmt.Errorf("empty service")
+		}
+	default:
+		return nil, fmt.Errorf("expecting host, service, state and output separated by tabs")
+	}
+	if host == "" {
+		return nil, fmt.Errorf("empty host")
+	}
+	code, err := parseLineState(state)
+	if err != nil {
+		return nil, err
+	}
+	return &nsca.DataPacket{HostName: host, Service: service, State: code, PluginOutput: output, Timestamp: uint32(now.Unix())}, nil
+}
+
+// parseLineState parses the state field of a line
+func parseLineState(state string) (int16, error) {
+	code, err := strconv.ParseInt(state, 10, 16)
+	if err != nil || code < 0 || code > 3 {
+		return 0, fmt.Errorf("invalid state '%s'", state)
+	}
+	return int16(code), nil
+}
+
+// processResultLines feeds the check results of the lines into the queue
+func processResultLines(r io.Reader, from net.Addr, refresh func()) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if refresh != nil {
+			refresh()
+		}
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		p, err := parseResultLine(line, time.Now())
+		if err != nil {
+			log.Printf("Ignoring a line from %s: %s", from, err)
+			continue
+		}
+		queueResult(p, "line")
+	}
+}
+
+// handleLineConn reads the check results sent on a TCP connection
+func handleLineConn(conn net.Conn) {
+	defer conn.Close()
+	refresh := func() { conn.SetReadDeadline(time.Now().Add(lineIdleTimeout)) }
+	refresh()
+	processResultLines(conn, conn.RemoteAddr(), refresh)
+}
+
+// serveLineTCP accepts the TCP connections of the line protocol
+func serveLineTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Line protocol TCP listener stopped: %s", err)
+			return
+		}
+		go handleLineConn(conn)
+	}
+}
+
+// serveLineUDP reads the datagrams of the line protocol, each of them holding
+// one or more lines
+func serveLineUDP(pc net.PacketConn) {
+	buf := make([]byte, lineMaxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Line protocol UDP listener stopped: %s", err)
+			return
+		}
+		processResultLines(bytes.NewReader(buf[:n]), from, nil)
+	}
+}
+
+// initLineListeners starts the TCP and UDP listeners of the line protocol on
+// the same address. An empty address disables them
+func initLineListeners(address string) error {
+	if address == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	go serveLineTCP(ln)
+	go serveLineUDP(pc)
+	return nil
+}
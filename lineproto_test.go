@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseResultLine(t *testing.T) {
+	now := time.Unix(1484527962, 0)
+	cases := []struct {
+		secret   string
+		line     string
+		expected *nsca.DataPacket
+	}{
+		{"", "web01\tapache\t2\tCRITICAL - down\tfor 5m", &nsca.DataPacket{HostName: "web01", Service: "apache", State: 2, PluginOutput: "CRITICAL - down\tfor 5m", Timestamp: 1484527962}},
+		{"", "web01\t1\tPING WARNING", &nsca.DataPacket{HostName: "web01", State: 1, PluginOutput: "PING WARNING", Timestamp: 1484527962}},
+		{"", "web01\t1\tPING WARNING\trta 250ms\tloss 0%", &nsca.DataPacket{HostName: "web01", State: 1, PluginOutput: "PING WARNING\trta 250ms\tloss 0%", Timestamp: 1484527962}},
+		{"", "web01\tapache\t0\tOK\t3\tworkers", &nsca.DataPacket{HostName: "web01", Service: "apache", State: 0, PluginOutput: "OK\t3\tworkers", Timestamp: 1484527962}},
+		{"s3cret", "s3cret\tweb01\tapache\t0\tOK", &nsca.DataPacket{HostName: "web01", Service: "apache", State: 0, PluginOutput: "OK", Timestamp: 1484527962}},
+		{"s3cret", "wrong\tweb01\tapache\t0\tOK", nil},
+		{"s3cret", "web01\tapache\t0\tOK", nil},
+		{"", "web01\tapache\t4\tOK", nil},
+		{"", "web01\tapache\tOK\tOK", nil},
+		{"", "web01\t\t0\tOK", nil},
+		{"", "\tapache\t0\tOK", nil},
+		{"", "web01 apache 0 OK", nil},
+	}
+	for _, tt := range cases {
+		lineSecret = tt.secret
+		p, err := parseResultLine(tt.line, now)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expecting an error. Got %+v", tt.line, p)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(p, tt.expected) {
+			t.Errorf("%q: expecting %+v. Got %+v: %v", tt.line, tt.expected, p, err)
+		}
+	}
+	lineSecret = ""
+}
+
+func TestLineListeners(t *testing.T) {
+	q = lfc.NewQueue()
+	if err := initLineListeners(""); err != nil {
+		t.Errorf("An empty address should disable the listeners. Got %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveLineTCP(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("web01\tapache\t0\tOK\r\n\nweb01\tinvalid\nweb02\tapache\t2\tCRITICAL\n"))
+	conn.Close()
+	if !waitQueueLength(2) {
+		t.Fatalf("Expecting 2 results from the TCP connection. Got %d", q.Len())
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveLineUDP(pc)
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("db01\tmysql\t1\tWARNING\ndb02\t0\tUP"))
+	client.Close()
+	if !waitQueueLength(4) {
+		t.Fatalf("Expecting 2 more results from the UDP datagram. Got %d", q.Len())
+	}
+	for _, expected := range []string{"web01/apache/OK", "web02/apache/CRITICAL", "db01/mysql/WARNING", "db02//UP"} {
+		item, _ := q.Dequeue()
+		p := item.(*queuedPacket).packet
+		if got := p.HostName + "/" + p.Service + "/" + p.PluginOutput; got != expected {
+			t.Errorf("Expecting %s. Got %s", expected, got)
+		}
+	}
+}
@@ -0,0 +1,952 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// livestatusVersion is the version of the Livestatus protocol reported to the
+// clients
+const livestatusVersion = "1.2.8-nscapi"
+
+// livestatusTimeout is the time given to a client to send a query and read its
+// response before the connection is closed
+var livestatusTimeout = time.Minute
+
+// livestatusOutputFormats are the supported values of OutputFormat
+var livestatusOutputFormats = []string{"csv", "json", "python", "python3"}
+
+// livestatusRow is a row of the Livestatus tables: a check for the services
+// table, a host and its checks for the hosts table. The host status is the
+// result of the host check or the UP state of the hosts without host check
+type livestatusRow struct {
+	host       string
+	service    string
+	entry      serviceEntry
+	hostStatus serviceEntry
+	services   []serviceEntry
+	names      []string
+	clockSkew  clockSkew
+}
+
+// livestatusColumns maps the name of the columns of a table to their value.
+// The values are int64, float64, string, []string or map[string]string
+type livestatusColumns map[string]func(r *livestatusRow) interface{}
+
+// livestatusBool converts a boolean to the integer used by Livestatus
+func livestatusBool(b bool) interface{} {
+	if b {
+		return int64(1)
+	}
+	return int64(0)
+}
+
+// livestatusCustomVariables returns the resolved custom fields of a check as
+// Nagios custom variables, the names being upper-cased like Nagios does
+func livestatusCustomVariables(host, service string) map[string]string {
+	vars := make(map[string]string)
+	custom := cFields.get(host, service)
+	for name := range custom {
+		vars[strings.ToUpper(name)] = strings.Join(getStrings(custom, name), ",")
+	}
+	return vars
+}
+
+// livestatusCustomVariableNames returns the sorted names of the custom
+// variables
+func livestatusCustomVariableNames(vars map[string]string) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// livestatusCustomVariableValues returns the values of the custom variables in
+// the order of their names
+func livestatusCustomVariableValues(vars map[string]string) []string {
+	names := livestatusCustomVariableNames(vars)
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = vars[name]
+	}
+	return values
+}
+
+// livestatusServiceColumns are the columns of the services table
+var livestatusServiceColumns = livestatusColumns{
+	"host_name":             func(r *livestatusRow) interface{} { return r.host },
+	"host_alias":            func(r *livestatusRow) interface{} { return r.host },
+	"host_address":          func(r *livestatusRow) interface{} { return r.host },
+	"host_state":            func(r *livestatusRow) interface{} { return int64(r.hostStatus.state) },
+	"host_plugin_output":    func(r *livestatusRow) interface{} { return r.hostStatus.shortOutput },
+	"host_acknowledged":     func(r *livestatusRow) interface{} { return livestatusBool(r.hostStatus.acknowledged) },
+	"host_has_been_checked": func(r *livestatusRow) interface{} { return int64(1) },
+	"host_groups":           func(r *livestatusRow) interface{} { return []string{hostgroupOf(r.host)} },
+	"description":           func(r *livestatusRow) interface{} { return r.service },
+	"display_name":          func(r *livestatusRow) interface{} { return r.service },
+	"state":                 func(r *livestatusRow) interface{} { return int64(r.entry.state) },
+	"state_type": func(r *livestatusRow) interface{} {
+		return livestatusBool(stateType(r.entry.state, r.entry.attempt, checkMaxAttempts(r.host, r.service)) == "HARD")
+	},
+	"plugin_output":      func(r *livestatusRow) interface{} { return r.entry.shortOutput },
+	"long_plugin_output": func(r *livestatusRow) interface{} { return nagiosOutputEscaper.Replace(r.entry.longOutput) },
+	"perf_data": func(r *livestatusRow) interface{} {
+		_, _, perfdata := splitPluginOutput(r.entry.output)
+		return perfdata
+	},
+	"last_check":        func(r *livestatusRow) interface{} { return int64(r.entry.timestamp) },
+	"last_state_change": func(r *livestatusRow) interface{} { return int64(r.entry.statusFirstSeen) },
+	"current_attempt": func(r *livestatusRow) interface{} {
+		if max := checkMaxAttempts(r.host, r.service); r.entry.attempt > max {
+			return int64(max)
+		}
+		return int64(r.entry.attempt)
+	},
+	"max_check_attempts":       func(r *livestatusRow) interface{} { return int64(checkMaxAttempts(r.host, r.service)) },
+	"acknowledged":             func(r *livestatusRow) interface{} { return livestatusBool(r.entry.acknowledged) },
+	"has_been_checked":         func(r *livestatusRow) interface{} { return int64(1) },
+	"check_type":               func(r *livestatusRow) interface{} { return int64(1) },
+	"active_checks_enabled":    func(r *livestatusRow) interface{} { return int64(0) },
+	"accept_passive_checks":    func(r *livestatusRow) interface{} { return int64(1) },
+	"notifications_enabled":    func(r *livestatusRow) interface{} { return int64(1) },
+	"in_notification_period":   func(r *livestatusRow) interface{} { return int64(1) },
+	"scheduled_downtime_depth": func(r *livestatusRow) interface{} { return int64(0) },
+	"is_flapping":              func(r *livestatusRow) interface{} { return int64(0) },
+	"groups":                   func(r *livestatusRow) interface{} { return []string{} },
+	"custom_variables":         func(r *livestatusRow) interface{} { return livestatusCustomVariables(r.host, r.service) },
+	"custom_variable_names": func(r *livestatusRow) interface{} {
+		return livestatusCustomVariableNames(livestatusCustomVariables(r.host, r.service))
+	},
+	"custom_variable_values": func(r *livestatusRow) interface{} {
+		return livestatusCustomVariableValues(livestatusCustomVariables(r.host, r.service))
+	},
+	"host_custom_variables": func(r *livestatusRow) interface{} { return livestatusCustomVariables(r.host, "all") },
+	"host_custom_variable_names": func(r *livestatusRow) interface{} {
+		return livestatusCustomVariableNames(livestatusCustomVariables(r.host, "all"))
+	},
+	"host_custom_variable_values": func(r *livestatusRow) interface{} {
+		return livestatusCustomVariableValues(livestatusCustomVariables(r.host, "all"))
+	},
+}
+
+// livestatusCountServices returns a column counting the checks of a host in
+// the given state
+func livestatusCountServices(state int16) func(r *livestatusRow) interface{} {
+	return func(r *livestatusRow) interface{} {
+		count := int64(0)
+		for _, entry := range r.services {
+			if clampState(entry.state) == state {
+				count++
+			}
+		}
+		return count
+	}
+}
+
+// livestatusHostColumns are the columns of the hosts table
+var livestatusHostColumns = livestatusColumns{
+	"name":               func(r *livestatusRow) interface{} { return r.host },
+	"alias":              func(r *livestatusRow) interface{} { return r.host },
+	"address":            func(r *livestatusRow) interface{} { return r.host },
+	"display_name":       func(r *livestatusRow) interface{} { return r.host },
+	"state":              func(r *livestatusRow) interface{} { return int64(r.hostStatus.state) },
+	"state_type":         func(r *livestatusRow) interface{} { return int64(1) },
+	"plugin_output":      func(r *livestatusRow) interface{} { return r.hostStatus.shortOutput },
+	"long_plugin_output": func(r *livestatusRow) interface{} { return nagiosOutputEscaper.Replace(r.hostStatus.longOutput) },
+	"perf_data": func(r *livestatusRow) interface{} {
+		_, _, perfdata := splitPluginOutput(r.hostStatus.output)
+		return perfdata
+	},
+	"last_check":               func(r *livestatusRow) interface{} { return int64(r.hostStatus.timestamp) },
+	"last_state_change":        func(r *livestatusRow) interface{} { return int64(r.hostStatus.statusFirstSeen) },
+	"has_been_checked":         func(r *livestatusRow) interface{} { return int64(1) },
+	"check_type":               func(r *livestatusRow) interface{} { return int64(1) },
+	"acknowledged":             func(r *livestatusRow) interface{} { return livestatusBool(r.hostStatus.acknowledged) },
+	"active_checks_enabled":    func(r *livestatusRow) interface{} { return int64(0) },
+	"accept_passive_checks":    func(r *livestatusRow) interface{} { return int64(1) },
+	"notifications_enabled":    func(r *livestatusRow) interface{} { return int64(1) },
+	"scheduled_downtime_depth": func(r *livestatusRow) interface{} { return int64(0) },
+	"groups":                   func(r *livestatusRow) interface{} { return []string{hostgroupOf(r.host)} },
+	"services":                 func(r *livestatusRow) interface{} { return r.names },
+	"num_services":             func(r *livestatusRow) interface{} { return int64(len(r.services)) },
+	"num_services_ok":          livestatusCountServices(0),
+	"num_services_warn":        livestatusCountServices(1),
+	"num_services_crit":        livestatusCountServices(2),
+	"num_services_unknown":     livestatusCountServices(3),
+	"num_services_pending":     func(r *livestatusRow) interface{} { return int64(0) },
+	"worst_service_state": func(r *livestatusRow) interface{} {
+		var worst int16
+		for _, entry := range r.services {
+			if state := clampState(entry.state); stateSeverity[state] > stateSeverity[worst] {
+				worst = state
+			}
+		}
+		return int64(worst)
+	},
+	// The clock skew of the host is an nscapi extension
+	"clock_skew_samples": func(r *livestatusRow) interface{} { return int64(r.clockSkew.Samples) },
+	"clock_skew_last":    func(r *livestatusRow) interface{} { return r.clockSkew.Last },
+	"clock_skew_min":     func(r *livestatusRow) interface{} { return r.clockSkew.Min },
+	"clock_skew_max":     func(r *livestatusRow) interface{} { return r.clockSkew.Max },
+	"clock_skew_mean":    func(r *livestatusRow) interface{} { return r.clockSkew.Mean },
+	"custom_variables":   func(r *livestatusRow) interface{} { return livestatusCustomVariables(r.host, "all") },
+	"custom_variable_names": func(r *livestatusRow) interface{} {
+		return livestatusCustomVariableNames(livestatusCustomVariables(r.host, "all"))
+	},
+	"custom_variable_values": func(r *livestatusRow) interface{} {
+		return livestatusCustomVariableValues(livestatusCustomVariables(r.host, "all"))
+	},
+}
+
+// livestatusStatusColumns are the columns of the status table describing
+// nscapi itself
+var livestatusStatusColumns = livestatusColumns{
+	"program_start":                  func(r *livestatusRow) interface{} { return startTime.Unix() },
+	"program_version":                func(r *livestatusRow) interface{} { return "nscapi " + version },
+	"livestatus_version":             func(r *livestatusRow) interface{} { return livestatusVersion },
+	"nagios_pid":                     func(r *livestatusRow) interface{} { return int64(os.Getpid()) },
+	"interval_length":                func(r *livestatusRow) interface{} { return int64(60) },
+	"accept_passive_service_checks":  func(r *livestatusRow) interface{} { return int64(1) },
+	"accept_passive_host_checks":     func(r *livestatusRow) interface{} { return int64(1) },
+	"execute_service_checks":         func(r *livestatusRow) interface{} { return int64(0) },
+	"execute_host_checks":            func(r *livestatusRow) interface{} { return int64(0) },
+	"enable_notifications":           func(r *livestatusRow) interface{} { return int64(1) },
+	"enable_event_handlers":          func(r *livestatusRow) interface{} { return livestatusBool(eventHandlers != nil) },
+	"enable_flap_detection":          func(r *livestatusRow) interface{} { return int64(0) },
+	"process_performance_data":       func(r *livestatusRow) interface{} { return int64(1) },
+	"check_service_freshness":        func(r *livestatusRow) interface{} { return int64(0) },
+	"check_host_freshness":           func(r *livestatusRow) interface{} { return int64(0) },
+	"obsess_over_services":           func(r *livestatusRow) interface{} { return int64(0) },
+	"obsess_over_hosts":              func(r *livestatusRow) interface{} { return int64(0) },
+	"last_command_check":             func(r *livestatusRow) interface{} { return time.Now().Unix() },
+	"last_log_rotation":              func(r *livestatusRow) interface{} { return int64(0) },
+	"external_command_buffer_slots":  func(r *livestatusRow) interface{} { return int64(0) },
+	"external_command_buffer_usage":  func(r *livestatusRow) interface{} { return int64(0) },
+	"external_command_buffer_max":    func(r *livestatusRow) interface{} { return int64(0) },
+	"num_hosts":                      func(r *livestatusRow) interface{} { return int64(len(r.names)) },
+	"num_services":                   func(r *livestatusRow) interface{} { return int64(len(r.services)) },
+	"cached_log_messages":            func(r *livestatusRow) interface{} { return int64(0) },
+	"connections":                    func(r *livestatusRow) interface{} { return int64(0) },
+	"requests":                       func(r *livestatusRow) interface{} { return int64(0) },
+	"host_checks":                    func(r *livestatusRow) interface{} { return int64(0) },
+	"service_checks":                 func(r *livestatusRow) interface{} { return int64(cacheUpdates.value()) },
+	"check_external_commands":        func(r *livestatusRow) interface{} { return int64(0) },
+	"enable_flap_detection_services": func(r *livestatusRow) interface{} { return int64(0) },
+}
+
+// livestatusTables are the tables that can be queried
+var livestatusTables = map[string]livestatusColumns{
+	"services": livestatusServiceColumns,
+	"hosts":    livestatusHostColumns,
+	"status":   livestatusStatusColumns,
+}
+
+// livestatusRows returns a snapshot of the rows of a table sorted by host and
+// service
+func livestatusRows(table string) []*livestatusRow {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	hosts := make([]string, 0, len(cache))
+	for host := range cache {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var rows []*livestatusRow
+	status := &livestatusRow{}
+	for _, host := range hosts {
+		services := make([]string, 0, len(cache[host]))
+		for svc := range cache[host] {
+			services = append(services, svc)
+		}
+		sort.Strings(services)
+		hostRow := &livestatusRow{host: host, hostStatus: *hostStatus(host), names: services}
+		if skew := hostClockSkew(host); skew != nil {
+			hostRow.clockSkew = *skew
+		}
+		for _, svc := range services {
+			entry := *cache[host][svc]
+			hostRow.services = append(hostRow.services, entry)
+			if table == "services" {
+				rows = append(rows, &livestatusRow{host: host, service: svc, entry: entry, hostStatus: hostRow.hostStatus})
+			}
+		}
+		if table == "hosts" {
+			rows = append(rows, hostRow)
+		}
+		status.names = append(status.names, host)
+		status.services = append(status.services, hostRow.services...)
+	}
+	if table == "status" {
+		rows = append(rows, status)
+	}
+	return rows
+}
+
+// livestatusError is an error returned to the client with its status code
+type livestatusError struct {
+	code    int
+	message string
+}
+
+// livestatusFilter tells whether a row is selected
+type livestatusFilter func(r *livestatusRow) bool
+
+// livestatusStat is one of the Stats of a query: either the number of rows
+// matching a filter or an aggregation of a column
+type livestatusStat struct {
+	filter      livestatusFilter
+	aggregation string
+	column      func(r *livestatusRow) interface{}
+}
+
+// livestatusQuery is a parsed LQL query
+type livestatusQuery struct {
+	table         string
+	columns       livestatusColumns
+	columnNames   []string
+	filters       []livestatusFilter
+	stats         []*livestatusStat
+	outputFormat  string
+	columnHeaders bool
+	fixed16       bool
+	keepAlive     bool
+	limit         int
+}
+
+// livestatusToFloat converts a numeric value to a float64
+func livestatusToFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// livestatusCompareOrdered applies a comparison operator to the result of a
+// comparison (-1, 0 or 1)
+func livestatusCompareOrdered(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// livestatusStringMatcher returns the function comparing a string to the
+// reference value of a filter
+func livestatusStringMatcher(op, ref string) (func(s string) bool, error) {
+	switch op {
+	case "~", "!~", "~~", "!~~":
+		pattern := ref
+		if strings.HasSuffix(op, "~~") {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		negate := strings.HasPrefix(op, "!")
+		return func(s string) bool { return re.MatchString(s) != negate }, nil
+	case "=~":
+		return func(s string) bool { return strings.EqualFold(s, ref) }, nil
+	case "!=~":
+		return func(s string) bool { return !strings.EqualFold(s, ref) }, nil
+	case "=", "!=", "<", ">", "<=", ">=":
+		return func(s string) bool { return livestatusCompareOrdered(strings.Compare(s, ref), op) }, nil
+	}
+	return nil, fmt.Errorf("invalid operator '%s'", op)
+}
+
+// newLivestatusFilter parses a "column operator value" filter. The numeric
+// columns are compared as numbers, the lists are tested for membership with
+// >= and < or for emptiness with = and !=, and the custom variables are
+// filtered with "custom_variables = NAME value", the operator applying to the
+// value of the variable only
+func newLivestatusFilter(columns livestatusColumns, spec string) (livestatusFilter, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid filter '%s'", spec)
+	}
+	column, ok := columns[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown column '%s'", parts[0])
+	}
+	op, ref := parts[1], ""
+	if len(parts) == 3 {
+		ref = parts[2]
+	}
+	var varName string
+	if strings.HasSuffix(parts[0], "custom_variables") {
+		varParts := strings.SplitN(ref, " ", 2)
+		varName, ref = strings.ToUpper(varParts[0]), ""
+		if len(varParts) == 2 {
+			ref = varParts[1]
+		}
+	}
+	match, err := livestatusStringMatcher(op, ref)
+	if err != nil {
+		return nil, err
+	}
+	refFloat, refErr := strconv.ParseFloat(ref, 64)
+	return func(r *livestatusRow) bool {
+		switch v := column(r).(type) {
+		case int64, float64:
+			f, _ := livestatusToFloat(v)
+			if refErr != nil {
+				return false
+			}
+			cmp := 0
+			if f < refFloat {
+				cmp = -1
+			} else if f > refFloat {
+				cmp = 1
+			}
+			return livestatusCompareOrdered(cmp, op)
+		case string:
+			return match(v)
+		case []string:
+			switch op {
+			case "=":
+				return ref == "" && len(v) == 0
+			case "!=":
+				return ref == "" && len(v) > 0
+			case ">=", "<":
+				return containsString(v, ref) == (op == ">=")
+			case "<=", ">":
+				return containsString(v, ref) == (op == "<=")
+			}
+			for _, elem := range v {
+				if match(elem) {
+					return true
+				}
+			}
+			return false
+		case map[string]string:
+			return match(v[varName])
+		}
+		return false
+	}, nil
+}
+
+// combineLivestatusFilters pops the n last filters of the stack and pushes
+// their conjunction or disjunction
+func combineLivestatusFilters(stack []livestatusFilter, n int, and bool) ([]livestatusFilter, error) {
+	if n < 0 || n > len(stack) {
+		return nil, fmt.Errorf("cannot combine %d filters, only %d on the stack", n, len(stack))
+	}
+	combined := append([]livestatusFilter{}, stack[len(stack)-n:]...)
+	stack = stack[:len(stack)-n]
+	return append(stack, func(r *livestatusRow) bool {
+		for _, f := range combined {
+			if f(r) != and {
+				return !and
+			}
+		}
+		return and
+	}), nil
+}
+
+// negateLivestatusFilter replaces the last filter of the stack by its negation
+func negateLivestatusFilter(stack []livestatusFilter) ([]livestatusFilter, error) {
+	if len(stack) == 0 {
+		return nil, fmt.Errorf("no filter to negate")
+	}
+	f := stack[len(stack)-1]
+	stack[len(stack)-1] = func(r *livestatusRow) bool { return !f(r) }
+	return stack, nil
+}
+
+// statFilters returns the filters of the count stats, failing if one of the
+// stats to combine is an aggregation
+func statFilters(stats []*livestatusStat) ([]livestatusFilter, error) {
+	filters := make([]livestatusFilter, len(stats))
+	for i, s := range stats {
+		if s.filter == nil {
+			return nil, fmt.Errorf("cannot combine the aggregation stats")
+		}
+		filters[i] = s.filter
+	}
+	return filters, nil
+}
+
+// parseLivestatusQuery parses the lines of an LQL query
+func parseLivestatusQuery(lines []string) (*livestatusQuery, *livestatusError) {
+	fields := strings.Fields(lines[0])
+	if len(fields) != 2 || fields[0] != "GET" {
+		return nil, &livestatusError{400, fmt.Sprintf("Invalid request '%s': only GET queries are supported", lines[0])}
+	}
+	lq := &livestatusQuery{table: fields[1], outputFormat: "csv"}
+	var ok bool
+	if lq.columns, ok = livestatusTables[lq.table]; !ok {
+		return nil, &livestatusError{404, fmt.Sprintf("Invalid GET request, no such table '%s'", lq.table)}
+	}
+	for _, line := range lines[1:] {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, &livestatusError{400, fmt.Sprintf("Invalid header line '%s'", line)}
+		}
+		header, value := parts[0], strings.TrimSpace(parts[1])
+		var err error
+		switch header {
+		case "Columns":
+			for _, name := range strings.Fields(value) {
+				if _, exists := lq.columns[name]; !exists {
+					return nil, &livestatusError{400, fmt.Sprintf("Table '%s' has no column '%s'", lq.table, name)}
+				}
+				lq.columnNames = append(lq.columnNames, name)
+			}
+		case "Filter":
+			var f livestatusFilter
+			if f, err = newLivestatusFilter(lq.columns, value); err == nil {
+				lq.filters = append(lq.filters, f)
+			}
+		case "And", "Or":
+			n, _ := strconv.Atoi(value)
+			lq.filters, err = combineLivestatusFilters(lq.filters, n, header == "And")
+		case "Negate":
+			lq.filters, err = negateLivestatusFilter(lq.filters)
+		case "Stats":
+			err = lq.addStat(value)
+		case "StatsAnd", "StatsOr":
+			n, _ := strconv.Atoi(value)
+			if n < 0 || n > len(lq.stats) {
+				err = fmt.Errorf("cannot combine %d stats, only %d defined", n, len(lq.stats))
+				break
+			}
+			var filters []livestatusFilter
+			if filters, err = statFilters(lq.stats[len(lq.stats)-n:]); err == nil {
+				filters, _ = combineLivestatusFilters(filters, n, header == "StatsAnd")
+				lq.stats = append(lq.stats[:len(lq.stats)-n], &livestatusStat{filter: filters[0]})
+			}
+		case "StatsNegate":
+			if len(lq.stats) == 0 || lq.stats[len(lq.stats)-1].filter == nil {
+				err = fmt.Errorf("no stats to negate")
+				break
+			}
+			f := lq.stats[len(lq.stats)-1].filter
+			lq.stats[len(lq.stats)-1].filter = func(r *livestatusRow) bool { return !f(r) }
+		case "OutputFormat":
+			if !containsString(livestatusOutputFormats, value) {
+				err = fmt.Errorf("invalid output format '%s'", value)
+			}
+			lq.outputFormat = value
+		case "ColumnHeaders":
+			lq.columnHeaders = value == "on"
+		case "ResponseHeader":
+			lq.fixed16 = value == "fixed16"
+		case "KeepAlive":
+			lq.keepAlive = value == "on"
+		case "Limit":
+			if lq.limit, err = strconv.Atoi(value); err == nil && lq.limit < 0 {
+				err = fmt.Errorf("invalid limit '%s'", value)
+			}
+		case "AuthUser", "Localtime", "Timelimit", "WaitTimeout", "WaitTrigger", "WaitObject", "WaitCondition", "Separators":
+			// Accepted for the compatibility with the clients but ignored
+		default:
+			err = fmt.Errorf("undefined request header '%s'", header)
+		}
+		if err != nil {
+			return nil, &livestatusError{400, fmt.Sprintf("%s: %s", header, err)}
+		}
+	}
+	// Without Columns, all the columns are returned with their names
+	if len(lq.columnNames) == 0 && len(lq.stats) == 0 {
+		for name := range lq.columns {
+			lq.columnNames = append(lq.columnNames, name)
+		}
+		sort.Strings(lq.columnNames)
+		lq.columnHeaders = true
+	}
+	return lq, nil
+}
+
+// addStat adds a "Stats: column operator value" count or a
+// "Stats: sum|min|max|avg column" aggregation to the query
+func (lq *livestatusQuery) addStat(spec string) error {
+	parts := strings.Fields(spec)
+	if len(parts) == 2 {
+		switch parts[0] {
+		case "sum", "min", "max", "avg":
+			column, ok := lq.columns[parts[1]]
+			if !ok {
+				return fmt.Errorf("unknown column '%s'", parts[1])
+			}
+			lq.stats = append(lq.stats, &livestatusStat{aggregation: parts[0], column: column})
+			return nil
+		}
+	}
+	f, err := newLivestatusFilter(lq.columns, spec)
+	if err != nil {
+		return err
+	}
+	lq.stats = append(lq.stats, &livestatusStat{filter: f})
+	return nil
+}
+
+// livestatusAggregate computes the value of a stat on a set of rows
+func livestatusAggregate(s *livestatusStat, rows []*livestatusRow) interface{} {
+	if s.filter != nil {
+		count := int64(0)
+		for _, r := range rows {
+			if s.filter(r) {
+				count++
+			}
+		}
+		return count
+	}
+	var sum float64
+	min, max := math.Inf(1), math.Inf(-1)
+	n := 0
+	for _, r := range rows {
+		f, ok := livestatusToFloat(s.column(r))
+		if !ok {
+			continue
+		}
+		sum += f
+		min = math.Min(min, f)
+		max = math.Max(max, f)
+		n++
+	}
+	if n == 0 {
+		return float64(0)
+	}
+	switch s.aggregation {
+	case "min":
+		return min
+	case "max":
+		return max
+	case "avg":
+		return sum / float64(n)
+	}
+	return sum
+}
+
+// execute runs the query and returns the rows of the response, starting with
+// the column names when requested
+func (lq *livestatusQuery) execute() [][]interface{} {
+	var selected []*livestatusRow
+	for _, r := range livestatusRows(lq.table) {
+		match := true
+		for _, f := range lq.filters {
+			if !f(r) {
+				match = false
+				break
+			}
+		}
+		if match {
+			selected = append(selected, r)
+		}
+	}
+
+	var result [][]interface{}
+	if lq.columnHeaders {
+		header := make([]interface{}, 0, len(lq.columnNames)+len(lq.stats))
+		for _, name := range lq.columnNames {
+			header = append(header, name)
+		}
+		for i := range lq.stats {
+			header = append(header, fmt.Sprint("stats_", i+1))
+		}
+		result = append(result, header)
+	}
+
+	if len(lq.stats) == 0 {
+		if lq.limit > 0 && len(selected) > lq.limit {
+			selected = selected[:lq.limit]
+		}
+		for _, r := range selected {
+			row := make([]interface{}, len(lq.columnNames))
+			for i, name := range lq.columnNames {
+				row[i] = lq.columns[name](r)
+			}
+			result = append(result, row)
+		}
+		return result
+	}
+
+	// The stats are grouped by the values of the columns, in the order the
+	// groups are first seen
+	var groupKeys []string
+	groups := make(map[string][]*livestatusRow)
+	groupValues := make(map[string][]interface{})
+	for _, r := range selected {
+		values := make([]interface{}, len(lq.columnNames))
+		for i, name := range lq.columnNames {
+			values[i] = lq.columns[name](r)
+		}
+		key := fmt.Sprint(values...)
+		if _, exists := groups[key]; !exists {
+			groupKeys = append(groupKeys, key)
+			groupValues[key] = values
+		}
+		groups[key] = append(groups[key], r)
+	}
+	if len(lq.columnNames) == 0 && len(groupKeys) == 0 {
+		groupKeys = append(groupKeys, "")
+	}
+	for _, key := range groupKeys {
+		row := append([]interface{}{}, groupValues[key]...)
+		for _, s := range lq.stats {
+			row = append(row, livestatusAggregate(s, groups[key]))
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// livestatusCSVEscaper escapes the field separator in the values of the csv
+// output format
+var livestatusCSVEscaper = strings.NewReplacer(";", `\;`)
+
+// livestatusCSVValue formats a value for the csv output format: the lists are
+// comma-separated and the custom variables are written as NAME|value. The
+// semicolons of the value are escaped as \;
+func livestatusCSVValue(value interface{}) string {
+	switch v := value.(type) {
+	case []string:
+		return livestatusCSVEscaper.Replace(strings.Join(v, ","))
+	case map[string]string:
+		names := livestatusCustomVariableNames(v)
+		pairs := make([]string, len(names))
+		for i, name := range names {
+			pairs[i] = name + "|" + v[name]
+		}
+		return livestatusCSVEscaper.Replace(strings.Join(pairs, ","))
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return livestatusCSVEscaper.Replace(fmt.Sprint(value))
+}
+
+// livestatusPythonValue formats a value as a Python literal, the strings being
+// unicode literals for python and plain literals for python3
+func livestatusPythonValue(b *strings.Builder, value interface{}, python3 bool) {
+	switch v := value.(type) {
+	case string:
+		if !python3 {
+			b.WriteString("u")
+		}
+		b.WriteString(livestatusPythonString(v))
+	case []string:
+		b.WriteString("[")
+		for i, s := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			livestatusPythonValue(b, s, python3)
+		}
+		b.WriteString("]")
+	case map[string]string:
+		b.WriteString("{")
+		for i, name := range livestatusCustomVariableNames(v) {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			livestatusPythonValue(b, name, python3)
+			b.WriteString(": ")
+			livestatusPythonValue(b, v[name], python3)
+		}
+		b.WriteString("}")
+	case []interface{}:
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			livestatusPythonValue(b, item, python3)
+		}
+		b.WriteString("]")
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			v = 0
+		}
+		b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		fmt.Fprint(b, v)
+	}
+}
+
+// livestatusPythonString quotes a string as a Python literal, escaping the
+// quotes, the backslashes, the control characters and the non-ASCII characters
+func livestatusPythonString(s string) string {
+	var b strings.Builder
+	b.WriteString(`"`)
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteString(`\` + string(r))
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case r > 0xffff:
+			fmt.Fprintf(&b, `\U%08x`, r)
+		case r > 0x7e:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteString(`"`)
+	return b.String()
+}
+
+// formatLivestatusResult formats the rows of the response in the output
+// format of the query
+func formatLivestatusResult(lq *livestatusQuery, rows [][]interface{}) []byte {
+	if lq.outputFormat == "python" || lq.outputFormat == "python3" {
+		var b strings.Builder
+		b.WriteString("[")
+		for i, row := range rows {
+			if i > 0 {
+				b.WriteString(",\n")
+			}
+			livestatusPythonValue(&b, row, lq.outputFormat == "python3")
+		}
+		b.WriteString("]\n")
+		return []byte(b.String())
+	}
+	if lq.outputFormat == "csv" {
+		var b strings.Builder
+		for _, row := range rows {
+			fields := make([]string, len(row))
+			for i, value := range row {
+				fields[i] = livestatusCSVValue(value)
+			}
+			b.WriteString(strings.Join(fields, ";") + "\n")
+		}
+		return []byte(b.String())
+	}
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	out, _ := json.Marshal(rows)
+	return append(out, '\n')
+}
+
+// writeLivestatusResponse writes the response with the fixed16 header when
+// requested
+func writeLivestatusResponse(w io.Writer, fixed16 bool, code int, body []byte) error {
+	if fixed16 {
+		if _, err := fmt.Fprintf(w, "%03d %11d\n", code, len(body)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// readLivestatusQuery reads the lines of a query up to the empty line ending
+// it or the end of the connection
+func readLivestatusQuery(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(lines) > 0 || err != nil {
+				return lines, err
+			}
+			continue
+		}
+		lines = append(lines, line)
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// handleLivestatusConn answers the queries of a client, keeping the
+// connection open between the queries when requested with KeepAlive. Each
+// query must be read and answered within livestatusTimeout
+func handleLivestatusConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(livestatusTimeout))
+		lines, err := readLivestatusQuery(r)
+		if len(lines) == 0 {
+			return
+		}
+		lq, lsErr := parseLivestatusQuery(lines)
+		if lsErr != nil {
+			fixed16 := containsString(lines, "ResponseHeader: fixed16")
+			writeLivestatusResponse(conn, fixed16, lsErr.code, []byte(lsErr.message+"\n"))
+			return
+		}
+		if writeLivestatusResponse(conn, lq.fixed16, 200, formatLivestatusResult(lq, lq.execute())) != nil {
+			return
+		}
+		if !lq.keepAlive || err != nil {
+			return
+		}
+	}
+}
+
+// livestatusListen opens the Livestatus listener: "unix:/path/to/socket" for
+// a Unix socket, "tcp:ip:port" or "ip:port" for a TCP socket
+func livestatusListen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		// Remove the socket left by a previous run
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", strings.TrimPrefix(address, "tcp:"))
+}
+
+// initLivestatus starts the Livestatus listener. An empty address disables it
+func initLivestatus(address string) error {
+	if address == "" {
+		return nil
+	}
+	ln, err := livestatusListen(address)
+	if err != nil {
+		return err
+	}
+	go serveLivestatus(ln)
+	return nil
+}
+
+// serveLivestatus accepts the Livestatus clients
+func serveLivestatus(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Livestatus listener stopped: %s", err)
+			return
+		}
+		go handleLivestatusConn(conn)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// livestatusTestCache fills the cache with the checks used by the Livestatus
+// tests
+func livestatusTestCache() {
+	initCache()
+	eventHandlers = nil
+	cFields.load("testData/customFields")
+	updateCacheEntry("web01", "apache", "OK - running|time=0.1s;1;2", 1484527962, 0)
+	updateCacheEntry("web01", "disk", "DISK WARNING - 85% used\n/var 85%\n/tmp 12%", 1484527963, 1)
+	updateCacheEntry("web02", "apache", "CRITICAL - down", 1484527964, 2)
+	updateCacheEntry("db01", "mysql", "UNKNOWN - no data", 1484527965, 3)
+	updateCacheEntry("web02", "", "PING CRITICAL - 100% loss", 1484527966, 1)
+	acknowledgeCacheEntry("web02", "apache")
+	hostClockSkews["web01"] = &clockSkew{Samples: 2, Last: -3, Min: -3, Max: 1, Mean: -1}
+}
+
+// runLivestatusQuery sends a query to a Livestatus connection and returns the
+// whole response
+func runLivestatusQuery(query string) string {
+	client, server := net.Pipe()
+	go handleLivestatusConn(server)
+	go client.Write([]byte(query))
+	out, _ := ioutil.ReadAll(client)
+	client.Close()
+	return string(out)
+}
+
+func TestLivestatusQueries(t *testing.T) {
+	livestatusTestCache()
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"columns", "GET services\nColumns: host_name description state\n\n",
+			"db01;mysql;3\nweb01;apache;0\nweb01;disk;1\nweb02;apache;2\n"},
+		{"filter", "GET services\nColumns: host_name description\nFilter: state >= 1\nFilter: acknowledged = 0\n\n",
+			"db01;mysql\nweb01;disk\n"},
+		{"or", "GET services\nColumns: host_name description\nFilter: state = 1\nFilter: state = 3\nOr: 2\n\n",
+			"db01;mysql\nweb01;disk\n"},
+		{"negate", "GET services\nColumns: host_name description\nFilter: host_name ~ ^web\nNegate:\n\n",
+			"db01;mysql\n"},
+		{"case-insensitive regex", "GET services\nColumns: description\nFilter: plugin_output ~~ disk\n\n",
+			"disk\n"},
+		{"list membership", "GET hosts\nColumns: name\nFilter: groups >= web\n\n",
+			"web01\nweb02\n"},
+		{"custom variables", "GET services\nColumns: host_name description custom_variables\nFilter: custom_variables = PAGING true\n\n",
+			"db01;mysql;PAGING|true,RUNBOOK|https://wiki.example.org/teams/dba/runbooks.html,TEAM|dba,ops\n" +
+				"web01;apache;PAGING|true,RUNBOOK|https://wiki.example.org/teams/cross/runbooks/apache.html,TEAM|webdev\n" +
+				"web02;apache;PAGING|true,RUNBOOK|https://wiki.example.org/teams/cross/runbooks/apache.html,TEAM|webdev\n"},
+		{"custom variable regex", "GET services\nColumns: host_name description\nFilter: custom_variables ~ TEAM ^web\n\n",
+			"web01;apache\nweb01;disk\nweb02;apache\n"},
+		{"custom variable case-insensitive regex", "GET services\nColumns: host_name description\nFilter: custom_variables ~~ team ^DBA\n\n",
+			"db01;mysql\n"},
+		{"custom variable regex on the value only", "GET services\nColumns: host_name description\nFilter: custom_variables ~ TEAM TEAM\n\n",
+			""},
+		{"custom variable name with regex characters", "GET services\nColumns: host_name\nFilter: custom_variables ~ TE(AM web\n\n",
+			""},
+		{"long output and perfdata", "GET services\nColumns: plugin_output long_plugin_output perf_data\nFilter: host_name = web01\n\n",
+			"OK - running;;time=0.1s\\;1\\;2\nDISK WARNING - 85% used;/var 85%\\n/tmp 12%;\n"},
+		{"hosts", "GET hosts\nColumns: name num_services num_services_warn worst_service_state last_check\nFilter: name = web01\n\n",
+			"web01;2;1;1;1484527963\n"},
+		{"host checks", "GET hosts\nColumns: name state plugin_output last_check\n\n",
+			"db01;0;Passive results received for 1 services;1484527965\nweb01;0;Passive results received for 2 services;1484527963\nweb02;1;PING CRITICAL - 100% loss;1484527966\n"},
+		{"clock skew", "GET hosts\nColumns: name clock_skew_samples clock_skew_last clock_skew_min clock_skew_max clock_skew_mean\n\n",
+			"db01;0;0;0;0;0\nweb01;2;-3;-3;1;-1\nweb02;0;0;0;0;0\n"},
+		{"host state of the services", "GET services\nColumns: host_name description host_state\nFilter: host_state != 0\n\n",
+			"web02;apache;1\n"},
+		{"stats", "GET services\nStats: state = 0\nStats: state = 1\nStats: state = 2\nStats: state = 3\n\n",
+			"1;1;1;1\n"},
+		{"stats grouped by column", "GET services\nColumns: host_name\nStats: state != 0\n\n",
+			"db01;1\nweb01;1\nweb02;1\n"},
+		{"stats and", "GET services\nStats: state = 2\nStats: acknowledged = 1\nStatsAnd: 2\n\n",
+			"1\n"},
+		{"stats aggregation", "GET services\nFilter: host_name = web01\nStats: sum state\nStats: max last_check\nStats: avg state\n\n",
+			"1;1484527963;0.5\n"},
+		{"json", "GET services\nColumns: host_name state host_groups\nFilter: host_name = web02\nOutputFormat: json\nColumnHeaders: on\n\n",
+			"[[\"host_name\",\"state\",\"host_groups\"],[\"web02\",2,[\"web\"]]]\n"},
+		{"json empty", "GET services\nColumns: host_name\nFilter: host_name = nonExisting\nOutputFormat: json\n\n",
+			"[]\n"},
+		{"python", "GET services\nColumns: host_name state host_groups custom_variables\nFilter: host_name = web02\nOutputFormat: python\nColumnHeaders: on\n\n",
+			"[[u\"host_name\", u\"state\", u\"host_groups\", u\"custom_variables\"],\n[u\"web02\", 2, [u\"web\"], {u\"PAGING\": u\"true\", u\"RUNBOOK\": u\"https://wiki.example.org/teams/cross/runbooks/apache.html\", u\"TEAM\": u\"webdev\"}]]\n"},
+		{"python3", "GET services\nFilter: host_name = web01\nStats: avg state\nStats: sum state\nOutputFormat: python3\n\n",
+			"[[0.5, 1]]\n"},
+		{"python empty", "GET services\nColumns: host_name\nFilter: host_name = nonExisting\nOutputFormat: python\n\n",
+			"[]\n"},
+		{"invalid output format", "GET services\nOutputFormat: xml\n\n",
+			"OutputFormat: invalid output format 'xml'\n"},
+		{"limit", "GET services\nColumns: host_name\nLimit: 2\n\n",
+			"db01\nweb01\n"},
+		{"status", "GET status\nColumns: num_hosts num_services accept_passive_service_checks\n\n",
+			"3;4;1\n"},
+		{"fixed16", "GET services\nColumns: description\nFilter: state = 3\nResponseHeader: fixed16\n\n",
+			"200           6\nmysql\n"},
+		{"unknown table", "GET comments\nResponseHeader: fixed16\n\n",
+			"404          46\nInvalid GET request, no such table 'comments'\n"},
+		{"unknown column", "GET services\nColumns: nonExisting\n\n",
+			"Table 'services' has no column 'nonExisting'\n"},
+		{"invalid filter", "GET services\nFilter: state\n\n",
+			"Filter: invalid filter 'state'\n"},
+		{"invalid regex", "GET services\nFilter: description ~ (\n\n",
+			"Filter: error parsing regexp: missing closing ): `(`\n"},
+		{"too many filters combined", "GET services\nFilter: state = 0\nAnd: 2\n\n",
+			"And: cannot combine 2 filters, only 1 on the stack\n"},
+		{"command", "COMMAND [1484527962] ACKNOWLEDGE_SVC_PROBLEM;web01;disk\n\n",
+			"Invalid request 'COMMAND [1484527962] ACKNOWLEDGE_SVC_PROBLEM;web01;disk': only GET queries are supported\n"},
+	}
+	for _, tt := range cases {
+		if out := runLivestatusQuery(tt.query); out != tt.expected {
+			t.Errorf("%s: expecting\n%q\nGot\n%q", tt.name, tt.expected, out)
+		}
+	}
+}
+
+func TestLivestatusCSVSeparator(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	updateCacheEntry("db01", "backup", "BACKUP OK - db;logs\nlast: 02:00;03:00", 1484527962, 0)
+	expected := "db01;BACKUP OK - db\\;logs;last: 02:00\\;03:00\n"
+	if out := runLivestatusQuery("GET services\nColumns: host_name plugin_output long_plugin_output\n\n"); out != expected {
+		t.Errorf("Expecting the separators of the outputs to be escaped:\n%q\nGot\n%q", expected, out)
+	}
+}
+
+func TestLivestatusAllColumns(t *testing.T) {
+	livestatusTestCache()
+	out := runLivestatusQuery("GET hosts\nFilter: name = db01\n\n")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "accept_passive_checks;acknowledged;active_checks_enabled;address;") {
+		t.Errorf("Expecting the headers and one row of all the columns. Got:\n%s", out)
+	}
+}
+
+func TestLivestatusKeepAlive(t *testing.T) {
+	livestatusTestCache()
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleLivestatusConn(server)
+	r := bufio.NewReader(client)
+	go client.Write([]byte("GET services\nColumns: description\nFilter: state = 1\nKeepAlive: on\nResponseHeader: fixed16\n\n"))
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "200           5\n" {
+		t.Fatalf("Unexpected header %q: %v", header, err)
+	}
+	body := make([]byte, 5)
+	if _, err := io.ReadFull(r, body); err != nil || string(body) != "disk\n" {
+		t.Fatalf("Unexpected body %q: %v", body, err)
+	}
+	// The connection is still open for a second query
+	go client.Write([]byte("GET services\nColumns: description\nFilter: state = 2\n\n"))
+	out, _ := ioutil.ReadAll(r)
+	if string(out) != "apache\n" {
+		t.Errorf("Unexpected response to the second query: %q", out)
+	}
+}
+
+func TestLivestatusPythonString(t *testing.T) {
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{"web01", `"web01"`},
+		{`say "hi" \o/`, `"say \"hi\" \\o/"`},
+		{"line 1\nline 2\r\tend\x01", `"line 1\nline 2\r\tend\x01"`},
+		{"café 🚀", `"caf\u00e9 \U0001f680"`},
+	}
+	for _, tt := range cases {
+		if out := livestatusPythonString(tt.in); out != tt.out {
+			t.Errorf("livestatusPythonString(%q) should return %s, not %s", tt.in, tt.out, out)
+		}
+	}
+}
+
+func TestLivestatusTimeout(t *testing.T) {
+	livestatusTimeout = 50 * time.Millisecond
+	defer func() { livestatusTimeout = time.Minute }()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleLivestatusConn(server)
+		close(done)
+	}()
+	// The client never ends its query
+	go client.Write([]byte("GET services\n"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The connection of an idle client should be closed")
+	}
+}
+
+func TestInitLivestatus(t *testing.T) {
+	livestatusTestCache()
+	if err := initLivestatus(""); err != nil {
+		t.Errorf("An empty address should disable Livestatus. Got %s", err)
+	}
+	dir, err := ioutil.TempDir("", "nscapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "live")
+	for i := 0; i < 2; i++ {
+		// The second listener replaces the socket left by the first one
+		ln, err := livestatusListen("unix:" + socket)
+		if err != nil {
+			t.Fatalf("Unable to listen on %s: %s", socket, err)
+		}
+		go serveLivestatus(ln)
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET services\nColumns: host_name\nFilter: state = 3\n\n"))
+		out, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(out) != "db01\n" {
+			t.Errorf("Unexpected response on the Unix socket: %q", out)
+		}
+		if i == 0 {
+			// Simulate a crash leaving the socket file behind
+			ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		ln.Close()
+	}
+	if _, err := livestatusListen("tcp:256.0.0.1:6557"); err == nil {
+		t.Error("Expecting an error for an invalid address")
+	}
+}
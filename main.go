@@ -4,6 +4,7 @@ import (
 	"flag"
 	"github.com/PurpureGecko/go-lfc"
 	nsca "github.com/tubemogul/nscatools"
+	"log"
 	"os"
 	"strconv"
 	"time"
@@ -11,6 +12,16 @@ import (
 
 var q *lfc.Queue
 
+// queuedPacket is a packet waiting in the queue along with the time it has been
+// received and the source it comes from. An acknowledgement only uses the host
+// and service names of the packet
+type queuedPacket struct {
+	packet      *nsca.DataPacket
+	receivedAt  time.Time
+	source      string
+	acknowledge bool
+}
+
 type cfg struct {
 	apiIP              string
 	apiPort            uint
@@ -20,6 +31,31 @@ type cfg struct {
 	nscaPort           uint
 	nscaPassword       string
 	nscaEncryption     uint
+	notificationsCfg   string
+	eventHandlersCfg   string
+	metricsLabels      string
+	adminIP            string
+	adminPort          uint
+	adminPprof         bool
+	readyMaxQueue      uint
+	probeStatusCodes   string
+	statusDatPath      string
+	statusDatInterval  uint
+	livestatusListen   string
+	resultsTokens      string
+	icingaAPIUsers     string
+	zabbixListen       string
+	zabbixMapping      string
+	commandFile        string
+	lineListen         string
+	lineSecret         string
+	rejectOutOfOrder   bool
+	maxPacketAge       uint
+	maxFutureSkew      uint
+	futureTimestamps   string
+	timestampClock     string
+	rewriteRules       string
+	filterRules        string
 }
 
 // cacheWorker will continuously pull DataPackets out of the queue and update
@@ -37,8 +73,27 @@ func cacheWorker(runIndefinetly bool) {
 		} else {
 			pkt, ok := q.Dequeue()
 			if ok {
-				if p, ok := pkt.(*nsca.DataPacket); ok {
-					updateCacheEntry(p.HostName, p.Service, p.PluginOutput, p.Timestamp, p.State)
+				if qp, ok := pkt.(*queuedPacket); ok {
+					workerLag.set(time.Since(qp.receivedAt).Seconds())
+					if qp.acknowledge {
+						// The acknowledgements are rewritten like the results
+						// to target the entries the results were stored in
+						if !rewriteResult(qp.packet) {
+							log.Printf("Ignoring the acknowledgement of %s from %s: dropped by the rewrite rules", checkName(qp.packet.HostName, qp.packet.Service), qp.source)
+							continue
+						}
+						if err := acknowledgeCacheEntry(qp.packet.HostName, qp.packet.Service); err != nil {
+							log.Printf("Ignoring the acknowledgement from %s: %s", qp.source, err)
+						}
+						continue
+					}
+					if !rewriteResult(qp.packet) || !filterResult(qp) || !acceptResult(qp) {
+						continue
+					}
+					p := qp.packet
+					updateCacheEntryAt(p.HostName, p.Service, p.PluginOutput, p.Timestamp, qp.receivedAt, p.State)
+					cacheUpdates.inc()
+					lastIngestion.set(float64(time.Now().Unix()))
 				}
 			}
 		}
@@ -48,10 +103,24 @@ func cacheWorker(runIndefinetly bool) {
 // queueData will put the DataPacket received by the nsca server in a
 // non-locking queue
 func queueData(p *nsca.DataPacket) error {
-	q.Enqueue(p)
+	queueResult(p, "nsca")
 	return nil
 }
 
+// queueResult puts a check result received from any of the sources in the
+// queue processed by the cache worker
+func queueResult(p *nsca.DataPacket, source string) {
+	resultsReceived.inc(source)
+	q.Enqueue(&queuedPacket{packet: p, receivedAt: time.Now(), source: source})
+}
+
+// queueAcknowledgement puts the acknowledgement of the problem of a check in the
+// queue processed by the cache worker, so that it applies after the results
+// queued before it. The empty service name acknowledges the host check
+func queueAcknowledgement(hostname, servicename, source string) {
+	q.Enqueue(&queuedPacket{packet: &nsca.DataPacket{HostName: hostname, Service: servicename}, receivedAt: time.Now(), source: source, acknowledge: true})
+}
+
 // getStringFromEnv gets the string value of the specified environment variable
 // or the default value if this variable is not set
 func getStringFromEnv(varName string, defaultValue string) string {
@@ -65,6 +134,17 @@ func getStringFromEnv(varName string, defaultValue string) string {
 	return val
 }
 
+// getBoolFromEnv gets the bool value of the specified environment variable
+// or the default value if this variable is not set
+func getBoolFromEnv(varName string, defaultValue bool) bool {
+	strVal, present := os.LookupEnv(varName)
+	val, err := strconv.ParseBool(strVal)
+	if !present || err != nil {
+		val = defaultValue
+	}
+	return val
+}
+
 // getUintFromEnv gets the uint value of the specified environment variable
 // or the default value if this variable is not set
 func getUintFromEnv(varName string, defaultValue uint, bitSize int) uint {
@@ -94,6 +174,31 @@ func initConfig() *cfg {
 	flag.UintVar(&conf.nscaPort, "nsca-server-port", getUintFromEnv("NSCAPI_NSCA_PORT", 5667, 16), "Port the NSCA server should listen on. Default to the NSCAPI_NSCA_PORT environment variable. Fallback: 5667")
 	flag.StringVar(&conf.nscaPassword, "nsca-server-password", getStringFromEnv("NSCAPI_NSCA_PASSWORD", ""), "Password the NSCA server should use. Default to the NSCAPI_NSCA_PASSWORD environment variable. Fallback: ''")
 	flag.UintVar(&conf.nscaEncryption, "nsca-server-encryption", getUintFromEnv("NSCAPI_NSCA_ENCYPTION", 0, 8), "Number corresponding to the encryption to be used by the NSCA server. Default to the NSCAPI_NSCA_ENCRYPTION environment variable. Fallback: 0. See 'DECRYPTION METHOD' on https://github.com/NagiosEnterprises/nsca/blob/master/sample-config/nsca.cfg.in for more details. Must be <27.")
+	flag.StringVar(&conf.notificationsCfg, "notifications-config", getStringFromEnv("NSCAPI_NOTIFICATIONS_CONFIG", ""), "Path to the yaml file configuring the notification sinks. Default to the NSCAPI_NOTIFICATIONS_CONFIG environment variable. Fallback: '' (notifications disabled)")
+	flag.StringVar(&conf.eventHandlersCfg, "event-handlers-config", getStringFromEnv("NSCAPI_EVENT_HANDLERS_CONFIG", ""), "Path to the yaml file configuring the event handlers. Default to the NSCAPI_EVENT_HANDLERS_CONFIG environment variable. Fallback: '' (event handlers disabled)")
+	flag.StringVar(&conf.metricsLabels, "metrics-custom-labels", getStringFromEnv("NSCAPI_METRICS_CUSTOM_LABELS", ""), "Comma-separated list of custom fields exposed as labels of the check metrics on /metrics. Default to the NSCAPI_METRICS_CUSTOM_LABELS environment variable. Fallback: ''")
+	flag.StringVar(&conf.adminIP, "admin-ip", getStringFromEnv("NSCAPI_ADMIN_IP", "127.0.0.1"), "IP the admin server exposing the internal metrics should listen on. Default to the NSCAPI_ADMIN_IP environment variable. Fallback: 127.0.0.1")
+	flag.UintVar(&conf.adminPort, "admin-port", getUintFromEnv("NSCAPI_ADMIN_PORT", 0, 16), "Port the admin server exposing the internal metrics should listen on. Default to the NSCAPI_ADMIN_PORT environment variable. Fallback: 0 (admin server disabled)")
+	flag.BoolVar(&conf.adminPprof, "admin-pprof", getBoolFromEnv("NSCAPI_ADMIN_PPROF", false), "Expose the pprof handlers on /debug/pprof/ on the admin server. Default to the NSCAPI_ADMIN_PPROF environment variable. Fallback: false")
+	flag.UintVar(&conf.readyMaxQueue, "ready-max-queue-length", getUintFromEnv("NSCAPI_READY_MAX_QUEUE_LENGTH", 10000, 32), "Number of check results waiting in the queue above which /readyz reports nscapi as not ready. Default to the NSCAPI_READY_MAX_QUEUE_LENGTH environment variable. Fallback: 10000")
+	flag.StringVar(&conf.probeStatusCodes, "probe-status-codes", getStringFromEnv("NSCAPI_PROBE_STATUS_CODES", "ok=200,warning=429,critical=503,unknown=503"), "Comma-separated mapping of the check states to the HTTP status codes returned on /probe/. Default to the NSCAPI_PROBE_STATUS_CODES environment variable. Fallback: ok=200,warning=429,critical=503,unknown=503")
+	flag.StringVar(&conf.statusDatPath, "status-dat-path", getStringFromEnv("NSCAPI_STATUS_DAT_PATH", ""), "Path of the Nagios status.dat file periodically written from the cache. Default to the NSCAPI_STATUS_DAT_PATH environment variable. Fallback: '' (file not written)")
+	flag.UintVar(&conf.statusDatInterval, "status-dat-interval", getUintFromEnv("NSCAPI_STATUS_DAT_INTERVAL", 10, 32), "Number of seconds between 2 writes of the status.dat file. Default to the NSCAPI_STATUS_DAT_INTERVAL environment variable. Fallback: 10")
+	flag.StringVar(&conf.livestatusListen, "livestatus-listen", getStringFromEnv("NSCAPI_LIVESTATUS_LISTEN", ""), "Address of the Livestatus listener: 'ip:port' for a TCP socket or 'unix:/path/to/socket' for a Unix socket. Default to the NSCAPI_LIVESTATUS_LISTEN environment variable. Fallback: '' (Livestatus disabled)")
+	flag.StringVar(&conf.resultsTokens, "api-results-tokens", getStringFromEnv("NSCAPI_API_RESULTS_TOKENS", ""), "Comma-separated list of the tokens accepted by /api/results, /nrdp and /api/acknowledge. Default to the NSCAPI_API_RESULTS_TOKENS environment variable. Fallback: '' (every submission rejected)")
+	flag.StringVar(&conf.zabbixListen, "zabbix-listen", getStringFromEnv("NSCAPI_ZABBIX_LISTEN", ""), "Address ('ip:port') of the listener accepting the zabbix_sender requests. Default to the NSCAPI_ZABBIX_LISTEN environment variable. Fallback: '' (Zabbix listener disabled)")
+	flag.StringVar(&conf.zabbixMapping, "zabbix-mapping", getStringFromEnv("NSCAPI_ZABBIX_MAPPING", ""), "Path to the yaml file mapping the Zabbix items to the services. Default to the NSCAPI_ZABBIX_MAPPING environment variable. Fallback: '' (item key as service and value as state)")
+	flag.StringVar(&conf.commandFile, "command-file", getStringFromEnv("NSCAPI_COMMAND_FILE", ""), "Path to the named pipe or the file to read the Nagios external commands from. Default to the NSCAPI_COMMAND_FILE environment variable. Fallback: '' (external commands disabled)")
+	flag.StringVar(&conf.lineListen, "line-listen", getStringFromEnv("NSCAPI_LINE_LISTEN", ""), "Address ('ip:port') of the TCP and UDP listeners accepting the tab-delimited check results. Default to the NSCAPI_LINE_LISTEN environment variable. Fallback: '' (line protocol disabled)")
+	flag.StringVar(&conf.lineSecret, "line-secret", getStringFromEnv("NSCAPI_LINE_SECRET", ""), "Shared secret prefixing the tab-delimited check results. Default to the NSCAPI_LINE_SECRET environment variable. Fallback: '' (no secret expected)")
+	flag.BoolVar(&conf.rejectOutOfOrder, "reject-out-of-order", getBoolFromEnv("NSCAPI_REJECT_OUT_OF_ORDER", false), "Ignore the check results older than the result in the cache for the same check. Default to the NSCAPI_REJECT_OUT_OF_ORDER environment variable. Fallback: false")
+	flag.UintVar(&conf.maxPacketAge, "max-packet-age", getUintFromEnv("NSCAPI_MAX_PACKET_AGE", 0, 32), "Maximum age in seconds of the check results when they are received, like max_packet_age in nsca.cfg. Default to the NSCAPI_MAX_PACKET_AGE environment variable. Fallback: 0 (no maximum age)")
+	flag.UintVar(&conf.maxFutureSkew, "max-future-skew", getUintFromEnv("NSCAPI_MAX_FUTURE_SKEW", 0, 32), "Number of seconds a check result timestamp can be ahead of the nscapi clock before -future-timestamps applies. Default to the NSCAPI_MAX_FUTURE_SKEW environment variable. Fallback: 0")
+	flag.StringVar(&conf.futureTimestamps, "future-timestamps", getStringFromEnv("NSCAPI_FUTURE_TIMESTAMPS", "accept"), "Policy applied to the check results with a timestamp in the future beyond -max-future-skew: accept, clamp (to the receive time) or reject. Default to the NSCAPI_FUTURE_TIMESTAMPS environment variable. Fallback: accept")
+	flag.StringVar(&conf.timestampClock, "timestamp-clock", getStringFromEnv("NSCAPI_TIMESTAMP_CLOCK", "client"), "Clock driving the timestamps, the time of the last status change and the age of the checks: client (timestamp of the check result) or server (time nscapi received the result). Default to the NSCAPI_TIMESTAMP_CLOCK environment variable. Fallback: client")
+	flag.StringVar(&conf.rewriteRules, "rewrite-rules", getStringFromEnv("NSCAPI_REWRITE_RULES", ""), "Path to the yaml file of the rules rewriting the host and service names of the check results, reloaded when it changes. Default to the NSCAPI_REWRITE_RULES environment variable. Fallback: '' (names kept as received)")
+	flag.StringVar(&conf.filterRules, "filter-rules", getStringFromEnv("NSCAPI_FILTER_RULES", ""), "Path to the yaml file of the rules accepting or denying the check results before they reach the cache. Default to the NSCAPI_FILTER_RULES environment variable. Fallback: '' (every result accepted)")
+	flag.StringVar(&conf.icingaAPIUsers, "icinga-api-users", getStringFromEnv("NSCAPI_ICINGA_API_USERS", ""), "Comma-separated list of the 'user:password' accepted by the Icinga 2 API emulation. Default to the NSCAPI_ICINGA_API_USERS environment variable. Fallback: '' (every submission rejected)")
 	flag.Parse()
 	return &conf
 }
@@ -105,14 +210,87 @@ func main() {
 	// Loads config from flags or from env
 	srvConf := initConfig()
 
+	// Load the custom fields before anything can read them
+	initCustomFields(srvConf.apiCustomFieldRoot, srvConf.apiTemplatesRoot)
+
+	// Start the notification sinks and event handlers before the worker can
+	// detect state changes
+	if err := initNotifications(srvConf.notificationsCfg); err != nil {
+		log.Fatalf("Unable to load the notifications configuration: %s", err)
+	}
+
+	if err := initEventHandlers(srvConf.eventHandlersCfg); err != nil {
+		log.Fatalf("Unable to load the event handlers configuration: %s", err)
+	}
+
+	if err := initRewriteRules(srvConf.rewriteRules); err != nil {
+		log.Fatalf("Unable to load the rewrite rules: %s", err)
+	}
+	if err := initFilter(srvConf.filterRules); err != nil {
+		log.Fatalf("Unable to load the filter rules: %s", err)
+	}
+
 	// Start the worker that updates the cache
 	go cacheWorker(true)
 
+	metricsCustomLabels = parseMetricsCustomLabels(srvConf.metricsLabels)
+	readyMaxQueueLength = srvConf.readyMaxQueue
+	codes, err := parseProbeStatusCodes(srvConf.probeStatusCodes)
+	if err != nil {
+		log.Fatalf("Unable to parse the probe status codes: %s", err)
+	}
+	probeStatusCodes = codes
+	resultsTokens = parseResultsTokens(srvConf.resultsTokens)
+	users, err := parseIcingaAPIUsers(srvConf.icingaAPIUsers)
+	if err != nil {
+		log.Fatalf("Unable to parse the Icinga API users: %s", err)
+	}
+	icingaAPIUsers = users
+	if futureTimestamps, err = parseFutureTimestamps(srvConf.futureTimestamps); err != nil {
+		log.Fatalf("Unable to parse the future timestamps policy: %s", err)
+	}
+	if timestampClock, err = parseTimestampClock(srvConf.timestampClock); err != nil {
+		log.Fatalf("Unable to parse the timestamp clock: %s", err)
+	}
+	rejectOutOfOrder = srvConf.rejectOutOfOrder
+	maxPacketAge = time.Duration(srvConf.maxPacketAge) * time.Second
+	maxFutureSkew = time.Duration(srvConf.maxFutureSkew) * time.Second
+	statusConfig = configSummary(srvConf)
+
 	// Start the API inside a routine
-	go initAPIServer(srvConf.apiIP, srvConf.apiPort, srvConf.apiCustomFieldRoot, srvConf.apiTemplatesRoot)
+	go initAPIServer(srvConf.apiIP, srvConf.apiPort)
+
+	// Start the Livestatus listener
+	if err := initLivestatus(srvConf.livestatusListen); err != nil {
+		log.Fatalf("Unable to start the Livestatus listener: %s", err)
+	}
+
+	// Start the Zabbix sender listener
+	if err := initZabbix(srvConf.zabbixListen, srvConf.zabbixMapping); err != nil {
+		log.Fatalf("Unable to start the Zabbix listener: %s", err)
+	}
+
+	// Start reading the external commands
+	if err := initCommandFile(srvConf.commandFile); err != nil {
+		log.Fatalf("Unable to read the external command file: %s", err)
+	}
+
+	// Start the listeners of the line protocol
+	lineSecret = srvConf.lineSecret
+	if err := initLineListeners(srvConf.lineListen); err != nil {
+		log.Fatalf("Unable to start the line protocol listeners: %s", err)
+	}
+
+	// Start writing the status.dat file inside a routine
+	go initStatusDat(srvConf.statusDatPath, time.Duration(srvConf.statusDatInterval)*time.Second)
+
+	// Start the admin server inside a routine
+	go initAdminServer(srvConf.adminIP, srvConf.adminPort, srvConf.adminPprof)
 
 	// Start the nsca server
 	nscaCfg := nsca.NewConfig(srvConf.nscaIP, uint16(srvConf.nscaPort), int(srvConf.nscaEncryption), srvConf.nscaPassword, queueData)
-	nsca.StartServer(nscaCfg, false)
+	if err := serveNSCA(nscaCfg); err != nil {
+		log.Fatalf("NSCA server stopped: %s", err)
+	}
 
 }
@@ -48,7 +48,7 @@ func TestCacheWorker(t *testing.T) {
 
 	for _, tt := range testCases {
 		p := &nsca.DataPacket{HostName: tt.host, Service: tt.service, PluginOutput: tt.output, Timestamp: tt.timestamp, State: tt.state}
-		q.Enqueue(p)
+		queueData(p)
 		cacheWorker(false)
 		h, ok := cache[tt.host]
 		if !ok {
@@ -69,3 +69,29 @@ func TestCacheWorker(t *testing.T) {
 		}
 	}
 }
+
+func TestCacheWorkerAcknowledgement(t *testing.T) {
+	initCache()
+	q = lfc.NewQueue()
+	rewriteRules = []*rewriteRule{{Action: "strip_domain", Field: "host", Domain: "example.org"}}
+	defer func() { rewriteRules = nil }()
+
+	// The acknowledgements go through the rewrite rules to reach the entry of
+	// the rewritten result
+	queueData(&nsca.DataPacket{HostName: "host01.example.org", Service: "disk", PluginOutput: "DISK CRITICAL", Timestamp: 1484527962, State: 2})
+	queueAcknowledgement("host01.example.org", "disk", "test")
+	cacheWorker(false)
+	if entry, ok := cache["host01"]["disk"]; !ok || !entry.acknowledged {
+		t.Errorf("Expecting host01/disk to be acknowledged. Got %+v", entry)
+	}
+	if _, ok := cache["host01.example.org"]; ok {
+		t.Error("Expecting the result to be stored under the rewritten host name")
+	}
+
+	// The acknowledgements dropped by the rules are ignored
+	queueAcknowledgement(".example.org", "disk", "test")
+	cacheWorker(false)
+	if q.Len() != 0 {
+		t.Errorf("Expecting the queue to be empty. Contains %d", q.Len())
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsCustomLabels is the allowlist of custom fields exposed as labels of
+// the check metrics
+var metricsCustomLabels []string
+
+// builtinLabels are the labels set by nscapi on the check metrics, including
+// the labels of the performance data metrics, which the custom fields can't
+// override
+var builtinLabels = map[string]bool{"host": true, "service": true, "hostgroup": true, "label": true, "uom": true}
+
+// labelNameRegexp matches the characters not allowed in a Prometheus label name
+var labelNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// metricLabel is a label of a Prometheus sample
+type metricLabel struct {
+	name, value string
+}
+
+// labelValueEscaper escapes the label values as required by the Prometheus text
+// exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric
+func writeMetricHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeMetricSample writes a sample of a metric in the Prometheus text
+// exposition format
+func writeMetricSample(w io.Writer, name string, labels []metricLabel, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, l := range labels {
+			pairs[i] = l.name + `="` + labelValueEscaper.Replace(l.value) + `"`
+		}
+		io.WriteString(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	io.WriteString(w, " "+formatMetricValue(value)+"\n")
+}
+
+// formatMetricValue formats a sample value, including the special values
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sanitizeLabelName turns a custom field name into a valid label name
+func sanitizeLabelName(name string) string {
+	name = labelNameRegexp.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// parseMetricsCustomLabels parses the comma-separated allowlist of custom fields
+// exposed as labels. The fields whose label name, once sanitized, is a built-in
+// label or the label of a previous field are dropped
+func parseMetricsCustomLabels(list string) []string {
+	var fields []string
+	seen := make(map[string]string)
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		name := sanitizeLabelName(field)
+		// The names starting with __ are reserved by Prometheus
+		if builtinLabels[name] || strings.HasPrefix(name, "__") {
+			log.Printf("Ignoring the custom label %s: %s is a built-in label of the check metrics", field, name)
+			continue
+		}
+		if previous, exists := seen[name]; exists {
+			log.Printf("Ignoring the custom label %s: its label name %s is already used by %s", field, name, previous)
+			continue
+		}
+		seen[name] = field
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// checkLabels returns the labels identifying a check in the metrics: host,
+// service, hostgroup and the allowlisted custom fields. Custom fields
+// containing a list are exposed as a comma-separated value
+func checkLabels(host, service string) []metricLabel {
+	return withCustomLabels([]metricLabel{{"host", host}, {"service", service}, {"hostgroup", hostgroupOf(host)}}, cFields.get(host, service))
+}
+
+// hostLabels returns the labels identifying a host in the metrics: host,
+// hostgroup and the allowlisted custom fields of the host
+func hostLabels(host string) []metricLabel {
+	return withCustomLabels([]metricLabel{{"host", host}, {"hostgroup", hostgroupOf(host)}}, cFields.get(host, "all"))
+}
+
+// withCustomLabels appends the allowlisted custom fields to the labels, as
+// validated by parseMetricsCustomLabels
+func withCustomLabels(labels []metricLabel, custom map[string]interface{}) []metricLabel {
+	for _, field := range metricsCustomLabels {
+		labels = append(labels, metricLabel{sanitizeLabelName(field), strings.Join(getStrings(custom, field), ",")})
+	}
+	return labels
+}
+
+// writeCheckMetrics writes the state, age, time in the current state and
+// performance data of every check of the cache, the state and age of the
+// host checks and the clock skew of the hosts
+func writeCheckMetrics(w io.Writer, now time.Time) {
+	// The entries are copied under the cache lock, which is released before
+	// writing the samples
+	type checkSample struct {
+		labels []metricLabel
+		entry  serviceEntry
+	}
+	type skewSample struct {
+		host string
+		mean float64
+	}
+	var samples, hostSamples []checkSample
+	var skewSamples []skewSample
+	cacheLock.RLock()
+	hosts := make([]string, 0, len(cache))
+	for host := range cache {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if entry, ok := hostCache[host]; ok {
+			hostSamples = append(hostSamples, checkSample{hostLabels(host), *entry})
+		}
+		services := make([]string, 0, len(cache[host]))
+		for svc := range cache[host] {
+			services = append(services, svc)
+		}
+		sort.Strings(services)
+		for _, svc := range services {
+			samples = append(samples, checkSample{checkLabels(host, svc), *cache[host][svc]})
+		}
+	}
+	for host, skew := range hostClockSkews {
+		skewSamples = append(skewSamples, skewSample{host, skew.Mean})
+	}
+	cacheLock.RUnlock()
+	sort.Slice(skewSamples, func(i, j int) bool { return skewSamples[i].host < skewSamples[j].host })
+
+	writeMetricHeader(w, "nscapi_check_state", "Current state of the check (0: OK, 1: Warning, 2: Critical, 3: Unknown).", "gauge")
+	for _, s := range samples {
+		writeMetricSample(w, "nscapi_check_state", s.labels, float64(s.entry.state))
+	}
+	writeMetricHeader(w, "nscapi_check_age_seconds", "Time since the last result of the check.", "gauge")
+	for _, s := range samples {
+		writeMetricSample(w, "nscapi_check_age_seconds", s.labels, now.Sub(time.Unix(int64(s.entry.timestamp), 0)).Seconds())
+	}
+	writeMetricHeader(w, "nscapi_check_state_duration_seconds", "Time since the check is in its current state.", "gauge")
+	for _, s := range samples {
+		writeMetricSample(w, "nscapi_check_state_duration_seconds", s.labels, now.Sub(time.Unix(int64(s.entry.statusFirstSeen), 0)).Seconds())
+	}
+
+	writeMetricHeader(w, "nscapi_host_state", "Current state of the host check (0: Up, 1: Down, 2: Unreachable).", "gauge")
+	for _, s := range hostSamples {
+		writeMetricSample(w, "nscapi_host_state", s.labels, float64(s.entry.state))
+	}
+	writeMetricHeader(w, "nscapi_host_age_seconds", "Time since the last result of the host check.", "gauge")
+	for _, s := range hostSamples {
+		writeMetricSample(w, "nscapi_host_age_seconds", s.labels, now.Sub(time.Unix(int64(s.entry.timestamp), 0)).Seconds())
+	}
+	writeMetricHeader(w, "nscapi_host_clock_skew_seconds", "Mean difference between the timestamps of the results of the host and the time nscapi received them.", "gauge")
+	for _, s := range skewSamples {
+		writeMetricSample(w, "nscapi_host_clock_skew_seconds", hostLabels(s.host), s.mean)
+	}
+
+	// Performance data, the missing values being skipped
+	perfdataMetrics := []struct {
+		name, help string
+		value      func(p *perfdataEntry) float64
+	}{
+		{"nscapi_check_perfdata", "Value of the performance data of the check.", func(p *perfdataEntry) float64 { return p.value }},
+		{"nscapi_check_perfdata_warning", "Warning threshold of the performance data of the check.", func(p *perfdataEntry) float64 { return parsePerfdataFloat(p.warn) }},
+		{"nscapi_check_perfdata_critical", "Critical threshold of the performance data of the check.", func(p *perfdataEntry) float64 { return parsePerfdataFloat(p.crit) }},
+		{"nscapi_check_perfdata_min", "Minimum value of the performance data of the check.", func(p *perfdataEntry) float64 { return p.min }},
+		{"nscapi_check_perfdata_max", "Maximum value of the performance data of the check.", func(p *perfdataEntry) float64 { return p.max }},
+	}
+	for _, m := range perfdataMetrics {
+		writeMetricHeader(w, m.name, m.help, "gauge")
+		for _, s := range samples {
+			for i := range s.entry.perfdata {
+				p := &s.entry.perfdata[i]
+				if value := m.value(p); !math.IsNaN(value) {
+					labels := append(append([]metricLabel{}, s.labels...), metricLabel{"label", p.label}, metricLabel{"uom", p.uom})
+					writeMetricSample(w, m.name, labels, value)
+				}
+			}
+		}
+	}
+}
+
+// metricsHandler takes care of the path /metrics that exposes the checks of the
+// cache in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeCheckMetrics(w, time.Now())
+}
+
+// counter is a monotonically increasing metric safe for concurrent use
+type counter struct {
+	v uint64
+}
+
+// inc increments the counter by one
+func (c *counter) inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// value returns the current value of the counter
+func (c *counter) value() float64 {
+	return float64(atomic.LoadUint64(&c.v))
+}
+
+// gauge is a metric that can go up and down, safe for concurrent use
+type gauge struct {
+	bits uint64
+}
+
+// set sets the value of the gauge
+func (g *gauge) set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// value returns the current value of the gauge
+func (g *gauge) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// labeledCounter is a set of counters identified by the value of a label
+type labeledCounter struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// inc increments by one the counter of the given label value
+func (c *labeledCounter) inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[label]++
+}
+
+// declare creates the counters of the given label values so that they are
+// written before their first increment
+func (c *labeledCounter) declare(labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	for _, label := range labels {
+		if _, ok := c.values[label]; !ok {
+			c.values[label] = 0
+		}
+	}
+}
+
+// write writes the samples of the counters sorted by label value
+func (c *labeledCounter) write(w io.Writer, name, labelName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labels := make([]string, 0, len(c.values))
+	for label := range c.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		writeMetricSample(w, name, []metricLabel{{labelName, label}}, float64(c.values[label]))
+	}
+}
+
+// histogram counts the observations in cumulative buckets per value of a label
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+// histogramSeries contains the buckets counts, sum and count of the
+// observations of one label value
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newHistogram creates a histogram with the given upper bounds of its buckets
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// observe adds an observation to the series of the given label value
+func (h *histogram) observe(label string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[label]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[label] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// write writes the buckets, sum and count of every series sorted by label value
+func (h *histogram) write(w io.Writer, name, labelName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	labels := make([]string, 0, len(h.series))
+	for label := range h.series {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		s := h.series[label]
+		for i, bound := range h.buckets {
+			writeMetricSample(w, name+"_bucket", []metricLabel{{labelName, label}, {"le", formatMetricValue(bound)}}, float64(s.counts[i]))
+		}
+		writeMetricSample(w, name+"_bucket", []metricLabel{{labelName, label}, {"le", "+Inf"}}, float64(s.count))
+		writeMetricSample(w, name+"_sum", []metricLabel{{labelName, label}}, s.sum)
+		writeMetricSample(w, name+"_count", []metricLabel{{labelName, label}}, float64(s.count))
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	nsca "github.com/tubemogul/nscatools"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricSample(t *testing.T) {
+	cases := []struct {
+		labels   []metricLabel
+		value    float64
+		expected string
+	}{
+		{nil, 1, "test_metric 1\n"},
+		{[]metricLabel{{"host", "web01"}, {"service", "apache"}}, 2.5, "test_metric{host=\"web01\",service=\"apache\"} 2.5\n"},
+		{[]metricLabel{{"output", "a \"quoted\" \\ multi\nline"}}, 0, "test_metric{output=\"a \\\"quoted\\\" \\\\ multi\\nline\"} 0\n"},
+		{nil, math.NaN(), "test_metric NaN\n"},
+		{nil, math.Inf(1), "test_metric +Inf\n"},
+		{nil, 1484527962, "test_metric 1.484527962e+09\n"},
+	}
+	for _, tt := range cases {
+		var b bytes.Buffer
+		writeMetricSample(&b, "test_metric", tt.labels, tt.value)
+		if b.String() != tt.expected {
+			t.Errorf("Expecting sample %q. Got %q", tt.expected, b.String())
+		}
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	cases := []struct{ in, out string }{{"team", "team"}, {"alert-group", "alert_group"}, {"1st", "_1st"}, {"", "_"}}
+	for _, tt := range cases {
+		if returned := sanitizeLabelName(tt.in); returned != tt.out {
+			t.Errorf("sanitizeLabelName(%s) should return %s, not %s", tt.in, tt.out, returned)
+		}
+	}
+}
+
+func TestParseMetricsCustomLabels(t *testing.T) {
+	if fields := parseMetricsCustomLabels(" team, alertGroup,,"); !reflect.DeepEqual(fields, []string{"team", "alertGroup"}) {
+		t.Errorf("Wrong custom labels parsed: %v", fields)
+	}
+	if fields := parseMetricsCustomLabels(""); fields != nil {
+		t.Errorf("Expecting no custom labels. Got %v", fields)
+	}
+
+	// The built-in labels and the fields sharing the label name of a previous
+	// field once sanitized are dropped
+	if fields := parseMetricsCustomLabels("team-name,host,hostgroup,team_name,service,team.name,label,uom,__name__,owner"); !reflect.DeepEqual(fields, []string{"team-name", "owner"}) {
+		t.Errorf("Wrong custom labels parsed: %v", fields)
+	}
+}
+
+func TestWriteCheckMetrics(t *testing.T) {
+	initCache()
+	cFields.load("testData/customFields")
+	metricsCustomLabels = parseMetricsCustomLabels("team,alertGroup,host,uom")
+	defer func() {
+		cFields = customFields{}
+		metricsCustomLabels = nil
+	}()
+	updateCacheEntry("web01", "apache", "Connection refused", 1484527900, 2)
+	updateCacheEntry("web01", "apache", "Connection refused|time=0.5s;1;@2:3;0 size=U;;;0;100", 1484527950, 2)
+	updateCacheEntry("db01", "disk", "OK", 1484527960, 0)
+	updateCacheEntry("db01", "", "PING CRITICAL - 100% loss", 1484527961, 1)
+	recordClockSkew(&nsca.DataPacket{HostName: "db01", Timestamp: 1484527961}, time.Unix(1484527958, 0))
+
+	var b bytes.Buffer
+	writeCheckMetrics(&b, time.Unix(1484527962, 0))
+	expected := `# HELP nscapi_check_state Current state of the check (0: OK, 1: Warning, 2: Critical, 3: Unknown).
+# TYPE nscapi_check_state gauge
+nscapi_check_state{host="db01",service="disk",hostgroup="db",team="dba,ops",alertGroup=""} 0
+nscapi_check_state{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup=""} 2
+# HELP nscapi_check_age_seconds Time since the last result of the check.
+# TYPE nscapi_check_age_seconds gauge
+nscapi_check_age_seconds{host="db01",service="disk",hostgroup="db",team="dba,ops",alertGroup=""} 2
+nscapi_check_age_seconds{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup=""} 12
+# HELP nscapi_check_state_duration_seconds Time since the check is in its current state.
+# TYPE nscapi_check_state_duration_seconds gauge
+nscapi_check_state_duration_seconds{host="db01",service="disk",hostgroup="db",team="dba,ops",alertGroup=""} 2
+nscapi_check_state_duration_seconds{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup=""} 62
+# HELP nscapi_host_state Current state of the host check (0: Up, 1: Down, 2: Unreachable).
+# TYPE nscapi_host_state gauge
+nscapi_host_state{host="db01",hostgroup="db",team="dba,ops",alertGroup=""} 1
+# HELP nscapi_host_age_seconds Time since the last result of the host check.
+# TYPE nscapi_host_age_seconds gauge
+nscapi_host_age_seconds{host="db01",hostgroup="db",team="dba,ops",alertGroup=""} 1
+# HELP nscapi_host_clock_skew_seconds Mean difference between the timestamps of the results of the host and the time nscapi received them.
+# TYPE nscapi_host_clock_skew_seconds gauge
+nscapi_host_clock_skew_seconds{host="db01",hostgroup="db",team="dba,ops",alertGroup=""} 3
+# HELP nscapi_check_perfdata Value of the performance data of the check.
+# TYPE nscapi_check_perfdata gauge
+nscapi_check_perfdata{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup="",label="time",uom="s"} 0.5
+# HELP nscapi_check_perfdata_warning Warning threshold of the performance data of the check.
+# TYPE nscapi_check_perfdata_warning gauge
+nscapi_check_perfdata_warning{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup="",label="time",uom="s"} 1
+# HELP nscapi_check_perfdata_critical Critical threshold of the performance data of the check.
+# TYPE nscapi_check_perfdata_critical gauge
+# HELP nscapi_check_perfdata_min Minimum value of the performance data of the check.
+# TYPE nscapi_check_perfdata_min gauge
+nscapi_check_perfdata_min{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup="",label="time",uom="s"} 0
+nscapi_check_perfdata_min{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup="",label="size",uom=""} 0
+# HELP nscapi_check_perfdata_max Maximum value of the performance data of the check.
+# TYPE nscapi_check_perfdata_max gauge
+nscapi_check_perfdata_max{host="web01",service="apache",hostgroup="web",team="webdev",alertGroup="",label="size",uom=""} 100
+`
+	if b.String() != expected {
+		t.Errorf("Wrong metrics. Expecting:\n%s\nGot:\n%s", expected, b.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	initCache()
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Wrong content type: %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), `nscapi_check_state{host="web01",service="apache",hostgroup="web"} 0`) {
+		t.Errorf("Missing check state in the metrics:\n%s", w.Body.String())
+	}
+}
+
+func TestCounterAndGauge(t *testing.T) {
+	var c counter
+	c.inc()
+	c.inc()
+	if c.value() != 2 {
+		t.Errorf("Expecting the counter to be 2. Got %v", c.value())
+	}
+	var g gauge
+	g.set(1.5)
+	g.set(0.25)
+	if g.value() != 0.25 {
+		t.Errorf("Expecting the gauge to be 0.25. Got %v", g.value())
+	}
+}
+
+func TestLabeledCounter(t *testing.T) {
+	var c labeledCounter
+	c.inc("routing")
+	c.inc("email")
+	c.inc("routing")
+	c.declare("chat", "email")
+	var b bytes.Buffer
+	c.write(&b, "test_total", "queue")
+	expected := "test_total{queue=\"chat\"} 0\ntest_total{queue=\"email\"} 1\ntest_total{queue=\"routing\"} 2\n"
+	if b.String() != expected {
+		t.Errorf("Expecting:\n%s\nGot:\n%s", expected, b.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe("/api/reports", 0.05)
+	h.observe("/api/reports", 0.5)
+	h.observe("/api/reports", 2)
+	var b bytes.Buffer
+	h.write(&b, "test_seconds", "path")
+	expected := `test_seconds_bucket{path="/api/reports",le="0.1"} 1
+test_seconds_bucket{path="/api/reports",le="1"} 2
+test_seconds_bucket{path="/api/reports",le="+Inf"} 3
+test_seconds_sum{path="/api/reports"} 2.55
+test_seconds_count{path="/api/reports"} 3
+`
+	if b.String() != expected {
+		t.Errorf("Expecting:\n%s\nGot:\n%s", expected, b.String())
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// notificationQueue is where the cache worker puts the state changes it sees.
+// It stays nil when the notifications are not enabled
+var notificationQueue chan *notification
+
+// notificationQueueSize is the number of state changes that can be waiting to
+// be dispatched before new ones get dropped
+const notificationQueueSize = 4096
+
+// notification describes a state change of a check as seen by the cache
+type notification struct {
+	host            string
+	service         string
+	hostgroup       string
+	state           int16
+	previousState   int16
+	output          string
+	longOutput      string
+	timestamp       uint32
+	statusFirstSeen uint32
+	// custom contains the custom fields resolved for this host and service
+	custom map[string]interface{}
+}
+
+// notifier is implemented by all the notification sinks. enqueue is called by
+// the dispatcher for each state change and must not block. run is started in
+// its own routine and takes care of actually sending the notifications
+type notifier interface {
+	enqueue(n *notification)
+	run()
+}
+
+// notificationsConfig is the content of the notifications configuration file.
+// The chat and email sections define sinks receiving all the state changes
+// while the route section defines the routing tree sending the state changes
+// to the receivers
+type notificationsConfig struct {
+	Chat      *chatConfig       `yaml:"chat"`
+	Email     *emailConfig      `yaml:"email"`
+	Route     *routeConfig      `yaml:"route"`
+	Receivers []*receiverConfig `yaml:"receivers"`
+	// Timeperiods are referenced by the custom field named by
+	// NotificationPeriodField (default to "notificationPeriod") to restrict when
+	// the checks are notified
+	Timeperiods             map[string]*timeperiodConfig `yaml:"timeperiods"`
+	NotificationPeriodField string                       `yaml:"notificationPeriodField"`
+}
+
+// loadNotificationsConfig reads the yaml notifications configuration file
+func loadNotificationsConfig(path string) (*notificationsConfig, error) {
+	conf := &notificationsConfig{}
+	fc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	err = yaml.Unmarshal(fc, conf)
+	return conf, err
+}
+
+// initNotifications loads the notifications configuration and starts the
+// notification sinks and the routine dispatching the state changes to them.
+// Notifications are disabled when no configuration file is given
+func initNotifications(configPath string) error {
+	if configPath == "" {
+		return nil
+	}
+	conf, err := loadNotificationsConfig(configPath)
+	if err != nil {
+		return err
+	}
+	periods, err := newPeriodFilter(conf.Timeperiods, conf.NotificationPeriodField)
+	if err != nil {
+		return err
+	}
+	var sinks []notifier
+	if conf.Chat != nil {
+		sinks = append(sinks, newChatNotifier(conf.Chat))
+	}
+	if conf.Email != nil {
+		email := newEmailNotifier(conf.Email)
+		email.periods = periods
+		sinks = append(sinks, email)
+	}
+	if conf.Route != nil {
+		r, err := newRouter(conf.Route, conf.Receivers)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, r)
+	}
+	for _, sink := range sinks {
+		go sink.run()
+	}
+	notificationQueue = make(chan *notification, notificationQueueSize)
+	go dispatchNotifications(notificationQueue, sinks, periods)
+	return nil
+}
+
+// dispatchNotifications resolves the custom fields of each state change coming
+// from the queue and hands it over to all the sinks when it is inside the
+// notification period of its check. Every minute, the state changes queued
+// outside of their notification period are released if the period started
+func dispatchNotifications(queue <-chan *notification, sinks []notifier, periods *periodFilter) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case n, ok := <-queue:
+			if !ok {
+				return
+			}
+			n.custom = cFields.get(n.host, n.service)
+			if periods.allow(n, time.Now()) {
+				dispatchToSinks(n, sinks)
+			}
+		case now := <-ticker.C:
+			for _, n := range periods.release(now) {
+				dispatchToSinks(n, sinks)
+			}
+		}
+	}
+}
+
+// dispatchToSinks hands a state change over to all the sinks
+func dispatchToSinks(n *notification, sinks []notifier) {
+	for _, sink := range sinks {
+		sink.enqueue(n)
+	}
+}
+
+// queueNotification puts the state change of a check in the notification
+// queue. It never blocks the cache worker: the state change is dropped if the
+// queue is full
+func queueNotification(hostname, servicename string, entry *serviceEntry, previousState int16) {
+	if notificationQueue == nil {
+		return
+	}
+	n := &notification{
+		host:            hostname,
+		service:         servicename,
+		hostgroup:       hostgroupOf(hostname),
+		state:           entry.state,
+		previousState:   previousState,
+		output:          entry.shortOutput,
+		longOutput:      entry.longOutput,
+		timestamp:       entry.timestamp,
+		statusFirstSeen: entry.statusFirstSeen,
+	}
+	select {
+	case notificationQueue <- n:
+	default:
+		queueDrops.inc("notifications")
+		log.Printf("Notification queue full, dropping state change of %s", checkName(hostname, servicename))
+	}
+}
+
+// stateDuration returns for how long the check has been in its current state,
+// rounded to the second
+func stateDuration(statusFirstSeen uint32) time.Duration {
+	d := time.Since(time.Unix(int64(statusFirstSeen), 0))
+	if d < 0 {
+		return 0
+	}
+	return d - d%time.Second
+}
+
+// notificationSummary returns a one-line description of a state change such as
+// "CRITICAL web01/apache for 5m0s"
+func notificationSummary(n *notification) string {
+	return fmt.Sprintf("%s %s for %s", strings.ToUpper(checkStatusString(n.service, n.state)), checkName(n.host, n.service), stateDuration(n.statusFirstSeen))
+}
+
+// notificationTemplateData returns the data describing a state change as used
+// by the notification templates
+func notificationTemplateData(n *notification) map[string]interface{} {
+	return map[string]interface{}{
+		"host":            n.host,
+		"service":         n.service,
+		"check":           checkName(n.host, n.service),
+		"hostgroup":       n.hostgroup,
+		"status":          checkStatusString(n.service, n.state),
+		"previousStatus":  checkStatusString(n.service, n.previousState),
+		"output":          n.output,
+		"longOutput":      n.longOutput,
+		"timestamp":       n.timestamp,
+		"statusFirstSeen": n.statusFirstSeen,
+		"duration":        stateDuration(n.statusFirstSeen).String(),
+		"custom":          n.custom,
+	}
+}
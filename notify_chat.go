@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatConfig is the configuration of the Slack/Mattermost notification sink.
+// Both use the same incoming webhook payload format
+type chatConfig struct {
+	// Teams maps a team name to the incoming webhook URL of its channel
+	Teams map[string]string `yaml:"teams"`
+	// DefaultWebhook is used for the checks not matching any of the teams
+	DefaultWebhook string `yaml:"defaultWebhook"`
+	// TeamField is the custom field containing the team(s) owning the check.
+	// Default to "team"
+	TeamField string `yaml:"teamField"`
+	// Username overrides the name the messages are posted as
+	Username string `yaml:"username"`
+	// GroupWindow is the time the state changes are accumulated before being
+	// sent. Default to 30s
+	GroupWindow time.Duration `yaml:"groupWindow"`
+	// MaxMessages is the maximum number of messages sent to a webhook per group
+	// window. The remaining state changes are summarised in one last message.
+	// Default to 10
+	MaxMessages int `yaml:"maxMessagesPerWindow"`
+}
+
+// chatNotifier accumulates the state changes per webhook during the group
+// window and sends them grouped by hostgroup, service and state
+type chatNotifier struct {
+	conf    *chatConfig
+	client  *http.Client
+	mu      sync.Mutex
+	pending map[string][]*notification
+}
+
+// chatGroupKey identifies the state changes that get merged in one message
+type chatGroupKey struct {
+	hostgroup, service string
+	state              int16
+}
+
+// newChatNotifier creates a chat notification sink, applying the defaults to
+// the configuration
+func newChatNotifier(conf *chatConfig) *chatNotifier {
+	if conf.TeamField == "" {
+		conf.TeamField = "team"
+	}
+	if conf.GroupWindow <= 0 {
+		conf.GroupWindow = 30 * time.Second
+	}
+	if conf.MaxMessages <= 0 {
+		conf.MaxMessages = 10
+	}
+	return &chatNotifier{
+		conf:    conf,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string][]*notification),
+	}
+}
+
+// webhooksFor returns the webhooks the given state change should be sent to
+// based on the teams found in its custom fields
+func (c *chatNotifier) webhooksFor(n *notification) []string {
+	var hooks []string
+	seen := make(map[string]bool)
+	for _, team := range getStrings(n.custom, c.conf.TeamField) {
+		if hook, ok := c.conf.Teams[team]; ok && !seen[hook] {
+			hooks = append(hooks, hook)
+			seen[hook] = true
+		}
+	}
+	if len(hooks) == 0 && c.conf.DefaultWebhook != "" {
+		hooks = append(hooks, c.conf.DefaultWebhook)
+	}
+	return hooks
+}
+
+// enqueue adds the state change to the pending ones of its webhooks
+func (c *chatNotifier) enqueue(n *notification) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, hook := range c.webhooksFor(n) {
+		c.pending[hook] = append(c.pending[hook], n)
+	}
+}
+
+// run flushes the pending state changes at every group window
+func (c *chatNotifier) run() {
+	for range time.Tick(c.conf.GroupWindow) {
+		c.flush()
+	}
+}
+
+// flush sends all the pending state changes
+func (c *chatNotifier) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string][]*notification)
+	c.mu.Unlock()
+
+	for hook, notifs := range pending {
+		if err := c.postAll(hook, notifs); err != nil {
+			log.Printf("Unable to send chat notification: %s", err)
+		}
+	}
+}
+
+// send immediately posts a group of state changes to their webhooks. It is
+// used when the chat sink is a receiver of the routing tree
+func (c *chatNotifier) send(notifs []*notification) error {
+	perHook := make(map[string][]*notification)
+	for _, n := range notifs {
+		for _, hook := range c.webhooksFor(n) {
+			perHook[hook] = append(perHook[hook], n)
+		}
+	}
+	var err error
+	for hook, hookNotifs := range perHook {
+		if e := c.postAll(hook, hookNotifs); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// postAll posts the messages of the given state changes to a webhook,
+// returning the last error encountered
+func (c *chatNotifier) postAll(hook string, notifs []*notification) error {
+	var err error
+	for _, msg := range chatMessages(notifs, c.conf.MaxMessages) {
+		if e := c.post(hook, msg); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// post sends a message to an incoming webhook
+func (c *chatNotifier) post(hook, text string) error {
+	payload := map[string]string{"text": text}
+	if c.conf.Username != "" {
+		payload["username"] = c.conf.Username
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(hook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// chatMessages groups the state changes having the same hostgroup, service and
+// state in one message each, keeping the order in which they were received.
+// Above maxMessages groups, the remaining ones are summarised in a last message
+func chatMessages(notifs []*notification, maxMessages int) []string {
+	var keys []chatGroupKey
+	groups := make(map[chatGroupKey][]*notification)
+	for _, n := range notifs {
+		key := chatGroupKey{n.hostgroup, n.service, n.state}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], n)
+	}
+
+	var msgs []string
+	for i, key := range keys {
+		if i == maxMessages-1 && len(keys) > maxMessages {
+			msgs = append(msgs, chatOverflowMessage(keys[i:], groups))
+			break
+		}
+		msgs = append(msgs, chatGroupMessage(groups[key]))
+	}
+	return msgs
+}
+
+// chatGroupMessage formats the message of a group of state changes on the same
+// service and hostgroup
+func chatGroupMessage(notifs []*notification) string {
+	n := notifs[0]
+	var msg string
+	if len(notifs) == 1 {
+		msg = fmt.Sprintf("*%s*\n> %s", notificationSummary(n), n.output)
+	} else {
+		hosts := make([]string, len(notifs))
+		for i, hn := range notifs {
+			hosts[i] = hn.host
+		}
+		what := strings.ToUpper(checkStatusString(n.service, n.state))
+		if n.service != "" {
+			what += " " + n.service
+		}
+		msg = fmt.Sprintf("*%s on %d hosts of %s*: %s\n> %s", what, len(notifs), n.hostgroup, strings.Join(hosts, ", "), n.output)
+	}
+	if runbook := getStrings(n.custom, "runbook"); len(runbook) > 0 {
+		msg += "\nRunbook: " + runbook[0]
+	}
+	return msg
+}
+
+// chatOverflowMessage summarises the groups of state changes that could not be
+// sent individually
+func chatOverflowMessage(keys []chatGroupKey, groups map[chatGroupKey][]*notification) string {
+	var states, hostStates [4]int
+	total := 0
+	for _, key := range keys {
+		state := key.state
+		if state < 0 || state > 3 {
+			state = 3
+		}
+		if key.service == "" {
+			hostStates[hostState(state)] += len(groups[key])
+		} else {
+			states[state] += len(groups[key])
+		}
+		total += len(groups[key])
+	}
+	var counts []string
+	for state := int16(0); state <= 3; state++ {
+		if states[state] > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", states[state], statusString(state)))
+		}
+	}
+	for state := int16(0); state <= 2; state++ {
+		if hostStates[state] > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", hostStates[state], hostStatusString(state)))
+		}
+	}
+	return fmt.Sprintf("*%d more state changes on %d checks*: %s", total, len(keys), strings.Join(counts, ", "))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestChatWebhooksFor(t *testing.T) {
+	c := newChatNotifier(&chatConfig{
+		Teams:          map[string]string{"dba": "http://dba", "ops": "http://ops", "sre": "http://ops"},
+		DefaultWebhook: "http://default",
+	})
+	cases := []struct {
+		custom   map[string]interface{}
+		expected []string
+	}{
+		{map[string]interface{}{"team": []interface{}{"dba", "ops"}}, []string{"http://dba", "http://ops"}},
+		{map[string]interface{}{"team": "dba"}, []string{"http://dba"}},
+		// Two teams sharing the same channel get only one message
+		{map[string]interface{}{"team": []interface{}{"ops", "sre"}}, []string{"http://ops"}},
+		{map[string]interface{}{"team": []interface{}{"webdev"}}, []string{"http://default"}},
+		{map[string]interface{}{}, []string{"http://default"}},
+	}
+	for _, tt := range cases {
+		if hooks := c.webhooksFor(&notification{custom: tt.custom}); !reflect.DeepEqual(hooks, tt.expected) {
+			t.Errorf("webhooksFor %v should return %v, not %v", tt.custom, tt.expected, hooks)
+		}
+	}
+}
+
+func TestChatMessages(t *testing.T) {
+	custom := map[string]interface{}{"runbook": "https://wiki.example.org/apache.html"}
+	notifs := []*notification{
+		{host: "web01", hostgroup: "web", service: "apache", state: 2, output: "Connection refused", custom: custom},
+		{host: "db01", hostgroup: "db", service: "disk", state: 1, output: "Disk 85% full"},
+		{host: "web02", hostgroup: "web", service: "apache", state: 2, output: "Connection refused", custom: custom},
+		{host: "web03", hostgroup: "web", service: "apache", state: 2, output: "Connection refused", custom: custom},
+	}
+	msgs := chatMessages(notifs, 10)
+	if len(msgs) != 2 {
+		t.Fatalf("Expecting 2 messages. Got %d: %v", len(msgs), msgs)
+	}
+	if !strings.HasPrefix(msgs[0], "*CRITICAL apache on 3 hosts of web*: web01, web02, web03\n> Connection refused") {
+		t.Errorf("Wrong grouped message: %s", msgs[0])
+	}
+	if !strings.HasSuffix(msgs[0], "\nRunbook: https://wiki.example.org/apache.html") {
+		t.Errorf("Missing runbook in message: %s", msgs[0])
+	}
+	if !strings.HasPrefix(msgs[1], "*WARNING db01/disk for ") || !strings.HasSuffix(msgs[1], "\n> Disk 85% full") {
+		t.Errorf("Wrong single message: %s", msgs[1])
+	}
+
+	// Host checks
+	hosts := []*notification{
+		{host: "web01", hostgroup: "web", state: 1, output: "PING CRITICAL"},
+		{host: "web02", hostgroup: "web", state: 1, output: "PING CRITICAL"},
+		{host: "db01", hostgroup: "db", state: 2, output: "Gateway down"},
+	}
+	msgs = chatMessages(hosts, 10)
+	if len(msgs) != 2 || !strings.HasPrefix(msgs[0], "*DOWN on 2 hosts of web*: web01, web02\n> PING CRITICAL") || !strings.HasPrefix(msgs[1], "*UNREACHABLE db01 for ") {
+		t.Errorf("Wrong host messages: %v", msgs)
+	}
+
+	// Rate limiting
+	notifs = append(notifs, &notification{host: "db01", hostgroup: "db", service: "load", state: 0})
+	notifs = append(notifs, &notification{host: "db02", hostgroup: "db", state: 1})
+	msgs = chatMessages(notifs, 2)
+	if len(msgs) != 2 {
+		t.Fatalf("Expecting 2 messages. Got %d: %v", len(msgs), msgs)
+	}
+	if msgs[1] != "*3 more state changes on 3 checks*: 1 OK, 1 Warning, 1 Down" {
+		t.Errorf("Wrong overflow message: %s", msgs[1])
+	}
+}
+
+func TestChatFlush(t *testing.T) {
+	var received []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, payload)
+	}))
+	defer srv.Close()
+
+	c := newChatNotifier(&chatConfig{Teams: map[string]string{"ops": srv.URL}, Username: "nscapi"})
+	c.enqueue(&notification{host: "web01", hostgroup: "web", service: "apache", state: 2, custom: map[string]interface{}{"team": []interface{}{"ops"}}})
+	// Not matching any webhook
+	c.enqueue(&notification{host: "db01", hostgroup: "db", service: "disk", state: 2})
+	c.flush()
+	if len(received) != 1 {
+		t.Fatalf("Expecting 1 message to be posted. Got %d", len(received))
+	}
+	if received[0]["username"] != "nscapi" || !strings.HasPrefix(received[0]["text"], "*CRITICAL web01/apache") {
+		t.Errorf("Wrong payload posted: %v", received[0])
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("Pending notifications should be empty after a flush")
+	}
+
+	c.conf.Teams["ops"] = srv.URL + "/nonExisting"
+	srv.Config.Handler = http.NotFoundHandler()
+	if err := c.post(c.conf.Teams["ops"], "test"); err == nil {
+		t.Errorf("post should fail on a non-2xx response")
+	}
+}
+
+func TestChatSend(t *testing.T) {
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	c := newChatNotifier(&chatConfig{Teams: map[string]string{"ops": srv.URL + "/ops", "dba": srv.URL + "/dba"}})
+	err := c.send([]*notification{
+		{host: "db01", hostgroup: "db", service: "disk", state: 2, custom: map[string]interface{}{"team": []interface{}{"dba", "ops"}}},
+		{host: "db02", hostgroup: "db", service: "disk", state: 2, custom: map[string]interface{}{"team": []interface{}{"dba", "ops"}}},
+	})
+	if err != nil {
+		t.Fatalf("send returned: %s", err)
+	}
+	sort.Strings(received)
+	if !reflect.DeepEqual(received, []string{"/dba", "/ops"}) {
+		t.Errorf("Expecting one grouped message per team. Got %v", received)
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("send should not keep any pending notification")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// emailConfig is the configuration of the SMTP notification sink
+type emailConfig struct {
+	Host string `yaml:"host"`
+	// Port of the SMTP server. Default to 25
+	Port uint16 `yaml:"port"`
+	From string `yaml:"from"`
+	// Username and Password enable the PLAIN authentication when set
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// StartTLS makes the STARTTLS extension mandatory. Without it, STARTTLS is
+	// only used when the server supports it
+	StartTLS           bool `yaml:"startTLS"`
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	// Mode is either "transition" to send one email per state change or
+	// "digest" to periodically send a summary of the current problems. Default
+	// to "transition"
+	Mode string `yaml:"mode"`
+	// DigestInterval is the time between 2 digests. Default to 1h
+	DigestInterval time.Duration `yaml:"digestInterval"`
+	// TeamField is the custom field containing the team(s) owning the check.
+	// Default to "team"
+	TeamField string `yaml:"teamField"`
+	// EmailField is the custom field containing explicit recipients of the
+	// check. Default to "notifyEmail"
+	EmailField string `yaml:"emailField"`
+	// Teams maps a team name to its email addresses
+	Teams map[string][]string `yaml:"teams"`
+	// DefaultRecipients are used for the checks without any recipient
+	DefaultRecipients []string `yaml:"defaultRecipients"`
+}
+
+// Name of the templates, looked for in the templates root, used to render the
+// emails. Each of them must define a "subject" and a "body" template
+const (
+	emailTransitionTemplate = "email_transition.tmpl"
+	emailDigestTemplate     = "email_digest.tmpl"
+)
+
+// emailNotifier sends the emails either on each state change or as a digest
+type emailNotifier struct {
+	conf  *emailConfig
+	queue chan *notification
+	// periods filters the problems of the digests, which don't go through
+	// dispatchNotifications. Nil when the sink is a receiver of the routing
+	// tree
+	periods *periodFilter
+}
+
+// newEmailNotifier creates an email notification sink, applying the defaults
+// to the configuration
+func newEmailNotifier(conf *emailConfig) *emailNotifier {
+	if conf.Port == 0 {
+		conf.Port = 25
+	}
+	if conf.Mode == "" {
+		conf.Mode = "transition"
+	}
+	if conf.DigestInterval <= 0 {
+		conf.DigestInterval = time.Hour
+	}
+	if conf.TeamField == "" {
+		conf.TeamField = "team"
+	}
+	if conf.EmailField == "" {
+		conf.EmailField = "notifyEmail"
+	}
+	return &emailNotifier{conf: conf, queue: make(chan *notification, notificationQueueSize)}
+}
+
+// recipientsFor returns the email addresses of the teams of the check and its
+// explicit recipients
+func (e *emailNotifier) recipientsFor(custom map[string]interface{}) []string {
+	var rcpts []string
+	seen := make(map[string]bool)
+	add := func(addrs ...string) {
+		for _, addr := range addrs {
+			if !seen[addr] {
+				rcpts = append(rcpts, addr)
+				seen[addr] = true
+			}
+		}
+	}
+	for _, team := range getStrings(custom, e.conf.TeamField) {
+		add(e.conf.Teams[team]...)
+	}
+	add(getStrings(custom, e.conf.EmailField)...)
+	if len(rcpts) == 0 {
+		add(e.conf.DefaultRecipients...)
+	}
+	return rcpts
+}
+
+// enqueue keeps the state change to be sent by the run routine. State changes
+// are ignored in digest mode as the digest is built from the cache
+func (e *emailNotifier) enqueue(n *notification) {
+	if e.conf.Mode == "digest" {
+		return
+	}
+	select {
+	case e.queue <- n:
+	default:
+		queueDrops.inc("email")
+		log.Printf("Email queue full, dropping notification of %s", checkName(n.host, n.service))
+	}
+}
+
+// run sends the emails as they come in transition mode or at every digest
+// interval in digest mode
+func (e *emailNotifier) run() {
+	if e.conf.Mode == "digest" {
+		for now := range time.Tick(e.conf.DigestInterval) {
+			e.sendDigests(e.digestProblems(cacheProblems(), now))
+		}
+		return
+	}
+	for n := range e.queue {
+		if err := e.sendTransition(n); err != nil {
+			log.Printf("Unable to send email notification of %s: %s", checkName(n.host, n.service), err)
+		}
+	}
+}
+
+// sendTransition sends the email of a single state change
+func (e *emailNotifier) sendTransition(n *notification) error {
+	rcpts := e.recipientsFor(n.custom)
+	if len(rcpts) == 0 {
+		return nil
+	}
+	subject, body, err := renderEmail(emailTransitionTemplate, notificationTemplateData(n))
+	if err != nil {
+		return err
+	}
+	return e.sendMail(rcpts, subject, body)
+}
+
+// digestProblems keeps the problems inside the notification period of their
+// check, like the state changes notified in transition mode
+func (e *emailNotifier) digestProblems(problems []*notification, now time.Time) []*notification {
+	if e.periods == nil {
+		return problems
+	}
+	var kept []*notification
+	for _, p := range problems {
+		if p.custom == nil {
+			p.custom = cFields.get(p.host, p.service)
+		}
+		if e.periods.inPeriod(p, now) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// digestsByRecipient groups the problems per recipient, sorted by host and
+// service
+func (e *emailNotifier) digestsByRecipient(problems []*notification) map[string][]*notification {
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].host != problems[j].host {
+			return problems[i].host < problems[j].host
+		}
+		return problems[i].service < problems[j].service
+	})
+	digests := make(map[string][]*notification)
+	for _, p := range problems {
+		if p.custom == nil {
+			p.custom = cFields.get(p.host, p.service)
+		}
+		for _, rcpt := range e.recipientsFor(p.custom) {
+			digests[rcpt] = append(digests[rcpt], p)
+		}
+	}
+	return digests
+}
+
+// sendDigests sends to each recipient the summary of its current problems
+func (e *emailNotifier) sendDigests(problems []*notification) {
+	for rcpt, probs := range e.digestsByRecipient(problems) {
+		if err := e.sendDigest(rcpt, probs); err != nil {
+			log.Printf("Unable to send email digest to %s: %s", rcpt, err)
+		}
+	}
+}
+
+// sendDigest renders the digest template for the given checks and sends it to
+// a recipient
+func (e *emailNotifier) sendDigest(rcpt string, checks []*notification) error {
+	problems := make([]map[string]interface{}, len(checks))
+	for i, chk := range checks {
+		problems[i] = notificationTemplateData(chk)
+	}
+	subject, body, err := renderEmail(emailDigestTemplate, map[string]interface{}{"recipient": rcpt, "problems": problems})
+	if err != nil {
+		return err
+	}
+	return e.sendMail([]string{rcpt}, subject, body)
+}
+
+// send immediately emails a group of state changes to their recipients. It is
+// used when the email sink is a receiver of the routing tree: a recipient gets
+// the transition email when the group contains a single state change for this
+// recipient and a digest of the group otherwise
+func (e *emailNotifier) send(notifs []*notification) error {
+	var err error
+	for rcpt, checks := range e.digestsByRecipient(notifs) {
+		var sendErr error
+		if len(checks) == 1 {
+			var subject, body string
+			subject, body, sendErr = renderEmail(emailTransitionTemplate, notificationTemplateData(checks[0]))
+			if sendErr == nil {
+				sendErr = e.sendMail([]string{rcpt}, subject, body)
+			}
+		} else {
+			sendErr = e.sendDigest(rcpt, checks)
+		}
+		if sendErr != nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// renderEmail executes the "subject" and "body" templates of the given
+// template file
+func renderEmail(tmplName string, data interface{}) (string, string, error) {
+	t, err := template.ParseFiles(filepath.Join(tmplRoot, tmplName))
+	if err != nil {
+		return "", "", err
+	}
+	var subject, body bytes.Buffer
+	if err = t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", "", err
+	}
+	if err = t.ExecuteTemplate(&body, "body", data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
+
+// sendMail delivers an email to the SMTP server
+func (e *emailNotifier) sendMail(rcpts []string, subject, body string) error {
+	c, err := smtp.Dial(net.JoinHostPort(e.conf.Host, fmt.Sprint(e.conf.Port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: e.conf.Host, InsecureSkipVerify: e.conf.InsecureSkipVerify}); err != nil {
+			return err
+		}
+	} else if e.conf.StartTLS {
+		return fmt.Errorf("%s does not support STARTTLS", e.conf.Host)
+	}
+	if e.conf.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", e.conf.Username, e.conf.Password, e.conf.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(e.conf.From); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(formatEmail(e.conf.From, rcpts, subject, body)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// formatEmail builds the raw email with its headers. The line endings of the
+// body are normalized to CRLF
+func formatEmail(from string, rcpts []string, subject, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerValue(strings.Join(rcpts, ", ")))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(body)
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return msg.Bytes()
+}
+
+// headerValue replaces the control characters of a header value, CR and LF
+// included, by spaces so that the host and service names, the outputs and the
+// custom fields cannot inject headers
+func headerValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, value)
+}
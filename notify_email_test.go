@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailRecipientsFor(t *testing.T) {
+	e := newEmailNotifier(&emailConfig{
+		Teams:             map[string][]string{"dba": {"dba@example.org"}, "ops": {"ops@example.org", "oncall@example.org"}},
+		DefaultRecipients: []string{"admin@example.org"},
+	})
+	cases := []struct {
+		custom   map[string]interface{}
+		expected []string
+	}{
+		{map[string]interface{}{"team": []interface{}{"dba", "ops"}}, []string{"dba@example.org", "ops@example.org", "oncall@example.org"}},
+		{map[string]interface{}{"team": "dba", "notifyEmail": []interface{}{"john@example.org", "dba@example.org"}}, []string{"dba@example.org", "john@example.org"}},
+		{map[string]interface{}{"notifyEmail": "john@example.org"}, []string{"john@example.org"}},
+		{map[string]interface{}{"team": "webdev"}, []string{"admin@example.org"}},
+	}
+	for _, tt := range cases {
+		if rcpts := e.recipientsFor(tt.custom); !reflect.DeepEqual(rcpts, tt.expected) {
+			t.Errorf("recipientsFor %v should return %v, not %v", tt.custom, tt.expected, rcpts)
+		}
+	}
+}
+
+func TestDigestsByRecipient(t *testing.T) {
+	e := newEmailNotifier(&emailConfig{Mode: "digest", Teams: map[string][]string{"dba": {"dba@example.org"}, "ops": {"ops@example.org"}}})
+	problems := []*notification{
+		{host: "web01", service: "apache", state: 2, custom: map[string]interface{}{"team": "ops"}},
+		{host: "db01", service: "disk", state: 1, custom: map[string]interface{}{"team": []interface{}{"dba", "ops"}}},
+	}
+	digests := e.digestsByRecipient(problems)
+	if len(digests) != 2 {
+		t.Fatalf("Expecting 2 digests. Got %d", len(digests))
+	}
+	if len(digests["dba@example.org"]) != 1 || digests["dba@example.org"][0].host != "db01" {
+		t.Errorf("Wrong digest for the dba team: %v", digests["dba@example.org"])
+	}
+	if ops := digests["ops@example.org"]; len(ops) != 2 || ops[0].host != "db01" || ops[1].host != "web01" {
+		t.Errorf("Wrong digest for the ops team: %v", ops)
+	}
+
+	// State changes are not sent in digest mode
+	e.enqueue(problems[0])
+	if len(e.queue) != 0 {
+		t.Errorf("State changes should not be queued in digest mode")
+	}
+}
+
+func TestDigestProblems(t *testing.T) {
+	e := newEmailNotifier(&emailConfig{Mode: "digest"})
+	problems := []*notification{
+		{host: "web01", service: "apache", state: 2, custom: map[string]interface{}{"notificationPeriod": "workhours"}},
+		{host: "db01", service: "disk", state: 1, custom: map[string]interface{}{"team": "dba"}},
+	}
+	if kept := e.digestProblems(problems, time.Now()); len(kept) != 2 {
+		t.Errorf("Expecting every problem without period filter. Got %v", kept)
+	}
+
+	// The problems outside of their notification period are left out of the
+	// digests, whatever the policy of the period
+	e.periods, _ = newPeriodFilter(map[string]*timeperiodConfig{
+		"workhours": {Timezone: "UTC", Days: map[string]string{"monday-friday": "09:00-18:00"}},
+	}, "")
+	night := time.Date(2017, 1, 30, 2, 0, 0, 0, time.UTC)
+	morning := time.Date(2017, 1, 30, 9, 0, 0, 0, time.UTC)
+	if kept := e.digestProblems(problems, night); len(kept) != 1 || kept[0].host != "db01" {
+		t.Errorf("Expecting only db01 in the night digest. Got %v", kept)
+	}
+	if kept := e.digestProblems(problems, morning); len(kept) != 2 {
+		t.Errorf("Expecting every problem in the morning digest. Got %v", kept)
+	}
+	if len(e.periods.pending) != 0 {
+		t.Errorf("The digests should not queue anything. Got %v", e.periods.pending)
+	}
+}
+
+func TestRenderEmail(t *testing.T) {
+	tmplRoot = "templates"
+	n := &notification{host: "web01", service: "apache", state: 2, previousState: 0, output: "Connection refused", custom: map[string]interface{}{"runbook": "https://wiki.example.org/apache.html"}}
+	subject, body, err := renderEmail(emailTransitionTemplate, notificationTemplateData(n))
+	if err != nil {
+		t.Fatalf("renderEmail returned: %s", err)
+	}
+	if subject != "[nscapi] Critical web01/apache" {
+		t.Errorf("Wrong subject: %s", subject)
+	}
+	if !strings.Contains(body, "Connection refused") || !strings.Contains(body, "Runbook: https://wiki.example.org/apache.html") {
+		t.Errorf("Wrong body: %s", body)
+	}
+
+	data := map[string]interface{}{"recipient": "ops@example.org", "problems": []map[string]interface{}{notificationTemplateData(n)}}
+	if subject, _, err = renderEmail(emailDigestTemplate, data); err != nil || subject != "[nscapi] 1 current problem(s)" {
+		t.Errorf("Wrong digest subject: %s (error: %v)", subject, err)
+	}
+
+	if _, _, err = renderEmail("nonExisting.tmpl", data); err == nil {
+		t.Errorf("renderEmail should fail on a non-existing template")
+	}
+}
+
+func TestFormatEmail(t *testing.T) {
+	testCases := []struct {
+		subject string
+		body    string
+		headers []string
+		rawBody string
+	}{
+		{"[nscapi] Critical web01/apache", "line 1\nline 2\n", []string{"Subject: [nscapi] Critical web01/apache"}, "line 1\r\nline 2\r\n"},
+		// Header injection through the names or the output
+		{"[nscapi] Critical web01\r\nBcc: evil@example.org", "", []string{"Subject: [nscapi] Critical web01  Bcc: evil@example.org"}, ""},
+		{"[nscapi] Critical web01\nBcc: evil@example.org", "", []string{"Subject: [nscapi] Critical web01 Bcc: evil@example.org"}, ""},
+		// Line endings already in CRLF or CR
+		{"Subject", "line 1\r\nline 2\rline 3", []string{"Subject: Subject"}, "line 1\r\nline 2\r\nline 3"},
+		// Non-ASCII subject
+		{"[nscapi] Critical café", "", []string{"Subject: =?utf-8?q?[nscapi]_Critical_caf=C3=A9?="}, ""},
+	}
+	for _, tt := range testCases {
+		msg := string(formatEmail("nscapi@example.org", []string{"ops@example.org"}, tt.subject, tt.body))
+		parts := strings.SplitN(msg, "\r\n\r\n", 2)
+		if len(parts) != 2 {
+			t.Fatalf("No header separator in %q", msg)
+		}
+		headers := strings.Split(parts[0], "\r\n")
+		if len(headers) != 6 {
+			t.Errorf("Expecting 6 headers for %q. Got %q", tt.subject, headers)
+		}
+		for _, h := range tt.headers {
+			if !containsString(headers, h) {
+				t.Errorf("Missing header %q in %q", h, headers)
+			}
+		}
+		if parts[1] != tt.rawBody {
+			t.Errorf("Wrong body for %q. Got %q, expecting %q", tt.body, parts[1], tt.rawBody)
+		}
+	}
+}
+
+// fakeSMTPServer accepts a single SMTP session and sends the received commands
+// and data on the returned channel
+func fakeSMTPServer(t *testing.T) (net.Listener, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to start the fake SMTP server: %s", err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch {
+			case inData && line == ".":
+				inData = false
+				conn.Write([]byte("250 OK\r\n"))
+			case inData:
+			case strings.HasPrefix(line, "EHLO"):
+				conn.Write([]byte("250 localhost\r\n"))
+			case line == "DATA":
+				inData = true
+				conn.Write([]byte("354 Go ahead\r\n"))
+			case line == "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				received <- lines
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+		received <- lines
+	}()
+	return l, received
+}
+
+func TestEmailSend(t *testing.T) {
+	l, received := fakeSMTPServer(t)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	e := newEmailNotifier(&emailConfig{Host: host, Port: uint16(p), From: "nscapi@example.org"})
+
+	if err := e.sendMail([]string{"ops@example.org", "dba@example.org"}, "Test subject", "Line 1\nLine 2"); err != nil {
+		t.Fatalf("sendMail returned: %s", err)
+	}
+	session := strings.Join(<-received, "\n")
+	for _, expected := range []string{"MAIL FROM:<nscapi@example.org>", "RCPT TO:<ops@example.org>", "RCPT TO:<dba@example.org>", "Subject: Test subject", "To: ops@example.org, dba@example.org", "Line 1\nLine 2"} {
+		if !strings.Contains(session, expected) {
+			t.Errorf("Expecting '%s' in the SMTP session:\n%s", expected, session)
+		}
+	}
+
+	// STARTTLS required but not supported by the server
+	l, _ = fakeSMTPServer(t)
+	defer l.Close()
+	host, port, _ = net.SplitHostPort(l.Addr().String())
+	p, _ = strconv.Atoi(port)
+	e = newEmailNotifier(&emailConfig{Host: host, Port: uint16(p), From: "nscapi@example.org", StartTLS: true})
+	if err := e.sendMail([]string{"ops@example.org"}, "Test", "Test"); err == nil {
+		t.Errorf("sendMail should fail when STARTTLS is required and not supported")
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// receiver is implemented by the notification sinks that can be used as a
+// destination of the routing tree. send delivers a group of state changes
+type receiver interface {
+	send(notifs []*notification) error
+}
+
+// receiverConfig defines a named receiver of the routing tree. A receiver can
+// send to several sinks at once
+type receiverConfig struct {
+	Name  string       `yaml:"name"`
+	Chat  *chatConfig  `yaml:"chat"`
+	Email *emailConfig `yaml:"email"`
+}
+
+// routeConfig is a node of the routing tree. The fields left empty on a node
+// are inherited from its parent
+type routeConfig struct {
+	Receiver string `yaml:"receiver"`
+	// Match and MatchRe are the equality and regular expression matchers on
+	// host, service, hostgroup, status or any custom field. For the custom fields
+	// containing a list, one of the values matching is enough
+	Match   map[string]string `yaml:"match"`
+	MatchRe map[string]string `yaml:"matchRe"`
+	// Continue makes the evaluation go on with the next siblings even if this
+	// node matched
+	Continue bool     `yaml:"continue"`
+	GroupBy  []string `yaml:"groupBy"`
+	// GroupWait is the time to wait for other state changes of a new group
+	// before sending the first notification. Default to 30s
+	GroupWait time.Duration `yaml:"groupWait"`
+	// GroupInterval is the minimum time between 2 notifications of a group
+	// having new state changes. Default to 5m
+	GroupInterval time.Duration `yaml:"groupInterval"`
+	// RepeatInterval is the time after which a group with unresolved and
+	// unacknowledged problems is notified again. Default to 4h
+	RepeatInterval time.Duration `yaml:"repeatInterval"`
+	// EscalateTo is the receiver notified when a problem is still unresolved and
+	// unacknowledged EscalateAfter after having been first routed
+	EscalateTo    string         `yaml:"escalateTo"`
+	EscalateAfter time.Duration  `yaml:"escalateAfter"`
+	Routes        []*routeConfig `yaml:"routes"`
+
+	matchRe map[string]*regexp.Regexp
+}
+
+// checkKey identifies a check in the routing groups
+type checkKey struct {
+	host, service string
+}
+
+// routedAlert is the last state change of a check in a routing group
+type routedAlert struct {
+	n            *notification
+	problemSince time.Time
+	escalated    bool
+}
+
+// alertGroup contains the checks routed to the same node and sharing the same
+// values of the group-by fields
+type alertGroup struct {
+	route    *routeConfig
+	alerts   map[checkKey]*routedAlert
+	created  time.Time
+	lastSent time.Time
+	// changed is true when the group has state changes not notified yet
+	changed bool
+}
+
+// groupKey identifies an alert group
+type groupKey struct {
+	route  *routeConfig
+	labels string
+}
+
+// delivery is a group of state changes to send to a receiver
+type delivery struct {
+	receiver string
+	notifs   []*notification
+}
+
+// router is the notification sink implementing the routing tree. All its
+// state is owned by its run routine
+type router struct {
+	root      *routeConfig
+	receivers map[string][]receiver
+	groups    map[groupKey]*alertGroup
+	queue     chan *notification
+	now       func() time.Time
+}
+
+// newRouter builds the receivers and validates the routing tree
+func newRouter(route *routeConfig, receiverConfs []*receiverConfig) (*router, error) {
+	r := &router{
+		root:      route,
+		receivers: make(map[string][]receiver),
+		groups:    make(map[groupKey]*alertGroup),
+		queue:     make(chan *notification, notificationQueueSize),
+		now:       time.Now,
+	}
+	for _, rc := range receiverConfs {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("receivers must have a name")
+		}
+		if _, exists := r.receivers[rc.Name]; exists {
+			return nil, fmt.Errorf("receiver %s defined twice", rc.Name)
+		}
+		r.receivers[rc.Name] = []receiver{}
+		if rc.Chat != nil {
+			r.receivers[rc.Name] = append(r.receivers[rc.Name], newChatNotifier(rc.Chat))
+		}
+		if rc.Email != nil {
+			r.receivers[rc.Name] = append(r.receivers[rc.Name], newEmailNotifier(rc.Email))
+		}
+	}
+	// Defaults of the root node, inherited by the rest of the tree
+	if route.GroupWait <= 0 {
+		route.GroupWait = 30 * time.Second
+	}
+	if route.GroupInterval <= 0 {
+		route.GroupInterval = 5 * time.Minute
+	}
+	if route.RepeatInterval <= 0 {
+		route.RepeatInterval = 4 * time.Hour
+	}
+	if err := r.initRoute(route, nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// initRoute applies the inheritance from the parent node, compiles the
+// regular expressions and checks the receivers of a node and its children
+func (r *router) initRoute(route, parent *routeConfig) error {
+	if parent != nil {
+		if route.Receiver == "" {
+			route.Receiver = parent.Receiver
+		}
+		if route.GroupBy == nil {
+			route.GroupBy = parent.GroupBy
+		}
+		if route.GroupWait <= 0 {
+			route.GroupWait = parent.GroupWait
+		}
+		if route.GroupInterval <= 0 {
+			route.GroupInterval = parent.GroupInterval
+		}
+		if route.RepeatInterval <= 0 {
+			route.RepeatInterval = parent.RepeatInterval
+		}
+		if route.EscalateTo == "" {
+			route.EscalateTo = parent.EscalateTo
+			route.EscalateAfter = parent.EscalateAfter
+		}
+	}
+	if _, ok := r.receivers[route.Receiver]; !ok {
+		return fmt.Errorf("unknown receiver '%s' in the routing tree", route.Receiver)
+	}
+	if _, ok := r.receivers[route.EscalateTo]; route.EscalateTo != "" && !ok {
+		return fmt.Errorf("unknown escalation receiver '%s' in the routing tree", route.EscalateTo)
+	}
+	route.matchRe = make(map[string]*regexp.Regexp)
+	for field, expr := range route.MatchRe {
+		// Anchored so that the expression has to match the whole value
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return err
+		}
+		route.matchRe[field] = re
+	}
+	for _, child := range route.Routes {
+		if err := r.initRoute(child, route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldValues returns the values of a field of a state change that can be used
+// by the matchers and the group-by
+func fieldValues(n *notification, field string) []string {
+	switch field {
+	case "host":
+		return []string{n.host}
+	case "service":
+		return []string{n.service}
+	case "hostgroup":
+		return []string{n.hostgroup}
+	case "status":
+		return []string{checkStatusString(n.service, n.state)}
+	}
+	return getStrings(n.custom, field)
+}
+
+// matches returns whether all the matchers of the node match the state change
+func (route *routeConfig) matches(n *notification) bool {
+	for field, expected := range route.Match {
+		if !containsString(fieldValues(n, field), expected) {
+			return false
+		}
+	}
+	for field, re := range route.matchRe {
+		matched := false
+		for _, value := range fieldValues(n, field) {
+			if re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchingRoutes returns the deepest nodes of the tree matching the state
+// change. The children are evaluated in order and the evaluation stops at the
+// first matching child unless it has continue set. A node without any
+// matching child is itself the result
+func (route *routeConfig) matchingRoutes(n *notification) []*routeConfig {
+	if !route.matches(n) {
+		return nil
+	}
+	var matching []*routeConfig
+	for _, child := range route.Routes {
+		if m := child.matchingRoutes(n); len(m) > 0 {
+			matching = append(matching, m...)
+			if !child.Continue {
+				break
+			}
+		}
+	}
+	if len(matching) == 0 {
+		matching = []*routeConfig{route}
+	}
+	return matching
+}
+
+// containsString returns whether the list contains the given string
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue puts the state change in the queue of the router
+func (r *router) enqueue(n *notification) {
+	select {
+	case r.queue <- n:
+	default:
+		queueDrops.inc("routing")
+		log.Printf("Routing queue full, dropping notification of %s", checkName(n.host, n.service))
+	}
+}
+
+// run processes the incoming state changes and checks every second the
+// groups that have to be notified
+func (r *router) run() {
+	ticker := time.NewTicker(time.Second)
+	for {
+		select {
+		case n := <-r.queue:
+			r.process(n)
+		case <-ticker.C:
+			for _, d := range r.flush() {
+				go r.deliver(d)
+			}
+		}
+	}
+}
+
+// process adds a state change to the groups of all the matching nodes. The
+// groups of the nodes no longer matching the check, such as a node matching
+// on the status, get the recovery of the check or forget its problem
+func (r *router) process(n *notification) {
+	now := r.now()
+	chk := checkKey{n.host, n.service}
+	matched := make(map[groupKey]bool)
+	for _, route := range r.root.matchingRoutes(n) {
+		var labels []string
+		for _, field := range route.GroupBy {
+			labels = append(labels, field+"="+strings.Join(fieldValues(n, field), ","))
+		}
+		key := groupKey{route, strings.Join(labels, ";")}
+		matched[key] = true
+		group, ok := r.groups[key]
+		if !ok {
+			group = &alertGroup{route: route, alerts: make(map[checkKey]*routedAlert), created: now}
+			r.groups[key] = group
+		}
+		alert, ok := group.alerts[chk]
+		if !ok {
+			alert = &routedAlert{}
+			group.alerts[chk] = alert
+		}
+		if n.state == 0 {
+			alert.problemSince = time.Time{}
+			alert.escalated = false
+		} else if alert.n == nil || alert.n.state == 0 {
+			alert.problemSince = now
+		}
+		alert.n = n
+		group.changed = true
+	}
+	for key, group := range r.groups {
+		alert, ok := group.alerts[chk]
+		if !ok || matched[key] {
+			continue
+		}
+		if n.state == 0 {
+			// Notified once and forgotten like the recoveries of the matching nodes
+			alert.n = n
+			alert.problemSince = time.Time{}
+			group.changed = true
+			continue
+		}
+		delete(group.alerts, chk)
+		if len(group.alerts) == 0 {
+			delete(r.groups, key)
+		}
+	}
+}
+
+// flush returns the deliveries due at this time: the groups waited long enough
+// since their creation or since their last notification, the unresolved
+// groups to notify again and the problems to escalate
+func (r *router) flush() []delivery {
+	now := r.now()
+	var deliveries []delivery
+	for key, group := range r.groups {
+		route := group.route
+		due := false
+		switch {
+		case group.lastSent.IsZero():
+			due = !now.Before(group.created.Add(route.GroupWait))
+		case group.changed:
+			due = !now.Before(group.lastSent.Add(route.GroupInterval))
+		default:
+			due = group.hasUnacknowledgedProblems() && !now.Before(group.lastSent.Add(route.RepeatInterval))
+		}
+
+		var escalations []*notification
+		for _, alert := range group.sortedAlerts() {
+			if route.EscalateTo != "" && route.EscalateAfter > 0 && alert.n.state != 0 && !alert.escalated &&
+				!now.Before(alert.problemSince.Add(route.EscalateAfter)) && !isAcknowledged(alert.n.host, alert.n.service) {
+				alert.escalated = true
+				escalations = append(escalations, alert.n)
+			}
+		}
+		if len(escalations) > 0 {
+			deliveries = append(deliveries, delivery{route.EscalateTo, escalations})
+		}
+
+		if !due {
+			continue
+		}
+		var notifs []*notification
+		for _, alert := range group.sortedAlerts() {
+			notifs = append(notifs, alert.n)
+			// Resolved checks are notified once and forgotten
+			if alert.n.state == 0 {
+				delete(group.alerts, checkKey{alert.n.host, alert.n.service})
+			}
+		}
+		deliveries = append(deliveries, delivery{route.Receiver, notifs})
+		group.lastSent = now
+		group.changed = false
+		if len(group.alerts) == 0 {
+			delete(r.groups, key)
+		}
+	}
+	return deliveries
+}
+
+// sortedAlerts returns the alerts of the group sorted by host and service
+func (g *alertGroup) sortedAlerts() []*routedAlert {
+	alerts := make([]*routedAlert, 0, len(g.alerts))
+	for _, alert := range g.alerts {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].n.host != alerts[j].n.host {
+			return alerts[i].n.host < alerts[j].n.host
+		}
+		return alerts[i].n.service < alerts[j].n.service
+	})
+	return alerts
+}
+
+// hasUnacknowledgedProblems returns whether some checks of the group are still
+// in a non-OK state without being acknowledged
+func (g *alertGroup) hasUnacknowledgedProblems() bool {
+	for _, alert := range g.alerts {
+		if alert.n.state != 0 && !isAcknowledged(alert.n.host, alert.n.service) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends a group of state changes to all the sinks of a receiver
+func (r *router) deliver(d delivery) {
+	for _, rcv := range r.receivers[d.receiver] {
+		if err := rcv.send(d.notifs); err != nil {
+			log.Printf("Unable to notify receiver %s: %s", d.receiver, err)
+		}
+	}
+}
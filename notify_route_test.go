@@ -0,0 +1,258 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRouteTree is a routing tree with a receiver per team, the db hostgroup
+// also being sent to the ops team
+func testRouteTree() (*routeConfig, []*receiverConfig) {
+	route := &routeConfig{
+		Receiver:       "default",
+		GroupBy:        []string{"hostgroup", "service"},
+		GroupWait:      30 * time.Second,
+		GroupInterval:  5 * time.Minute,
+		RepeatInterval: time.Hour,
+		Routes: []*routeConfig{
+			{Receiver: "dba", Match: map[string]string{"hostgroup": "db"}, Continue: true, EscalateTo: "oncall", EscalateAfter: 10 * time.Minute},
+			{Receiver: "ops", Match: map[string]string{"team": "ops"}, Routes: []*routeConfig{
+				{Receiver: "oncall", MatchRe: map[string]string{"status": "Critical|Unknown", "paging": "true"}},
+			}},
+			{Receiver: "web", MatchRe: map[string]string{"service": "apache|nginx.*"}},
+		},
+	}
+	receivers := []*receiverConfig{{Name: "default"}, {Name: "dba"}, {Name: "ops"}, {Name: "web"}, {Name: "oncall"}}
+	return route, receivers
+}
+
+func TestNewRouter(t *testing.T) {
+	route, receivers := testRouteTree()
+	if _, err := newRouter(route, receivers); err != nil {
+		t.Fatalf("newRouter returned: %s", err)
+	}
+	// Inheritance from the parent
+	if dba := route.Routes[0]; !reflect.DeepEqual(dba.GroupBy, []string{"hostgroup", "service"}) || dba.RepeatInterval != time.Hour {
+		t.Errorf("Wrong settings inherited by the dba node: %v, %s", dba.GroupBy, dba.RepeatInterval)
+	}
+	if oncall := route.Routes[1].Routes[0]; oncall.GroupWait != 30*time.Second {
+		t.Errorf("Wrong group wait inherited by the oncall node: %s", oncall.GroupWait)
+	}
+
+	errorCases := []struct {
+		route     *routeConfig
+		receivers []*receiverConfig
+	}{
+		{&routeConfig{Receiver: "nonExisting"}, []*receiverConfig{{Name: "default"}}},
+		{&routeConfig{Receiver: "default", Routes: []*routeConfig{{Receiver: "nonExisting"}}}, []*receiverConfig{{Name: "default"}}},
+		{&routeConfig{Receiver: "default", EscalateTo: "nonExisting"}, []*receiverConfig{{Name: "default"}}},
+		{&routeConfig{Receiver: "default", MatchRe: map[string]string{"host": "web(["}}, []*receiverConfig{{Name: "default"}}},
+		{&routeConfig{Receiver: "default"}, []*receiverConfig{{Name: "default"}, {Name: "default"}}},
+		{&routeConfig{Receiver: "default"}, []*receiverConfig{{Name: ""}}},
+	}
+	for i, tt := range errorCases {
+		if _, err := newRouter(tt.route, tt.receivers); err == nil {
+			t.Errorf("newRouter should fail on the error case #%d", i)
+		}
+	}
+}
+
+func TestMatchingRoutes(t *testing.T) {
+	route, receivers := testRouteTree()
+	newRouter(route, receivers)
+	cases := []struct {
+		n         *notification
+		receivers []string
+	}{
+		{&notification{host: "app01", hostgroup: "app", service: "load", state: 2}, []string{"default"}},
+		// continue on the dba node
+		{&notification{host: "db01", hostgroup: "db", service: "disk", state: 1, custom: map[string]interface{}{"team": []interface{}{"dba", "ops"}}}, []string{"dba", "ops"}},
+		{&notification{host: "db01", hostgroup: "db", service: "disk", state: 2, custom: map[string]interface{}{"team": []interface{}{"dba", "ops"}, "paging": true}}, []string{"dba", "oncall"}},
+		{&notification{host: "db01", hostgroup: "db", service: "disk", state: 1, custom: map[string]interface{}{"team": []interface{}{"dba"}}}, []string{"dba"}},
+		{&notification{host: "web01", hostgroup: "web", service: "nginx_port", state: 2}, []string{"web"}},
+		// Stops at the first matching node
+		{&notification{host: "web01", hostgroup: "web", service: "apache", state: 2, custom: map[string]interface{}{"team": "ops"}}, []string{"ops"}},
+		// Regexp have to match the whole value
+		{&notification{host: "web01", hostgroup: "web", service: "apache2", state: 2}, []string{"default"}},
+	}
+	for _, tt := range cases {
+		var names []string
+		for _, r := range route.matchingRoutes(tt.n) {
+			names = append(names, r.Receiver)
+		}
+		if !reflect.DeepEqual(names, tt.receivers) {
+			t.Errorf("%s/%s should be routed to %v, not %v", tt.n.host, tt.n.service, tt.receivers, names)
+		}
+	}
+}
+
+func TestRouterFlush(t *testing.T) {
+	initCache()
+	route, receivers := testRouteTree()
+	r, _ := newRouter(route, receivers)
+	now := time.Unix(1484527962, 0)
+	r.now = func() time.Time { return now }
+	elapse := func(d time.Duration) []delivery {
+		now = now.Add(d)
+		return r.flush()
+	}
+
+	web01 := &notification{host: "web01", hostgroup: "web", service: "apache", state: 2}
+	web02 := &notification{host: "web02", hostgroup: "web", service: "apache", state: 2}
+	r.process(web01)
+	if d := elapse(10 * time.Second); len(d) != 0 {
+		t.Errorf("Nothing should be sent during the group wait. Got %v", d)
+	}
+	r.process(web02)
+	d := elapse(20 * time.Second)
+	if len(d) != 1 || d[0].receiver != "web" || !reflect.DeepEqual(d[0].notifs, []*notification{web01, web02}) {
+		t.Fatalf("Expecting web01 and web02 to be sent grouped after the group wait. Got %v", d)
+	}
+
+	// Recovery of web01 waits for the group interval
+	web01OK := &notification{host: "web01", hostgroup: "web", service: "apache", state: 0}
+	r.process(web01OK)
+	if d = elapse(time.Minute); len(d) != 0 {
+		t.Errorf("Nothing should be sent before the group interval. Got %v", d)
+	}
+	d = elapse(4 * time.Minute)
+	if len(d) != 1 || !reflect.DeepEqual(d[0].notifs, []*notification{web01OK, web02}) {
+		t.Fatalf("Expecting the recovery to be sent after the group interval. Got %v", d)
+	}
+
+	// Re-notification of web02 which is still critical, until it is acknowledged
+	if d = elapse(30 * time.Minute); len(d) != 0 {
+		t.Errorf("Nothing should be sent before the repeat interval. Got %v", d)
+	}
+	d = elapse(30 * time.Minute)
+	if len(d) != 1 || !reflect.DeepEqual(d[0].notifs, []*notification{web02}) {
+		t.Fatalf("Expecting web02 to be notified again after the repeat interval. Got %v", d)
+	}
+	updateCacheEntry("web02", "apache", "Connection refused", 1484527962, 2)
+	acknowledgeCacheEntry("web02", "apache")
+	if d = elapse(time.Hour); len(d) != 0 {
+		t.Errorf("Acknowledged problems should not be notified again. Got %v", d)
+	}
+
+	// The group is forgotten once everything is resolved
+	r.process(&notification{host: "web02", hostgroup: "web", service: "apache", state: 0})
+	elapse(5 * time.Minute)
+	if len(r.groups) != 0 {
+		t.Errorf("Resolved groups should be removed. %d groups left", len(r.groups))
+	}
+}
+
+func TestRouterEscalation(t *testing.T) {
+	initCache()
+	route, receivers := testRouteTree()
+	r, _ := newRouter(route, receivers)
+	now := time.Unix(1484527962, 0)
+	r.now = func() time.Time { return now }
+	elapse := func(d time.Duration) []delivery {
+		now = now.Add(d)
+		return r.flush()
+	}
+
+	db01 := &notification{host: "db01", hostgroup: "db", service: "disk", state: 2}
+	db02 := &notification{host: "db02", hostgroup: "db", service: "disk", state: 2}
+	updateCacheEntry("db02", "disk", "Disk full", 1484527962, 2)
+	r.process(db01)
+	r.process(db02)
+	if d := elapse(time.Minute); len(d) != 1 || d[0].receiver != "dba" {
+		t.Fatalf("Expecting the problems to be sent to the dba receiver. Got %v", d)
+	}
+	acknowledgeCacheEntry("db02", "disk")
+	d := elapse(10 * time.Minute)
+	if len(d) != 1 || d[0].receiver != "oncall" || !reflect.DeepEqual(d[0].notifs, []*notification{db01}) {
+		t.Fatalf("Expecting the unacknowledged db01 problem to be escalated. Got %v", d)
+	}
+	if d = elapse(10 * time.Minute); len(d) != 0 {
+		t.Errorf("A problem should be escalated only once. Got %v", d)
+	}
+}
+
+func TestRouterStatusMatcherRecovery(t *testing.T) {
+	initCache()
+	route := &routeConfig{
+		Receiver: "default",
+		GroupBy:  []string{"hostgroup"},
+		Routes: []*routeConfig{
+			{Receiver: "dba", Match: map[string]string{"hostgroup": "db"}, MatchRe: map[string]string{"status": "Critical|Unknown"}, EscalateTo: "oncall", EscalateAfter: 10 * time.Minute},
+		},
+	}
+	r, _ := newRouter(route, []*receiverConfig{{Name: "default"}, {Name: "dba"}, {Name: "oncall"}})
+	now := time.Unix(1484527962, 0)
+	r.now = func() time.Time { return now }
+	elapse := func(d time.Duration) []delivery {
+		now = now.Add(d)
+		return r.flush()
+	}
+
+	db01 := &notification{host: "db01", hostgroup: "db", service: "disk", state: 2}
+	updateCacheEntry("db01", "disk", "Disk full", 1484527962, 2)
+	r.process(db01)
+	if d := elapse(time.Minute); len(d) != 1 || d[0].receiver != "dba" {
+		t.Fatalf("Expecting the problem to be sent to the dba receiver. Got %v", d)
+	}
+
+	// The recovery does not match the status matcher of the dba node but
+	// resolves the problem of its group
+	db01OK := &notification{host: "db01", hostgroup: "db", service: "disk", state: 0}
+	updateCacheEntry("db01", "disk", "Disk OK", 1484527972, 0)
+	r.process(db01OK)
+	d := elapse(5 * time.Minute)
+	var dba []*notification
+	for _, del := range d {
+		if del.receiver == "oncall" {
+			t.Errorf("A resolved problem should not be escalated. Got %v", del.notifs)
+		}
+		if del.receiver == "dba" {
+			dba = del.notifs
+		}
+	}
+	if !reflect.DeepEqual(dba, []*notification{db01OK}) {
+		t.Errorf("Expecting the recovery to be sent to the dba receiver. Got %v", d)
+	}
+	for _, del := range elapse(5 * time.Hour) {
+		if del.receiver != "default" {
+			t.Errorf("Nothing should be sent again for the resolved problem. Got %v", del)
+		}
+	}
+	for key := range r.groups {
+		if key.route.Receiver == "dba" {
+			t.Error("The group of the dba node should be forgotten once resolved")
+		}
+	}
+
+	// A problem no longer matching the node is forgotten by its group
+	r.process(db01)
+	elapse(time.Minute)
+	r.process(&notification{host: "db01", hostgroup: "db", service: "disk", state: 1})
+	for key := range r.groups {
+		if key.route.Receiver == "dba" {
+			t.Error("The Warning state should remove the check from the group of the dba node")
+		}
+	}
+}
+
+type fakeReceiver struct {
+	received [][]*notification
+}
+
+func (f *fakeReceiver) send(notifs []*notification) error {
+	f.received = append(f.received, notifs)
+	return nil
+}
+
+func TestRouterDeliver(t *testing.T) {
+	route, receivers := testRouteTree()
+	r, _ := newRouter(route, receivers)
+	fake := &fakeReceiver{}
+	r.receivers["web"] = []receiver{fake, fake}
+	n := &notification{host: "web01", service: "apache"}
+	r.deliver(delivery{"web", []*notification{n}})
+	if len(fake.received) != 2 {
+		t.Errorf("Expecting all the sinks of the receiver to be notified. Got %d notifications", len(fake.received))
+	}
+}
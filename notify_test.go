@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadNotificationsConfig(t *testing.T) {
+	conf, err := loadNotificationsConfig("testData/notifications.yaml")
+	if err != nil {
+		t.Fatalf("loadNotificationsConfig returned: %s", err)
+	}
+	if conf.Chat == nil {
+		t.Fatalf("chat section should have been loaded")
+	}
+	if conf.Chat.Teams["dba"] != "http://chat.example.org/hooks/dba" {
+		t.Errorf("Wrong webhook for the dba team: %s", conf.Chat.Teams["dba"])
+	}
+	if conf.Chat.GroupWindow != 45*time.Second {
+		t.Errorf("Wrong group window. Got %s, expecting 45s", conf.Chat.GroupWindow)
+	}
+	if conf.Email == nil || conf.Email.Mode != "digest" || conf.Email.DigestInterval != 2*time.Hour || !conf.Email.StartTLS {
+		t.Errorf("Wrong email section loaded: %v", conf.Email)
+	}
+	if len(conf.Receivers) != 2 || conf.Receivers[1].Email == nil {
+		t.Errorf("Wrong receivers loaded: %v", conf.Receivers)
+	}
+	if conf.Route == nil || len(conf.Route.Routes) != 1 || conf.Route.Routes[0].EscalateAfter != 30*time.Minute || conf.Route.Routes[0].Match["hostgroup"] != "db" {
+		t.Errorf("Wrong routing tree loaded: %v", conf.Route)
+	}
+	if conf.NotificationPeriodField != "notifyDuring" || conf.Timeperiods["workhours"] == nil || conf.Timeperiods["workhours"].Days["monday-friday"] != "09:00-12:00,13:00-18:00" {
+		t.Errorf("Wrong time periods loaded: %v", conf.Timeperiods)
+	}
+	if _, err = newPeriodFilter(conf.Timeperiods, conf.NotificationPeriodField); err != nil {
+		t.Errorf("The time periods should be valid. Got: %s", err)
+	}
+
+	if _, err = loadNotificationsConfig("testData/nonExistingFile.yaml"); err == nil {
+		t.Errorf("loadNotificationsConfig should fail on a non-existing file")
+	}
+}
+
+func TestQueueNotification(t *testing.T) {
+	initCache()
+	notificationQueue = make(chan *notification, 10)
+	defer func() { notificationQueue = nil }()
+
+	testCases := []struct {
+		output   string
+		state    int16
+		notified bool
+		previous int16
+	}{
+		// New check in OK state
+		{"OK", 0, false, 0},
+		{"Still OK", 0, false, 0},
+		{"Disk full", 2, true, 0},
+		{"Disk still full", 2, false, 0},
+		{"Disk almost full", 1, true, 2},
+		{"OK", 0, true, 1},
+	}
+	for i, tt := range testCases {
+		updateCacheEntry("db01", "disk", tt.output, uint32(1484527962+i), tt.state)
+		select {
+		case n := <-notificationQueue:
+			if !tt.notified {
+				t.Errorf("Unexpected notification for '%s'", tt.output)
+			}
+			if n.host != "db01" || n.service != "disk" || n.hostgroup != "db" {
+				t.Errorf("Wrong check in the notification: %s/%s (%s)", n.host, n.service, n.hostgroup)
+			}
+			if n.state != tt.state || n.previousState != tt.previous || n.output != tt.output {
+				t.Errorf("Wrong notification for '%s'. Got state %d (previously %d) and output '%s'", tt.output, n.state, n.previousState, n.output)
+			}
+		default:
+			if tt.notified {
+				t.Errorf("Expecting a notification for '%s'", tt.output)
+			}
+		}
+	}
+
+	// New check directly in a non-OK state
+	updateCacheEntry("db02", "disk", "Disk full", 1484527962, 2)
+	if len(notificationQueue) != 1 {
+		t.Errorf("Expecting a notification for a new check in a non-OK state")
+	}
+	<-notificationQueue
+
+	// Host checks
+	updateCacheEntry("db03", "", "PING OK", 1484527962, 0)
+	updateCacheEntry("db03", "", "PING CRITICAL - 100% loss", 1484527972, 2)
+	updateCacheEntry("db03", "", "PING CRITICAL - 100% loss", 1484527982, 3)
+	if len(notificationQueue) != 2 {
+		t.Fatalf("Expecting 2 host notifications. Got %d", len(notificationQueue))
+	}
+	<-notificationQueue
+	n := <-notificationQueue
+	if n.host != "db03" || n.service != "" || n.state != 1 || n.previousState != 2 {
+		t.Errorf("Wrong host notification: %+v", n)
+	}
+	if s := notificationSummary(n); !strings.HasPrefix(s, "DOWN db03 for ") {
+		t.Errorf("Wrong host notification summary: %s", s)
+	}
+	if data := notificationTemplateData(n); data["status"] != "Down" || data["previousStatus"] != "Unreachable" || data["check"] != "db03" {
+		t.Errorf("Wrong host notification template data: %v", data)
+	}
+}
+
+func TestStateDuration(t *testing.T) {
+	if d := stateDuration(uint32(time.Now().Add(time.Hour).Unix())); d != 0 {
+		t.Errorf("Expecting a duration of 0 for a future timestamp. Got %s", d)
+	}
+	if d := stateDuration(uint32(time.Now().Add(-90 * time.Second).Unix())); d < 90*time.Second || d > 91*time.Second {
+		t.Errorf("Expecting a duration of 1m30s. Got %s", d)
+	}
+}
+
+type fakeNotifier struct {
+	received []*notification
+}
+
+func (f *fakeNotifier) enqueue(n *notification) { f.received = append(f.received, n) }
+func (f *fakeNotifier) run()                    {}
+
+func TestDispatchNotifications(t *testing.T) {
+	cFields = customFields{fields: map[fieldClassifier]map[string]interface{}{
+		{hostgroup: "db", service: "all"}: {"notificationPeriod": "never"},
+	}}
+	defer func() { cFields = customFields{} }()
+	periods, _ := newPeriodFilter(map[string]*timeperiodConfig{"never": {Policy: "drop"}}, "")
+
+	sink := &fakeNotifier{}
+	queue := make(chan *notification, 2)
+	queue <- &notification{host: "web01", service: "apache", state: 2}
+	queue <- &notification{host: "db01", service: "disk", state: 2}
+	close(queue)
+	dispatchNotifications(queue, []notifier{sink}, periods)
+	if len(sink.received) != 1 || sink.received[0].host != "web01" {
+		t.Errorf("Only web01 should have been dispatched. Got %v", sink.received)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeperiodConfig is the Nagios-style definition of a time period
+type timeperiodConfig struct {
+	// Timezone the time ranges are expressed in. Default to the local time zone
+	Timezone string `yaml:"timezone"`
+	// Policy applied to the notifications outside of the period: "queue" to
+	// send them when the period starts or "drop". Default to "queue"
+	Policy string `yaml:"policy"`
+	// Days maps a weekday ("monday") or a range of weekdays ("monday-friday") to
+	// a comma-separated list of time ranges ("09:00-12:00,13:00-18:00")
+	Days map[string]string `yaml:"days"`
+	// Exceptions maps a date ("2017-12-24") or a yearly date ("december 25") to
+	// the time ranges replacing the ones of the weekday. An empty value means
+	// the period does not include this date at all
+	Exceptions map[string]string `yaml:"exceptions"`
+}
+
+// timeRange is a range of minutes since midnight, end excluded
+type timeRange struct {
+	start, end int
+}
+
+// timeperiod is the compiled version of a timeperiodConfig
+type timeperiod struct {
+	name     string
+	loc      *time.Location
+	policy   string
+	weekdays [7][]timeRange
+	// dates are indexed by "2006-01-02" and yearly dates by "1-2"
+	dates  map[string][]timeRange
+	yearly map[string][]timeRange
+}
+
+var weekdayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// parseWeekday returns the index of a weekday as used by time.Weekday
+func parseWeekday(name string) (int, error) {
+	for i, day := range weekdayNames {
+		if day == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday '%s'", name)
+}
+
+// parseTimeRanges parses a comma-separated list of time ranges such as
+// "09:00-12:00,13:00-24:00"
+func parseTimeRanges(value string) ([]timeRange, error) {
+	ranges := []timeRange{}
+	for _, rng := range strings.Split(value, ",") {
+		rng = strings.TrimSpace(rng)
+		if rng == "" {
+			continue
+		}
+		bounds := strings.Split(rng, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid time range '%s'", rng)
+		}
+		var minutes [2]int
+		for i, bound := range bounds {
+			hm := strings.Split(strings.TrimSpace(bound), ":")
+			if len(hm) != 2 {
+				return nil, fmt.Errorf("invalid time '%s' in time range '%s'", bound, rng)
+			}
+			h, errH := strconv.Atoi(hm[0])
+			m, errM := strconv.Atoi(hm[1])
+			if errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+				return nil, fmt.Errorf("invalid time '%s' in time range '%s'", bound, rng)
+			}
+			minutes[i] = h*60 + m
+		}
+		if minutes[0] >= minutes[1] {
+			return nil, fmt.Errorf("invalid time range '%s': the end must be after the start", rng)
+		}
+		ranges = append(ranges, timeRange{minutes[0], minutes[1]})
+	}
+	return ranges, nil
+}
+
+// newTimeperiod compiles a time period definition
+func newTimeperiod(name string, conf *timeperiodConfig) (*timeperiod, error) {
+	tp := &timeperiod{
+		name:   name,
+		loc:    time.Local,
+		policy: conf.Policy,
+		dates:  make(map[string][]timeRange),
+		yearly: make(map[string][]timeRange),
+	}
+	if tp.policy == "" {
+		tp.policy = "queue"
+	}
+	if tp.policy != "queue" && tp.policy != "drop" {
+		return nil, fmt.Errorf("invalid policy '%s' for time period %s", tp.policy, name)
+	}
+	if conf.Timezone != "" {
+		loc, err := time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		tp.loc = loc
+	}
+
+	for days, value := range conf.Days {
+		ranges, err := parseTimeRanges(value)
+		if err != nil {
+			return nil, err
+		}
+		bounds := strings.Split(strings.ToLower(days), "-")
+		first, err := parseWeekday(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseWeekday(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, err
+			}
+		} else if len(bounds) > 2 {
+			return nil, fmt.Errorf("invalid weekday range '%s'", days)
+		}
+		// Ranges like saturday-monday wrap around the end of the week
+		for day := first; ; day = (day + 1) % 7 {
+			tp.weekdays[day] = append(tp.weekdays[day], ranges...)
+			if day == last {
+				break
+			}
+		}
+	}
+
+	for date, value := range conf.Exceptions {
+		ranges, err := parseTimeRanges(value)
+		if err != nil {
+			return nil, err
+		}
+		if d, err := time.Parse("2006-01-02", date); err == nil {
+			tp.dates[d.Format("2006-01-02")] = ranges
+		} else if d, err := time.Parse("January 2", date); err == nil {
+			tp.yearly[fmt.Sprintf("%d-%d", d.Month(), d.Day())] = ranges
+		} else {
+			return nil, fmt.Errorf("invalid exception date '%s' in time period %s", date, name)
+		}
+	}
+	return tp, nil
+}
+
+// contains returns whether the given time is part of the time period
+func (tp *timeperiod) contains(t time.Time) bool {
+	t = t.In(tp.loc)
+	ranges, ok := tp.dates[t.Format("2006-01-02")]
+	if !ok {
+		ranges, ok = tp.yearly[fmt.Sprintf("%d-%d", t.Month(), t.Day())]
+	}
+	if !ok {
+		ranges = tp.weekdays[t.Weekday()]
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, rng := range ranges {
+		if minute >= rng.start && minute < rng.end {
+			return true
+		}
+	}
+	return false
+}
+
+// suppressedNotification is the last state change of a check received outside
+// of its notification period
+type suppressedNotification struct {
+	n      *notification
+	period *timeperiod
+	// stateBefore is the state of the check before the first suppressed state
+	// change. Nothing is sent if the check went back to this state
+	stateBefore int16
+}
+
+// periodFilter holds the notifications received outside of the notification
+// period of their check
+type periodFilter struct {
+	periods map[string]*timeperiod
+	// field is the custom field containing the notification period of a check
+	field   string
+	pending map[checkKey]*suppressedNotification
+}
+
+// newPeriodFilter compiles the time periods definitions
+func newPeriodFilter(confs map[string]*timeperiodConfig, field string) (*periodFilter, error) {
+	if field == "" {
+		field = "notificationPeriod"
+	}
+	f := &periodFilter{
+		periods: make(map[string]*timeperiod),
+		field:   field,
+		pending: make(map[checkKey]*suppressedNotification),
+	}
+	for name, conf := range confs {
+		tp, err := newTimeperiod(name, conf)
+		if err != nil {
+			return nil, err
+		}
+		f.periods[name] = tp
+	}
+	return f, nil
+}
+
+// periodOf returns the notification period of a check, nil for the checks
+// notified at any time
+func (f *periodFilter) periodOf(n *notification) *timeperiod {
+	names := getStrings(n.custom, f.field)
+	if len(names) == 0 {
+		return nil
+	}
+	tp, ok := f.periods[names[0]]
+	if !ok {
+		log.Printf("Unknown notification period '%s' for %s, notifying anyway", names[0], checkName(n.host, n.service))
+		return nil
+	}
+	return tp
+}
+
+// inPeriod returns whether the check of a notification is inside its
+// notification period, without queuing anything. It only reads the compiled
+// periods and can be called from the sinks
+func (f *periodFilter) inPeriod(n *notification, now time.Time) bool {
+	tp := f.periodOf(n)
+	return tp == nil || tp.contains(now)
+}
+
+// allow returns whether the state change can be notified now. The state
+// changes outside of the notification period of their check are queued or
+// dropped depending on the policy of the period
+func (f *periodFilter) allow(n *notification, now time.Time) bool {
+	chk := checkKey{n.host, n.service}
+	tp := f.periodOf(n)
+	if tp == nil {
+		return true
+	}
+	if tp.contains(now) {
+		// A newer state change supersedes the suppressed ones
+		delete(f.pending, chk)
+		return true
+	}
+	if tp.policy == "queue" {
+		if suppressed, exists := f.pending[chk]; exists {
+			suppressed.n = n
+		} else {
+			f.pending[chk] = &suppressedNotification{n: n, period: tp, stateBefore: n.previousState}
+		}
+	}
+	return false
+}
+
+// release returns the queued state changes whose notification period started.
+// The checks that went back to their state before the first suppressed state
+// change are forgotten
+func (f *periodFilter) release(now time.Time) []*notification {
+	var released []*notification
+	for chk, suppressed := range f.pending {
+		if !suppressed.period.contains(now) {
+			continue
+		}
+		delete(f.pending, chk)
+		if suppressed.n.state != suppressed.stateBefore {
+			suppressed.n.previousState = suppressed.stateBefore
+			released = append(released, suppressed.n)
+		}
+	}
+	return released
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRanges(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected []timeRange
+		err      bool
+	}{
+		{"09:00-17:00", []timeRange{{540, 1020}}, false},
+		{"00:00-09:00, 18:30-24:00", []timeRange{{0, 540}, {1110, 1440}}, false},
+		{"", []timeRange{}, false},
+		{"09:00", nil, true},
+		{"17:00-09:00", nil, true},
+		{"09:00-25:00", nil, true},
+		{"9h-10h", nil, true},
+	}
+	for _, tt := range cases {
+		ranges, err := parseTimeRanges(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("parseTimeRanges(%s) returned the error: %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(ranges, tt.expected) {
+			t.Errorf("parseTimeRanges(%s) should return %v, not %v", tt.in, tt.expected, ranges)
+		}
+	}
+}
+
+func TestTimeperiodContains(t *testing.T) {
+	tp, err := newTimeperiod("workhours", &timeperiodConfig{
+		Timezone: "Europe/Paris",
+		Days: map[string]string{
+			"monday-thursday": "09:00-12:00,13:00-18:00",
+			"friday":          "09:00-12:00",
+			"saturday-sunday": "",
+		},
+		Exceptions: map[string]string{
+			"december 25": "",
+			"2017-02-03":  "09:00-18:00",
+		},
+	})
+	if err != nil {
+		t.Fatalf("newTimeperiod returned: %s", err)
+	}
+	paris, _ := time.LoadLocation("Europe/Paris")
+	cases := []struct {
+		t        time.Time
+		expected bool
+	}{
+		// Monday
+		{time.Date(2017, 1, 30, 10, 0, 0, 0, paris), true},
+		{time.Date(2017, 1, 30, 12, 30, 0, 0, paris), false},
+		{time.Date(2017, 1, 30, 8, 59, 0, 0, paris), false},
+		{time.Date(2017, 1, 30, 18, 0, 0, 0, paris), false},
+		// Same time expressed in UTC
+		{time.Date(2017, 1, 30, 9, 0, 0, 0, time.UTC), true},
+		// Friday, with the exception of the 2017-02-03
+		{time.Date(2017, 1, 27, 14, 0, 0, 0, paris), false},
+		{time.Date(2017, 2, 3, 14, 0, 0, 0, paris), true},
+		// Saturday
+		{time.Date(2017, 1, 28, 10, 0, 0, 0, paris), false},
+		// Christmas on a monday
+		{time.Date(2017, 12, 25, 10, 0, 0, 0, paris), false},
+	}
+	for _, tt := range cases {
+		if returned := tp.contains(tt.t); returned != tt.expected {
+			t.Errorf("contains(%s) should return %t", tt.t, tt.expected)
+		}
+	}
+
+	errorCases := []*timeperiodConfig{
+		{Timezone: "Nowhere/Nothing"},
+		{Policy: "whatever"},
+		{Days: map[string]string{"funday": "09:00-17:00"}},
+		{Days: map[string]string{"monday-friday-sunday": "09:00-17:00"}},
+		{Days: map[string]string{"monday": "09:00-07:00"}},
+		{Exceptions: map[string]string{"25/12": ""}},
+	}
+	for _, conf := range errorCases {
+		if _, err := newTimeperiod("error", conf); err == nil {
+			t.Errorf("newTimeperiod should fail on %v", conf)
+		}
+	}
+}
+
+func TestPeriodFilter(t *testing.T) {
+	f, err := newPeriodFilter(map[string]*timeperiodConfig{
+		"workhours": {Timezone: "UTC", Days: map[string]string{"monday-friday": "09:00-18:00"}},
+		"dropped":   {Timezone: "UTC", Policy: "drop", Days: map[string]string{"monday-friday": "09:00-18:00"}},
+	}, "")
+	if err != nil {
+		t.Fatalf("newPeriodFilter returned: %s", err)
+	}
+	night := time.Date(2017, 1, 30, 2, 0, 0, 0, time.UTC)
+	morning := time.Date(2017, 1, 30, 9, 0, 0, 0, time.UTC)
+	workhours := map[string]interface{}{"notificationPeriod": "workhours"}
+
+	if !f.allow(&notification{host: "web01", service: "apache", state: 2}, night) {
+		t.Errorf("Checks without notification period should always be notified")
+	}
+	if !f.allow(&notification{host: "web01", service: "apache", state: 2, custom: map[string]interface{}{"notificationPeriod": "nonExisting"}}, night) {
+		t.Errorf("Checks with an unknown notification period should be notified")
+	}
+	if f.allow(&notification{host: "web01", service: "apache", state: 2, custom: map[string]interface{}{"notificationPeriod": "dropped"}}, night) {
+		t.Errorf("Checks outside of their notification period should not be notified")
+	}
+
+	// web01 goes critical then warning, db01 goes critical and recovers
+	f.allow(&notification{host: "web01", service: "apache", state: 2, previousState: 0, custom: workhours}, night)
+	web01 := &notification{host: "web01", service: "apache", state: 1, previousState: 2, custom: workhours}
+	f.allow(web01, night)
+	f.allow(&notification{host: "db01", service: "disk", state: 2, previousState: 0, custom: workhours}, night)
+	f.allow(&notification{host: "db01", service: "disk", state: 0, previousState: 2, custom: workhours}, night)
+
+	if released := f.release(night.Add(time.Hour)); len(released) != 0 {
+		t.Errorf("Nothing should be released outside of the period. Got %v", released)
+	}
+	released := f.release(morning)
+	if !reflect.DeepEqual(released, []*notification{web01}) {
+		t.Fatalf("Only the last state change of web01 should be released. Got %v", released)
+	}
+	if released[0].previousState != 0 {
+		t.Errorf("The released state change should be relative to the state before the period. Got %d", released[0].previousState)
+	}
+	if len(f.pending) != 0 {
+		t.Errorf("Nothing should be pending after the release")
+	}
+	if !f.allow(&notification{host: "web01", service: "apache", state: 0, custom: workhours}, morning) {
+		t.Errorf("Checks inside of their notification period should be notified")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nrdpCheckResult is a check result in the format sent by the NRDP clients.
+// Host check results have no service name
+type nrdpCheckResult struct {
+	Type        string `xml:"type,attr"`
+	HostName    string `xml:"hostname"`
+	ServiceName string `xml:"servicename"`
+	State       string `xml:"state"`
+	Output      string `xml:"output"`
+	Time        string `xml:"time"`
+}
+
+// nrdpXMLCheckResults is the XMLDATA document of the NRDP clients
+type nrdpXMLCheckResults struct {
+	XMLName      xml.Name          `xml:"checkresults"`
+	CheckResults []nrdpCheckResult `xml:"checkresult"`
+}
+
+// nrdpJSONCheckResults is the JSONDATA document of the NRDP clients. The
+// numbers can be sent either as JSON numbers or strings
+type nrdpJSONCheckResults struct {
+	CheckResults []struct {
+		CheckResult struct {
+			Type string `json:"type"`
+		} `json:"checkresult"`
+		HostName    string      `json:"hostname"`
+		ServiceName string      `json:"servicename"`
+		State       interface{} `json:"state"`
+		Output      string      `json:"output"`
+		Time        interface{} `json:"time"`
+	} `json:"checkresults"`
+}
+
+// nrdpResult is the response of the NRDP server
+type nrdpResult struct {
+	XMLName xml.Name  `xml:"result" json:"-"`
+	Status  int       `xml:"status" json:"status"`
+	Message string    `xml:"message" json:"message"`
+	Meta    *nrdpMeta `xml:"meta,omitempty" json:"meta,omitempty"`
+}
+
+// nrdpMeta is the additional output of a successful NRDP command
+type nrdpMeta struct {
+	Output string `xml:"output" json:"output"`
+}
+
+// jsonScalarString returns the string value of a JSON number or string
+func jsonScalarString(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// parseNRDPCheckResults parses the check results sent as XML or JSON
+func parseNRDPCheckResults(xmlData, jsonData string) ([]nrdpCheckResult, error) {
+	if xmlData != "" {
+		var doc nrdpXMLCheckResults
+		if err := xml.Unmarshal([]byte(xmlData), &doc); err != nil {
+			return nil, fmt.Errorf("BAD XML")
+		}
+		return doc.CheckResults, nil
+	}
+	var doc nrdpJSONCheckResults
+	if err := json.Unmarshal([]byte(jsonData), &doc); err != nil {
+		return nil, fmt.Errorf("BAD JSON")
+	}
+	results := make([]nrdpCheckResult, len(doc.CheckResults))
+	for i, cr := range doc.CheckResults {
+		results[i] = nrdpCheckResult{
+			Type:        cr.CheckResult.Type,
+			HostName:    cr.HostName,
+			ServiceName: cr.ServiceName,
+			State:       jsonScalarString(cr.State),
+			Output:      cr.Output,
+			Time:        jsonScalarString(cr.Time),
+		}
+	}
+	return results, nil
+}
+
+// packet turns an NRDP check result into the packet handled by the cache
+// worker. The host check results keep an empty service name like the NSCA
+// host check packets
+func (cr *nrdpCheckResult) packet(now time.Time) (*nsca.DataPacket, error) {
+	if strings.TrimSpace(cr.HostName) == "" {
+		return nil, fmt.Errorf("missing hostname")
+	}
+	service := strings.TrimSpace(cr.ServiceName)
+	if cr.Type != "host" && service == "" {
+		return nil, fmt.Errorf("missing servicename for %s", cr.HostName)
+	}
+	if cr.Type == "host" {
+		service = ""
+	}
+	state, err := strconv.ParseInt(strings.TrimSpace(cr.State), 10, 16)
+	if err != nil || state < 0 || state > 3 {
+		return nil, fmt.Errorf("invalid state '%s' for %s/%s", cr.State, cr.HostName, service)
+	}
+	p := &nsca.DataPacket{HostName: strings.TrimSpace(cr.HostName), Service: service, State: int16(state), PluginOutput: cr.Output, Timestamp: uint32(now.Unix())}
+	if ts, err := strconv.ParseUint(strings.TrimSpace(cr.Time), 10, 32); err == nil {
+		p.Timestamp = uint32(ts)
+	}
+	return p, nil
+}
+
+// writeNRDPResult writes the response in the output type requested by the
+// client: XML by default or JSON
+func writeNRDPResult(w http.ResponseWriter, r *http.Request, result *nrdpResult) {
+	if r.FormValue("outputtype") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]*nrdpResult{"result": result})
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	out, _ := xml.MarshalIndent(result, "", "  ")
+	fmt.Fprintf(w, "%s%s\n", xml.Header, out)
+}
+
+// nrdpHandler implements the submitcheck command of the NRDP server protocol so
+// that the NRDP clients (send_nrdp.sh, send_nrdp.py) can submit their check
+// results to nscapi. Like NRDP, the errors are reported in the response with a
+// 200 status code. The tokens are the ones accepted by /api/results
+func nrdpHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	switch {
+	case token == "":
+		writeNRDPResult(w, r, &nrdpResult{Status: -1, Message: "NO TOKEN"})
+		return
+	case !validResultsToken(token):
+		writeNRDPResult(w, r, &nrdpResult{Status: -1, Message: "BAD TOKEN"})
+		return
+	case r.FormValue("cmd") == "":
+		writeNRDPResult(w, r, &nrdpResult{Status: -1, Message: "NO COMMAND"})
+		return
+	case r.FormValue("cmd") != "submitcheck":
+		writeNRDPResult(w, r, &nrdpResult{Status: -1, Message: "NO REQUEST HANDLER"})
+		return
+	}
+
+	xmlData := r.FormValue("XMLDATA")
+	if xmlData == "" {
+		xmlData = r.FormValue("xml")
+	}
+	jsonData := r.FormValue("JSONDATA")
+	if jsonData == "" {
+		jsonData = r.FormValue("json")
+	}
+	if xmlData == "" && jsonData == "" {
+		writeNRDPResult(w, r, &nrdpResult{Status: -1, Message: "NO DATA"})
+		return
+	}
+	results, err := parseNRDPCheckResults(xmlData, jsonData)
+	if err != nil {
+		writeNRDPResult(w, r, &nrdpResult{Status: -1, Message: err.Error()})
+		return
+	}
+
+	now := time.Now()
+	processed := 0
+	var errs []string
+	for i := range results {
+		p, err := results[i].packet(now)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		queueResult(p, "nrdp")
+		processed++
+	}
+	output := fmt.Sprintf("%d checks processed.", processed)
+	if len(errs) > 0 {
+		output += fmt.Sprintf(" %d checks rejected: %s.", len(errs), strings.Join(errs, ", "))
+	}
+	writeNRDPResult(w, r, &nrdpResult{Status: 0, Message: "OK", Meta: &nrdpMeta{Output: output}})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNRDPHandler(t *testing.T) {
+	resultsTokens = []string{"secret"}
+	defer func() { resultsTokens = nil }()
+
+	cases := []struct {
+		name    string
+		form    url.Values
+		status  int
+		message string
+		output  string
+		packets []nsca.DataPacket
+	}{
+		{"xml", url.Values{"token": {"secret"}, "cmd": {"submitcheck"}, "XMLDATA": {`<?xml version='1.0'?>
+<checkresults>
+  <checkresult type='service' checktype='1'>
+    <hostname>web01</hostname>
+    <servicename>apache</servicename>
+    <state>2</state>
+    <output>CRITICAL - down|time=1s</output>
+    <time>1484527962</time>
+  </checkresult>
+  <checkresult type='host' checktype='1'>
+    <hostname>web02</hostname>
+    <state>0</state>
+    <output>PING OK</output>
+    <time>1484527963</time>
+  </checkresult>
+  <checkresult type='service'>
+    <hostname>web03</hostname>
+    <servicename>apache</servicename>
+    <state>9</state>
+  </checkresult>
+</checkresults>`}}, 0, "OK", "2 checks processed. 1 checks rejected: invalid state '9' for web03/apache.",
+			[]nsca.DataPacket{
+				{HostName: "web01", Service: "apache", State: 2, PluginOutput: "CRITICAL - down|time=1s", Timestamp: 1484527962},
+				{HostName: "web02", Service: "", State: 0, PluginOutput: "PING OK", Timestamp: 1484527963},
+			}},
+		{"json", url.Values{"token": {"secret"}, "cmd": {"submitcheck"}, "JSONDATA": {`{"checkresults": [
+			{"checkresult": {"type": "service", "checktype": "1"}, "hostname": "db01", "servicename": "mysql", "state": "1", "output": "WARNING - slow", "time": "1484527964"},
+			{"checkresult": {"type": "service"}, "hostname": "db02", "servicename": "mysql", "state": 3, "output": "UNKNOWN", "time": 1484527965},
+			{"checkresult": {"type": "service"}, "hostname": "db03", "state": 0}
+		]}`}}, 0, "OK", "2 checks processed. 1 checks rejected: missing servicename for db03.",
+			[]nsca.DataPacket{
+				{HostName: "db01", Service: "mysql", State: 1, PluginOutput: "WARNING - slow", Timestamp: 1484527964},
+				{HostName: "db02", Service: "mysql", State: 3, PluginOutput: "UNKNOWN", Timestamp: 1484527965},
+			}},
+		{"no token", url.Values{"cmd": {"submitcheck"}, "xml": {"<checkresults/>"}}, -1, "NO TOKEN", "", nil},
+		{"bad token", url.Values{"token": {"wrong"}, "cmd": {"submitcheck"}, "xml": {"<checkresults/>"}}, -1, "BAD TOKEN", "", nil},
+		{"no command", url.Values{"token": {"secret"}, "xml": {"<checkresults/>"}}, -1, "NO COMMAND", "", nil},
+		{"unknown command", url.Values{"token": {"secret"}, "cmd": {"submitcmd"}}, -1, "NO REQUEST HANDLER", "", nil},
+		{"no data", url.Values{"token": {"secret"}, "cmd": {"submitcheck"}}, -1, "NO DATA", "", nil},
+		{"bad xml", url.Values{"token": {"secret"}, "cmd": {"submitcheck"}, "xml": {"<checkresults>"}}, -1, "BAD XML", "", nil},
+		{"bad json", url.Values{"token": {"secret"}, "cmd": {"submitcheck"}, "json": {"{"}}, -1, "BAD JSON", "", nil},
+	}
+	for _, tt := range cases {
+		q = lfc.NewQueue()
+		req := httptest.NewRequest("POST", "/nrdp/", strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		nrdpHandler(w, req)
+		var resp struct {
+			Status  int    `xml:"status"`
+			Message string `xml:"message"`
+			Output  string `xml:"meta>output"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: invalid XML response %q: %s", tt.name, w.Body.String(), err)
+			continue
+		}
+		if resp.Status != tt.status || resp.Message != tt.message || resp.Output != tt.output {
+			t.Errorf("%s: unexpected response %+v", tt.name, resp)
+		}
+		if q.Len() != len(tt.packets) {
+			t.Errorf("%s: expecting %d results in the queue. Got %d", tt.name, len(tt.packets), q.Len())
+		}
+		for _, expected := range tt.packets {
+			item, _ := q.Dequeue()
+			if p := item.(*queuedPacket).packet; !reflect.DeepEqual(*p, expected) {
+				t.Errorf("%s: expecting %+v in the queue. Got %+v", tt.name, expected, *p)
+			}
+		}
+	}
+}
+
+func TestNRDPHandlerJSONOutput(t *testing.T) {
+	resultsTokens = []string{"secret"}
+	defer func() { resultsTokens = nil }()
+	q = lfc.NewQueue()
+	w := httptest.NewRecorder()
+	nrdpHandler(w, httptest.NewRequest("GET", "/nrdp/?token=secret&cmd=submitcheck&outputtype=json&json="+url.QueryEscape(`{"checkresults":[{"checkresult":{"type":"service"},"hostname":"web01","servicename":"apache","state":0,"output":"OK"}]}`), nil))
+	var resp map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON response %q: %s", w.Body.String(), err)
+	}
+	expected := map[string]interface{}{"status": 0.0, "message": "OK", "meta": map[string]interface{}{"output": "1 checks processed."}}
+	if !reflect.DeepEqual(resp["result"], expected) {
+		t.Errorf("Expecting %v. Got %v", expected, resp["result"])
+	}
+	item, ok := q.Dequeue()
+	if !ok {
+		t.Fatal("Expecting a result in the queue")
+	}
+	if p := item.(*queuedPacket).packet; p.Timestamp == 0 {
+		t.Error("The timestamp should default to the current time")
+	}
+}
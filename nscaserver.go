@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Reasons for which the NSCA packets are dropped by the NSCA library before
+// reaching queueData, used as label of nscapi_nsca_packets_rejected_total
+const (
+	nscaRejectedCRC     = "crc"
+	nscaRejectedDecrypt = "decrypt"
+	nscaRejectedRead    = "read"
+)
+
+// nscaRejectReason classifies the error returned by the NSCA library for a
+// connection whose packet never reached the packet handler. The library
+// reports the CRC mismatches, which is how a wrong password or encryption
+// method shows up, the other errors on a complete packet being decryption
+// failures
+func nscaRejectReason(err error) string {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nscaRejectedRead
+	}
+	if _, ok := err.(net.Error); ok {
+		return nscaRejectedRead
+	}
+	if strings.Contains(strings.ToLower(err.Error()), "crc") {
+		return nscaRejectedCRC
+	}
+	return nscaRejectedDecrypt
+}
+
+// nscaConn counts the bytes received on an NSCA connection
+type nscaConn struct {
+	net.Conn
+	received int64
+}
+
+// Read reads from the connection, counting the bytes received
+func (c *nscaConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received += int64(n)
+	return n, err
+}
+
+// nscaConnRejection returns the reason for which the packet of a connection
+// served by the NSCA library is counted as rejected, empty when it is not. The
+// connections closed without sending anything, like the TCP health checks of
+// the load balancers, are not counted
+func nscaConnRejection(err error, handled bool, received int64) string {
+	if err == nil || handled {
+		return ""
+	}
+	if received == 0 && nscaRejectReason(err) == nscaRejectedRead {
+		return ""
+	}
+	return nscaRejectReason(err)
+}
+
+// handleNSCAClient serves an NSCA connection with the library, counting the
+// packets it drops. The packet handler is wrapped to know whether the packet
+// made it through the decryption and the CRC check
+func handleNSCAClient(conf *nsca.Config, conn net.Conn) {
+	defer conn.Close()
+	handled := false
+	connConf := *conf
+	connConf.PacketHandler = func(p *nsca.DataPacket) error {
+		handled = true
+		return conf.PacketHandler(p)
+	}
+	c := &nscaConn{Conn: conn}
+	err := nsca.HandleClient(&connConf, c)
+	if reason := nscaConnRejection(err, handled, c.received); reason != "" {
+		nscaPacketsRejected.inc(reason)
+		log.Printf("Dropping the NSCA packet from %s (%s): %s", conn.RemoteAddr(), reason, err)
+	}
+}
+
+// serveNSCA accepts the NSCA connections. It replaces nsca.StartServer, which
+// gives no feedback on the packets it drops
+func serveNSCA(conf *nsca.Config) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(conf.Host, fmt.Sprint(conf.Port)))
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&nscaListening, 1)
+	nscaPacketsRejected.declare(nscaRejectedCRC, nscaRejectedDecrypt, nscaRejectedRead)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleNSCAClient(conf, conn)
+	}
+}
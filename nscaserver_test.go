@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestNscaConnRejection(t *testing.T) {
+	cases := []struct {
+		err      error
+		handled  bool
+		received int64
+		reason   string
+	}{
+		{nil, true, 720, ""},
+		{errors.New("queue full"), true, 720, ""},
+		// Health check connecting and closing without sending anything
+		{io.EOF, false, 0, ""},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, false, 0, ""},
+		{io.ErrUnexpectedEOF, false, 100, nscaRejectedRead},
+		{errors.New("Dropping packet with invalid CRC32"), false, 720, nscaRejectedCRC},
+		{errors.New("unable to decrypt the packet"), false, 0, nscaRejectedDecrypt},
+	}
+	for _, tt := range cases {
+		if reason := nscaConnRejection(tt.err, tt.handled, tt.received); reason != tt.reason {
+			t.Errorf("nscaConnRejection(%v, %t, %d) should return %q, not %q", tt.err, tt.handled, tt.received, tt.reason, reason)
+		}
+	}
+}
+
+func TestNscaRejectReason(t *testing.T) {
+	cases := []struct {
+		err    error
+		reason string
+	}{
+		{errors.New("Dropping packet with invalid CRC32 - possibly due to client using wrong password or crypto algorithm?"), nscaRejectedCRC},
+		{errors.New("crc mismatch"), nscaRejectedCRC},
+		{errors.New("unable to decrypt the packet"), nscaRejectedDecrypt},
+		{io.EOF, nscaRejectedRead},
+		{io.ErrUnexpectedEOF, nscaRejectedRead},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}, nscaRejectedRead},
+	}
+	for _, tt := range cases {
+		if reason := nscaRejectReason(tt.err); reason != tt.reason {
+			t.Errorf("nscaRejectReason(%q) should return %s, not %s", tt.err, tt.reason, reason)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// perfdataValueRegexp splits the value of a performance data from its unit of
+// measurement
+var perfdataValueRegexp = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)([a-zA-Z%/]*)$`)
+
+// perfdataEntry is a performance data as defined in the Nagios plugin
+// guidelines: 'label'=value[UOM];[warn];[crit];[min];[max]. The missing
+// numbers and the undetermined value "U" are NaN. Warn and crit are kept as
+// strings as they can be ranges such as "@10:20"
+type perfdataEntry struct {
+	label string
+	value float64
+	uom   string
+	warn  string
+	crit  string
+	min   float64
+	max   float64
+}
+
+// splitPluginOutput splits a plugin output into its short text (first line),
+// its long text (next lines) and its performance data, following the Nagios
+// plugin guidelines:
+//
+//	TEXT OUTPUT | OPTIONAL PERFDATA
+//	LONG TEXT LINE 1
+//	LONG TEXT LINE 2 | PERFDATA LINE 2
+//	PERFDATA LINE 3
+func splitPluginOutput(output string) (text, longText, perfdata string) {
+	lines := strings.Split(output, "\n")
+	var perf, long []string
+	parts := strings.SplitN(lines[0], "|", 2)
+	text = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		perf = append(perf, strings.TrimSpace(parts[1]))
+	}
+	inPerfdata := false
+	for _, line := range lines[1:] {
+		if inPerfdata {
+			perf = append(perf, strings.TrimSpace(line))
+			continue
+		}
+		parts = strings.SplitN(line, "|", 2)
+		long = append(long, parts[0])
+		if len(parts) == 2 {
+			perf = append(perf, strings.TrimSpace(parts[1]))
+			inPerfdata = true
+		}
+	}
+	longText = strings.TrimSpace(strings.Join(long, "\n"))
+	perfdata = strings.TrimSpace(strings.Join(perf, " "))
+	return text, longText, perfdata
+}
+
+// parsePerfdataFloat parses an optional number of a performance data
+func parsePerfdataFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return f
+}
+
+// parsePerfdata parses the space-separated performance data. The labels can be
+// quoted with single quotes to contain spaces or equal signs, two single
+// quotes standing for a quote in the label. Invalid entries are skipped
+func parsePerfdata(perfdata string) []perfdataEntry {
+	var entries []perfdataEntry
+	i := 0
+	for i < len(perfdata) {
+		if perfdata[i] == ' ' || perfdata[i] == '\t' || perfdata[i] == '\n' {
+			i++
+			continue
+		}
+		var label string
+		if perfdata[i] == '\'' {
+			var b strings.Builder
+			i++
+			for i < len(perfdata) {
+				if perfdata[i] == '\'' {
+					if i+1 < len(perfdata) && perfdata[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(perfdata[i])
+				i++
+			}
+			label = b.String()
+		} else {
+			start := i
+			for i < len(perfdata) && perfdata[i] != '=' && perfdata[i] != ' ' {
+				i++
+			}
+			label = perfdata[start:i]
+		}
+		start := i
+		for i < len(perfdata) && perfdata[i] != ' ' && perfdata[i] != '\t' && perfdata[i] != '\n' {
+			i++
+		}
+		if label == "" || start >= len(perfdata) || perfdata[start] != '=' {
+			continue
+		}
+		fields := strings.Split(perfdata[start+1:i], ";")
+		entry := perfdataEntry{label: label, value: math.NaN(), min: math.NaN(), max: math.NaN()}
+		if fields[0] != "U" {
+			m := perfdataValueRegexp.FindStringSubmatch(fields[0])
+			if m == nil {
+				continue
+			}
+			entry.value, _ = strconv.ParseFloat(m[1], 64)
+			entry.uom = m[2]
+		}
+		if len(fields) > 1 {
+			entry.warn = fields[1]
+		}
+		if len(fields) > 2 {
+			entry.crit = fields[2]
+		}
+		if len(fields) > 3 {
+			entry.min = parsePerfdataFloat(fields[3])
+		}
+		if len(fields) > 4 {
+			entry.max = parsePerfdataFloat(fields[4])
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// jsonFloat returns nil for NaN as it cannot be represented in JSON
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+// perfdataTemplateData returns the performance data as used by the templates.
+// The missing numbers are nil
+func perfdataTemplateData(entries []perfdataEntry) []map[string]interface{} {
+	data := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		data[i] = map[string]interface{}{
+			"label": e.label,
+			"value": jsonFloat(e.value),
+			"uom":   e.uom,
+			"warn":  e.warn,
+			"crit":  e.crit,
+			"min":   jsonFloat(e.min),
+			"max":   jsonFloat(e.max),
+		}
+	}
+	return data
+}
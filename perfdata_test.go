@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPluginOutput(t *testing.T) {
+	cases := []struct {
+		output, text, longText, perfdata string
+	}{
+		{"OK", "OK", "", ""},
+		{"OK - load 0.5|load1=0.5;4;8;0", "OK - load 0.5", "", "load1=0.5;4;8;0"},
+		{"DISK OK\n/ 10% used\n/var 20% used", "DISK OK", "/ 10% used\n/var 20% used", ""},
+		// Full example of the Nagios plugin guidelines
+		{"DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n/ 15272 MB (77%);\n/boot 68 MB (69%);\n/home 69357 MB (27%);\n/var/log 819 MB (84%); | /boot=68MB;88;93;0;98\n/home=69357MB;253404;253409;0;253414\n/var/log=818MB;970;975;0;980",
+			"DISK OK - free space: / 3326 MB (56%);",
+			"/ 15272 MB (77%);\n/boot 68 MB (69%);\n/home 69357 MB (27%);\n/var/log 819 MB (84%);",
+			"/=2643MB;5948;5958;0;5968 /boot=68MB;88;93;0;98 /home=69357MB;253404;253409;0;253414 /var/log=818MB;970;975;0;980"},
+	}
+	for _, tt := range cases {
+		text, longText, perfdata := splitPluginOutput(tt.output)
+		if text != tt.text || longText != tt.longText || perfdata != tt.perfdata {
+			t.Errorf("splitPluginOutput(%q) should return (%q, %q, %q), not (%q, %q, %q)", tt.output, tt.text, tt.longText, tt.perfdata, text, longText, perfdata)
+		}
+	}
+}
+
+func TestParsePerfdata(t *testing.T) {
+	nan := math.NaN()
+	cases := []struct {
+		perfdata string
+		expected []perfdataEntry
+	}{
+		{"", nil},
+		{"load1=0.5;4;8;0", []perfdataEntry{{"load1", 0.5, "", "4", "8", 0, nan}}},
+		{"time=0.012s;;;0.000000 size=1234B;;;0", []perfdataEntry{{"time", 0.012, "s", "", "", 0, nan}, {"size", 1234, "B", "", "", 0, nan}}},
+		{"'disk usage /var'=85%;80;90;0;100 'it''s'=U", []perfdataEntry{{"disk usage /var", 85, "%", "80", "90", 0, 100}, {"it's", nan, "", "", "", nan, nan}}},
+		{"rta=-1.5e2ms;@10:20;~:30", []perfdataEntry{{"rta", -150, "ms", "@10:20", "~:30", nan, nan}}},
+		{"counter=42c", []perfdataEntry{{"counter", 42, "c", "", "", nan, nan}}},
+		// Invalid entries are skipped
+		{"novalue invalid=abc =5 ok=1", []perfdataEntry{{"ok", 1, "", "", "", nan, nan}}},
+	}
+	for _, tt := range cases {
+		entries := parsePerfdata(tt.perfdata)
+		if len(entries) != len(tt.expected) {
+			t.Errorf("parsePerfdata(%q) should return %v, not %v", tt.perfdata, tt.expected, entries)
+			continue
+		}
+		for i := range entries {
+			// NaN are not equal to each other so they are compared through the
+			// template data
+			if !reflect.DeepEqual(perfdataTemplateData(entries[i:i+1]), perfdataTemplateData(tt.expected[i:i+1])) {
+				t.Errorf("parsePerfdata(%q) entry #%d should be %v, not %v", tt.perfdata, i, tt.expected[i], entries[i])
+			}
+		}
+	}
+}
+
+func TestPerfdataTemplateData(t *testing.T) {
+	data := perfdataTemplateData([]perfdataEntry{{"load1", 0.5, "", "4", "8", 0, math.NaN()}})
+	expected := []map[string]interface{}{{"label": "load1", "value": 0.5, "uom": "", "warn": "4", "crit": "8", "min": 0.0, "max": nil}}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("perfdataTemplateData should return %v, not %v", expected, data)
+	}
+	if ToJSONString(data) != `[{"crit":"8","label":"load1","max":null,"min":0,"uom":"","value":0.5,"warn":"4"}]` {
+		t.Errorf("Wrong JSON for the performance data: %s", ToJSONString(data))
+	}
+}
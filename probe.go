@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// probeStatusCodes are the HTTP status codes returned by the probes for the
+// OK, Warning, Critical and Unknown states
+var probeStatusCodes = [4]int{http.StatusOK, http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+
+// stateSeverity orders the states from the best to the worst to compute the
+// worst state of a hostgroup: OK, Warning, Unknown then Critical
+var stateSeverity = [4]int{0, 1, 3, 2}
+
+// parseProbeStatusCodes parses the comma-separated mapping of the states to
+// the HTTP status codes returned by the probes, such as
+// "ok=200,warning=429,critical=503,unknown=503". The states not listed keep
+// their default status code
+func parseProbeStatusCodes(mapping string) ([4]int, error) {
+	codes := probeStatusCodes
+	for _, pair := range strings.Split(mapping, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return codes, fmt.Errorf("invalid probe status code mapping '%s'", pair)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || code < 100 || code > 599 {
+			return codes, fmt.Errorf("invalid HTTP status code in '%s'", pair)
+		}
+		found := false
+		for state := int16(0); state < 4; state++ {
+			if strings.EqualFold(strings.TrimSpace(parts[0]), statusString(state)) {
+				codes[state] = code
+				found = true
+			}
+		}
+		if !found {
+			return codes, fmt.Errorf("invalid state in '%s'", pair)
+		}
+	}
+	return codes, nil
+}
+
+// probeStatusCode returns the HTTP status code of a state, the states out of
+// range being considered as Unknown
+func probeStatusCode(state int16) int {
+	return probeStatusCodes[clampState(state)]
+}
+
+// probeHostState returns the check state used to probe a host state: the
+// hosts DOWN or UNREACHABLE are Critical
+func probeHostState(state int16) int16 {
+	if state == 0 {
+		return 0
+	}
+	return 2
+}
+
+// probeHandler takes care of the paths /probe/{host}/{service} and
+// /probe/{host} that return the state of a check or of a host check as an
+// HTTP status code, for the tools that can only check status codes. The
+// hostgroups have their own prefix so that no host name is shadowed
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/probe/"), "/", 2)
+	if parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		http.Error(w, "Usage: /probe/{host}/{service} or /probe/{host}", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(parts) == 1 {
+		probeHost(w, parts[0])
+		return
+	}
+	cacheLock.RLock()
+	entry, ok := cache[parts[0]][parts[1]]
+	var state int16
+	var output string
+	if ok {
+		state, output = entry.state, entry.shortOutput
+	}
+	cacheLock.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("No result for %s/%s", parts[0], parts[1]), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(probeStatusCode(state))
+	fmt.Fprintf(w, "%s: %s\n", statusString(state), output)
+}
+
+// probeHost writes the state of the host check of a host
+func probeHost(w http.ResponseWriter, host string) {
+	cacheLock.RLock()
+	entry, ok := hostCache[host]
+	var state int16
+	var output string
+	if ok {
+		state, output = entry.state, entry.shortOutput
+	}
+	cacheLock.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("No host check result for %s", host), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(probeStatusCode(probeHostState(state)))
+	fmt.Fprintf(w, "%s: %s\n", hostStatusString(state), output)
+}
+
+// probeHostgroupHandler takes care of the path /probe-hostgroup/{hostgroup}
+// that returns the worst state of the checks of a hostgroup as an HTTP status
+// code
+func probeHostgroupHandler(w http.ResponseWriter, r *http.Request) {
+	hostgroup := strings.TrimPrefix(r.URL.Path, "/probe-hostgroup/")
+	if hostgroup == "" || strings.Contains(hostgroup, "/") {
+		http.Error(w, "Usage: /probe-hostgroup/{hostgroup}", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	probeHostgroup(w, hostgroup)
+}
+
+// probeHostgroup writes the worst state of the checks of the hosts of the
+// hostgroup followed by the checks that are not OK. The hosts DOWN or
+// UNREACHABLE make the hostgroup Critical
+func probeHostgroup(w http.ResponseWriter, hostgroup string) {
+	var worst int16
+	var problems []string
+	checks := 0
+	cacheLock.RLock()
+	for host, svcs := range cache {
+		if hostgroupOf(host) != hostgroup {
+			continue
+		}
+		if entry, ok := hostCache[host]; ok {
+			checks++
+			if entry.state != 0 {
+				problems = append(problems, fmt.Sprintf("%s %s: %s", host, hostStatusString(entry.state), entry.shortOutput))
+				if state := probeHostState(entry.state); stateSeverity[state] > stateSeverity[worst] {
+					worst = state
+				}
+			}
+		}
+		for svc, entry := range svcs {
+			checks++
+			if entry.state == 0 {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("%s/%s %s: %s", host, svc, statusString(entry.state), entry.shortOutput))
+			if state := clampState(entry.state); stateSeverity[state] > stateSeverity[worst] {
+				worst = state
+			}
+		}
+	}
+	cacheLock.RUnlock()
+	if checks == 0 {
+		http.Error(w, fmt.Sprintf("No result for the hostgroup %s", hostgroup), http.StatusNotFound)
+		return
+	}
+	sort.Strings(problems)
+	w.WriteHeader(probeStatusCode(worst))
+	fmt.Fprintf(w, "%s: %d of %d checks not OK\n", statusString(worst), len(problems), checks)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+}
+
+// clampState considers the states out of range as Unknown
+func clampState(state int16) int16 {
+	if state < 0 || state > 3 {
+		return 3
+	}
+	return state
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseProbeStatusCodes(t *testing.T) {
+	cases := []struct {
+		mapping  string
+		expected [4]int
+		err      bool
+	}{
+		{"", [4]int{200, 429, 503, 503}, false},
+		{"ok=200,warning=429,critical=503,unknown=503", [4]int{200, 429, 503, 503}, false},
+		{"Warning=200, critical=500", [4]int{200, 200, 500, 503}, false},
+		{"warning", [4]int{}, true},
+		{"warning=abc", [4]int{}, true},
+		{"warning=42", [4]int{}, true},
+		{"degraded=500", [4]int{}, true},
+	}
+	for _, tt := range cases {
+		codes, err := parseProbeStatusCodes(tt.mapping)
+		if (err != nil) != tt.err {
+			t.Errorf("Unexpected error for %q: %v", tt.mapping, err)
+			continue
+		}
+		if !tt.err && codes != tt.expected {
+			t.Errorf("Expecting %v for %q. Got %v", tt.expected, tt.mapping, codes)
+		}
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	initCache()
+	updateCacheEntry("web01", "apache", "OK - running|time=0.1s", 1484527962, 0)
+	updateCacheEntry("web01", "Disk /var", "DISK WARNING - 85% used", 1484527962, 1)
+	updateCacheEntry("web02", "apache", "CRITICAL - down", 1484527962, 2)
+	updateCacheEntry("web02", "load", "UNKNOWN - no data", 1484527962, 3)
+	updateCacheEntry("db01", "mysql", "OK", 1484527962, 0)
+	updateCacheEntry("db01", "", "PING OK", 1484527962, 0)
+	updateCacheEntry("db02", "", "PING CRITICAL - 100% loss", 1484527962, 1)
+	updateCacheEntry("hostgroup", "web", "OK - running", 1484527962, 0)
+
+	cases := []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/probe/web01/apache", http.StatusOK, "OK: OK - running\n"},
+		{"/probe/web01/Disk%20/var", http.StatusTooManyRequests, "Warning: DISK WARNING - 85% used\n"},
+		{"/probe/web02/apache", http.StatusServiceUnavailable, "Critical: CRITICAL - down\n"},
+		{"/probe/web01/nonExisting", http.StatusNotFound, "No result for web01/nonExisting\n"},
+		{"/probe/db01", http.StatusOK, "Up: PING OK\n"},
+		{"/probe/db02", http.StatusServiceUnavailable, "Down: PING CRITICAL - 100% loss\n"},
+		{"/probe/web01", http.StatusNotFound, "No host check result for web01\n"},
+		{"/probe/web01/", http.StatusBadRequest, "Usage: /probe/{host}/{service} or /probe/{host}\n"},
+		{"/probe/", http.StatusBadRequest, "Usage: /probe/{host}/{service} or /probe/{host}\n"},
+		// A host can be named like a hostgroup probe
+		{"/probe/hostgroup/web", http.StatusOK, "OK: OK - running\n"},
+		{"/probe-hostgroup/db", http.StatusServiceUnavailable, "Critical: 1 of 3 checks not OK\n" +
+			"db02 Down: PING CRITICAL - 100% loss\n"},
+		{"/probe-hostgroup/web", http.StatusServiceUnavailable, "Critical: 3 of 4 checks not OK\n" +
+			"web01/Disk /var Warning: DISK WARNING - 85% used\n" +
+			"web02/apache Critical: CRITICAL - down\n" +
+			"web02/load Unknown: UNKNOWN - no data\n"},
+		{"/probe-hostgroup/nonExisting", http.StatusNotFound, "No result for the hostgroup nonExisting\n"},
+		{"/probe-hostgroup/", http.StatusBadRequest, "Usage: /probe-hostgroup/{hostgroup}\n"},
+		{"/probe-hostgroup/web/apache", http.StatusBadRequest, "Usage: /probe-hostgroup/{hostgroup}\n"},
+	}
+	mux := newAPIMux()
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: expecting status %d. Got %d", tt.path, tt.code, w.Code)
+		}
+		if w.Body.String() != tt.expected {
+			t.Errorf("%s: expecting body %q. Got %q", tt.path, tt.expected, w.Body.String())
+		}
+	}
+}
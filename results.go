@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resultsMaxBodySize is the maximum size of a request to /api/results
+const resultsMaxBodySize = 10 << 20
+
+// errRequestTooLarge is returned when a request is larger than
+// resultsMaxBodySize
+var errRequestTooLarge = fmt.Errorf("request larger than %d bytes", resultsMaxBodySize)
+
+// resultsTokens are the tokens accepted by /api/results, /nrdp and
+// /api/acknowledge. The endpoints reject every request when no token is
+// configured
+var resultsTokens []string
+
+// submittedResult is a check result submitted over HTTP
+type submittedResult struct {
+	Host      string  `json:"host"`
+	Service   string  `json:"service"`
+	State     *int16  `json:"state"`
+	Output    string  `json:"output"`
+	Timestamp *uint32 `json:"timestamp"`
+}
+
+// submittedResultStatus is the outcome of one of the submitted results
+type submittedResultStatus struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parseResultsTokens parses the comma-separated list of tokens
+func parseResultsTokens(list string) []string {
+	var tokens []string
+	for _, token := range strings.Split(list, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// validResultsToken returns whether the token is one of the accepted tokens
+func validResultsToken(token string) bool {
+	valid := false
+	for _, accepted := range resultsTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(accepted)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// authorizedResultsRequest returns whether the request carries one of the
+// accepted bearer tokens
+func authorizedResultsRequest(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") && validResultsToken(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// validate checks a submitted result and turns it into the packet handled by
+// the cache worker. The timestamp defaults to the given time. The results
+// without service are host checks, UP, DOWN or UNREACHABLE
+func (res *submittedResult) validate(now time.Time) (*nsca.DataPacket, error) {
+	switch {
+	case res.Host == "":
+		return nil, fmt.Errorf("host is required")
+	case res.State == nil:
+		return nil, fmt.Errorf("state is required")
+	case res.Service == "" && (*res.State < 0 || *res.State > 2):
+		return nil, fmt.Errorf("state of a host check must be between 0 and 2, got %d", *res.State)
+	case *res.State < 0 || *res.State > 3:
+		return nil, fmt.Errorf("state must be between 0 and 3, got %d", *res.State)
+	}
+	p := &nsca.DataPacket{HostName: res.Host, Service: res.Service, State: *res.State, PluginOutput: res.Output, Timestamp: uint32(now.Unix())}
+	if res.Timestamp != nil {
+		p.Timestamp = *res.Timestamp
+	}
+	return p, nil
+}
+
+// readResultsBody reads the body of a request, up to resultsMaxBodySize
+func readResultsBody(r *http.Request) ([]byte, error) {
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(io.LimitReader(r.Body, resultsMaxBodySize+1)); err != nil {
+		return nil, err
+	}
+	if body.Len() > resultsMaxBodySize {
+		return nil, errRequestTooLarge
+	}
+	return body.Bytes(), nil
+}
+
+// decodeSubmittedResults decodes a single result or a batch of results. Each
+// result is kept raw so that an invalid one does not reject the whole batch
+func decodeSubmittedResults(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		err := json.Unmarshal(body, &batch)
+		return batch, err
+	}
+	var single json.RawMessage
+	if err := json.Unmarshal(body, &single); err != nil {
+		return nil, err
+	}
+	return []json.RawMessage{single}, nil
+}
+
+// resultsHandler takes care of the path /api/results that accepts check
+// results submitted over HTTP as a single JSON object or a batch. The valid
+// results are fed into the same queue as the NSCA packets and the outcome of
+// each of them is reported. It only accepts authenticated POST requests
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizedResultsRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nscapi"`)
+		http.Error(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	body, err := readResultsBody(r)
+	if err == errRequestTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read the request: %s", err), http.StatusBadRequest)
+		return
+	}
+	raws, err := decodeSubmittedResults(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	accepted := 0
+	statuses := make([]submittedResultStatus, len(raws))
+	for i, raw := range raws {
+		statuses[i] = submittedResultStatus{Index: i, Status: "rejected"}
+		var res submittedResult
+		if err := json.Unmarshal(raw, &res); err != nil {
+			statuses[i].Error = fmt.Sprintf("invalid result: %s", err)
+			continue
+		}
+		p, err := res.validate(now)
+		if err != nil {
+			statuses[i].Error = err.Error()
+			continue
+		}
+		queueResult(p, "http")
+		statuses[i].Status = "accepted"
+		accepted++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if accepted == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accepted": accepted,
+		"rejected": len(raws) - accepted,
+		"results":  statuses,
+	})
+}
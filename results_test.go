@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResultsTokens(t *testing.T) {
+	if tokens := parseResultsTokens(" abc, ,def "); !reflect.DeepEqual(tokens, []string{"abc", "def"}) {
+		t.Errorf("Unexpected tokens: %v", tokens)
+	}
+	if tokens := parseResultsTokens(""); tokens != nil {
+		t.Errorf("Expecting no token. Got %v", tokens)
+	}
+}
+
+func TestResultsHandler(t *testing.T) {
+	resultsTokens = []string{"secret", "other"}
+	defer func() { resultsTokens = nil }()
+
+	cases := []struct {
+		name     string
+		method   string
+		token    string
+		body     string
+		code     int
+		statuses []submittedResultStatus
+		packets  []nsca.DataPacket
+	}{
+		{"single", "POST", "secret", `{"host": "web01", "service": "apache", "state": 2, "output": "CRITICAL - down", "timestamp": 1484527962}`,
+			http.StatusAccepted, []submittedResultStatus{{0, "accepted", ""}},
+			[]nsca.DataPacket{{HostName: "web01", Service: "apache", State: 2, PluginOutput: "CRITICAL - down", Timestamp: 1484527962}}},
+		{"batch with errors", "POST", "other", `[
+			{"host": "web01", "service": "apache", "state": 0, "output": "OK", "timestamp": 1484527962},
+			{"service": "apache", "state": 0},
+			{"host": "web01", "state": 0, "output": "PING OK", "timestamp": 1484527962},
+			{"host": "web01", "service": "apache"},
+			{"host": "web01", "service": "apache", "state": 4},
+			{"host": "web01", "service": "apache", "state": "OK"},
+			{"host": "db01", "service": "mysql", "state": 1, "output": "WARNING - slow", "timestamp": 1484527963}
+		]`,
+			http.StatusAccepted, []submittedResultStatus{
+				{0, "accepted", ""},
+				{1, "rejected", "host is required"},
+				{2, "accepted", ""},
+				{3, "rejected", "state is required"},
+				{4, "rejected", "state must be between 0 and 3, got 4"},
+				{5, "rejected", "invalid result: json: cannot unmarshal string into Go struct field submittedResult.state of type int16"},
+				{6, "accepted", ""},
+			},
+			[]nsca.DataPacket{
+				{HostName: "web01", Service: "apache", State: 0, PluginOutput: "OK", Timestamp: 1484527962},
+				{HostName: "web01", State: 0, PluginOutput: "PING OK", Timestamp: 1484527962},
+				{HostName: "db01", Service: "mysql", State: 1, PluginOutput: "WARNING - slow", Timestamp: 1484527963},
+			}},
+		{"all rejected", "POST", "secret", `[{"host": "web01"}, {"host": "web01", "service": "", "state": 3}]`,
+			http.StatusBadRequest, []submittedResultStatus{{0, "rejected", "state is required"}, {1, "rejected", "state of a host check must be between 0 and 2, got 3"}}, nil},
+		{"invalid JSON", "POST", "secret", `{"host": `, http.StatusBadRequest, nil, nil},
+		{"wrong token", "POST", "wrong", `{"host": "web01", "service": "apache", "state": 0}`, http.StatusUnauthorized, nil, nil},
+		{"no token", "POST", "", `{"host": "web01", "service": "apache", "state": 0}`, http.StatusUnauthorized, nil, nil},
+		{"GET", "GET", "secret", "", http.StatusMethodNotAllowed, nil, nil},
+	}
+	for _, tt := range cases {
+		q = lfc.NewQueue()
+		req := httptest.NewRequest(tt.method, "/api/results", strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		resultsHandler(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expecting status %d. Got %d: %s", tt.name, tt.code, w.Code, w.Body.String())
+			continue
+		}
+		if tt.statuses != nil {
+			var resp struct {
+				Accepted int                     `json:"accepted"`
+				Rejected int                     `json:"rejected"`
+				Results  []submittedResultStatus `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Errorf("%s: invalid response: %s", tt.name, err)
+			}
+			if !reflect.DeepEqual(resp.Results, tt.statuses) || resp.Accepted != len(tt.packets) || resp.Rejected != len(tt.statuses)-len(tt.packets) {
+				t.Errorf("%s: unexpected response %+v", tt.name, resp)
+			}
+		}
+		if q.Len() != len(tt.packets) {
+			t.Errorf("%s: expecting %d results in the queue. Got %d", tt.name, len(tt.packets), q.Len())
+		}
+		for _, expected := range tt.packets {
+			item, _ := q.Dequeue()
+			if p := item.(*queuedPacket).packet; !reflect.DeepEqual(*p, expected) {
+				t.Errorf("%s: expecting %+v in the queue. Got %+v", tt.name, expected, *p)
+			}
+		}
+	}
+}
+
+func TestResultsHandlerDefaultTimestamp(t *testing.T) {
+	resultsTokens = []string{"secret"}
+	defer func() { resultsTokens = nil }()
+	q = lfc.NewQueue()
+	req := httptest.NewRequest("POST", "/api/results", strings.NewReader(`{"host": "web01", "service": "apache", "state": 0}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	resultsHandler(w, req)
+	item, ok := q.Dequeue()
+	if !ok {
+		t.Fatal("Expecting a result in the queue")
+	}
+	if p := item.(*queuedPacket).packet; p.Timestamp == 0 {
+		t.Error("The timestamp should default to the current time")
+	}
+}
+
+func TestResultsHandlerWithoutTokens(t *testing.T) {
+	resultsTokens = nil
+	req := httptest.NewRequest("POST", "/api/results", strings.NewReader(`{"host": "web01", "service": "apache", "state": 0}`))
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	resultsHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expecting every submission to be rejected without tokens. Got %d", w.Code)
+	}
+}
+
+// failingReader fails every read, like a connection reset by the client
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestResultsHandlerBody(t *testing.T) {
+	resultsTokens = []string{"secret"}
+	defer func() { resultsTokens = nil }()
+	q = lfc.NewQueue()
+	cases := []struct {
+		name string
+		body io.Reader
+		code int
+	}{
+		{"too large", strings.NewReader(strings.Repeat(" ", resultsMaxBodySize) + `{"host": "web01", "service": "apache", "state": 0}`), http.StatusRequestEntityTooLarge},
+		{"read error", failingReader{}, http.StatusBadRequest},
+	}
+	for _, tt := range cases {
+		req := httptest.NewRequest("POST", "/api/results", tt.body)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		resultsHandler(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expecting status %d. Got %d: %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expecting no result in the queue. Got %d", q.Len())
+	}
+}
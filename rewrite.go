@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rewriteRulesPollInterval is the interval at which the rewrite rules file is
+// checked for changes
+var rewriteRulesPollInterval = 10 * time.Second
+
+// rewriteRules are the rules applied to the names of the check results before
+// they reach the cache. They are replaced as a whole when the file is reloaded
+var (
+	rewriteRulesLock sync.RWMutex
+	rewriteRules     []*rewriteRule
+)
+
+// rewriteConfig is the content of the rewrite rules file
+type rewriteConfig struct {
+	Rules []*rewriteRule `yaml:"rules"`
+}
+
+// rewriteRule rewrites the host or service names of the check results. The
+// rules are applied in order, each of them to the name rewritten by the
+// previous ones
+type rewriteRule struct {
+	// Field is the name the rule applies to: host, service or, when empty, both
+	Field string `yaml:"field"`
+	// Action is one of lowercase, strip_domain, replace, alias or drop
+	Action string `yaml:"action"`
+	// Domain is the suffix removed by strip_domain. Everything after the first
+	// dot is removed when empty, except for the IP addresses
+	Domain string `yaml:"domain"`
+	// Match is the regular expression replaced by replace or dropping the
+	// results for drop
+	Match string `yaml:"match"`
+	// Replacement can refer to the groups of Match ($1, ${name})
+	Replacement string `yaml:"replacement"`
+	// Aliases maps the names to their canonical name for alias
+	Aliases map[string]string `yaml:"aliases"`
+	re      *regexp.Regexp
+}
+
+// loadRewriteRules reads and checks the yaml rewrite rules file
+func loadRewriteRules(path string) ([]*rewriteRule, error) {
+	fc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &rewriteConfig{}
+	if err = yaml.Unmarshal(fc, conf); err != nil {
+		return nil, err
+	}
+	for i, rule := range conf.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rewrite rule %d is empty", i)
+		}
+		if rule.Field != "" && rule.Field != "host" && rule.Field != "service" {
+			return nil, fmt.Errorf("rewrite rule %d: invalid field '%s', expecting host or service", i, rule.Field)
+		}
+		switch rule.Action {
+		case "lowercase", "strip_domain":
+		case "alias":
+			if len(rule.Aliases) == 0 {
+				return nil, fmt.Errorf("rewrite rule %d: alias without aliases", i)
+			}
+		case "replace", "drop":
+			if rule.Match == "" {
+				return nil, fmt.Errorf("rewrite rule %d: %s without match", i, rule.Action)
+			}
+			if rule.re, err = regexp.Compile(rule.Match); err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: %s", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("rewrite rule %d: invalid action '%s'", i, rule.Action)
+		}
+	}
+	return conf.Rules, nil
+}
+
+// apply rewrites a name. It returns false when the result must be dropped
+func (rule *rewriteRule) apply(name string) (string, bool) {
+	switch rule.Action {
+	case "lowercase":
+		return strings.ToLower(name), true
+	case "strip_domain":
+		if rule.Domain != "" {
+			return strings.TrimSuffix(name, "."+strings.TrimPrefix(rule.Domain, ".")), true
+		}
+		if i := strings.Index(name, "."); i > 0 && net.ParseIP(name) == nil {
+			return name[:i], true
+		}
+	case "replace":
+		return rule.re.ReplaceAllString(name, rule.Replacement), true
+	case "alias":
+		if alias, ok := rule.Aliases[name]; ok {
+			return alias, true
+		}
+	case "drop":
+		return name, !rule.re.MatchString(name)
+	}
+	return name, true
+}
+
+// rewriteResult applies the rewrite rules to the host and service names of a
+// result. The empty service name of the host checks is never rewritten. It
+// returns false when the result is dropped by a rule or ends up without host
+// name
+func rewriteResult(p *nsca.DataPacket) bool {
+	rewriteRulesLock.RLock()
+	rules := rewriteRules
+	rewriteRulesLock.RUnlock()
+	kept := true
+	for _, rule := range rules {
+		if rule.Field != "service" {
+			if p.HostName, kept = rule.apply(p.HostName); !kept {
+				break
+			}
+		}
+		if rule.Field != "host" && p.Service != "" {
+			if p.Service, kept = rule.apply(p.Service); !kept {
+				break
+			}
+		}
+	}
+	if !kept || p.HostName == "" {
+		resultsRejected.inc(rejectedRewrite)
+		return false
+	}
+	return true
+}
+
+// watchRewriteRules reloads the rewrite rules whenever the modification time
+// or the size of the file changes. The previous rules are kept when the new
+// file is invalid
+func watchRewriteRules(path string, loaded os.FileInfo, stop <-chan struct{}) {
+	poll := rewriteRulesPollInterval
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(poll):
+		}
+		loaded = reloadRewriteRules(path, loaded)
+	}
+}
+
+// reloadRewriteRules reloads the rewrite rules if the file changed since it
+// was loaded with the given file info. It returns the file info of the file
+// now considered as loaded
+func reloadRewriteRules(path string, loaded os.FileInfo) os.FileInfo {
+	fi, err := os.Stat(path)
+	if err != nil || (fi.ModTime().Equal(loaded.ModTime()) && fi.Size() == loaded.Size()) {
+		return loaded
+	}
+	rules, err := loadRewriteRules(path)
+	if err != nil {
+		rewriteRulesReloads.inc("failure")
+		log.Printf("Keeping the previous rewrite rules, unable to reload %s: %s", path, err)
+		return fi
+	}
+	rewriteRulesLock.Lock()
+	rewriteRules = rules
+	rewriteRulesLock.Unlock()
+	rewriteRulesReloads.inc("success")
+	log.Printf("Reloaded %d rewrite rules from %s", len(rules), path)
+	return fi
+}
+
+// initRewriteRules loads the rewrite rules file and starts watching it for
+// changes. An empty path disables the rewriting
+func initRewriteRules(path string) error {
+	if path == "" {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	rules, err := loadRewriteRules(path)
+	if err != nil {
+		return err
+	}
+	rewriteRulesLock.Lock()
+	rewriteRules = rules
+	rewriteRulesLock.Unlock()
+	go watchRewriteRules(path, fi, nil)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	nsca "github.com/tubemogul/nscatools"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRewriteRules(t *testing.T) {
+	rules, err := loadRewriteRules("testData/rewrite.yaml")
+	if err != nil {
+		t.Fatalf("Unable to load the rewrite rules: %s", err)
+	}
+	if len(rules) != 7 || rules[5].re == nil {
+		t.Errorf("Wrong rewrite rules loaded: %v", rules)
+	}
+
+	dir, _ := ioutil.TempDir("", "nscapi")
+	defer os.RemoveAll(dir)
+	invalid := []string{
+		"rules:\n  - action: uppercase\n",
+		"rules:\n  - action: lowercase\n    field: hostname\n",
+		"rules:\n  - action: replace\n",
+		"rules:\n  - action: drop\n    match: '('\n",
+		"rules:\n  - action: alias\n",
+		"rules:\n  -\n",
+		"rules: [",
+	}
+	for _, content := range invalid {
+		path := filepath.Join(dir, "rewrite.yaml")
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err := loadRewriteRules(path); err == nil {
+			t.Errorf("Expecting an error for the rules %q", content)
+		}
+	}
+	if _, err := loadRewriteRules(filepath.Join(dir, "nonExisting.yaml")); err == nil {
+		t.Error("Expecting an error for a missing file")
+	}
+}
+
+func TestRewriteResult(t *testing.T) {
+	rules, _ := loadRewriteRules("testData/rewrite.yaml")
+	rewriteRules = rules
+	resultsRejected = labeledCounter{}
+	defer func() { rewriteRules = nil }()
+
+	cases := []struct {
+		host, service       string
+		kept                bool
+		expHost, expService string
+	}{
+		{"WEB01.example.org", "check_disk", true, "web01", "disk"},
+		{"db01.dc1.internal", "mysql", true, "db01", "mysql"},
+		{"10.0.0.1", "ping", true, "10.0.0.1", "ping"},
+		{"www01", "httpd", true, "web01", "apache"},
+		{"httpd", "", true, "apache", ""},
+		{"test-web01", "apache", false, "test-web01", "apache"},
+		// Only the host names are dropped
+		{"web01", "test-apache", true, "web01", "test-apache"},
+	}
+	for _, tt := range cases {
+		p := &nsca.DataPacket{HostName: tt.host, Service: tt.service}
+		if kept := rewriteResult(p); kept != tt.kept {
+			t.Errorf("%s/%s: expecting kept to be %t", tt.host, tt.service, tt.kept)
+			continue
+		}
+		if tt.kept && (p.HostName != tt.expHost || p.Service != tt.expService) {
+			t.Errorf("%s/%s: expecting %s/%s, got %s/%s", tt.host, tt.service, tt.expHost, tt.expService, p.HostName, p.Service)
+		}
+	}
+	if n := resultsRejected.values[rejectedRewrite]; n != 1 {
+		t.Errorf("Expecting 1 dropped result, got %d", n)
+	}
+
+	// A result without host name once rewritten is dropped
+	rewriteRules = []*rewriteRule{{Action: "strip_domain", Field: "host", Domain: "example.org"}}
+	if rewriteResult(&nsca.DataPacket{HostName: ".example.org", Service: "disk"}) {
+		t.Error("Expecting the results without host name to be dropped")
+	}
+}
+
+func TestWatchRewriteRules(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nscapi")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rewrite.yaml")
+	ioutil.WriteFile(path, []byte("rules:\n  - action: lowercase\n"), 0644)
+	rewriteRulesReloads = labeledCounter{}
+	defer func() { rewriteRules = nil }()
+
+	if err := initRewriteRules(""); err != nil || rewriteRules != nil {
+		t.Errorf("An empty path should disable the rewrite rules: %v", err)
+	}
+	if err := initRewriteRules(filepath.Join(dir, "nonExisting.yaml")); err == nil {
+		t.Error("Expecting an error for a missing file")
+	}
+	rules, _ := loadRewriteRules(path)
+	rewriteRules = rules
+	loaded, _ := os.Stat(path)
+
+	// Writes the file with a modification time different from the loaded one
+	// and runs the reload step of the watcher
+	mtime := loaded.ModTime()
+	reload := func(content string) []*rewriteRule {
+		mtime = mtime.Add(time.Second)
+		ioutil.WriteFile(path, []byte(content), 0644)
+		os.Chtimes(path, mtime, mtime)
+		loaded = reloadRewriteRules(path, loaded)
+		rewriteRulesLock.RLock()
+		defer rewriteRulesLock.RUnlock()
+		return rewriteRules
+	}
+
+	if rules := reload("rules:\n  - action: lowercase\n  - action: strip_domain\n"); len(rules) != 2 || rewriteRulesReloads.values["success"] != 1 {
+		t.Errorf("Expecting the 2 rules of the new file, got %d", len(rules))
+	}
+	// An unchanged file is not reloaded
+	if loaded = reloadRewriteRules(path, loaded); rewriteRulesReloads.values["success"] != 1 {
+		t.Errorf("An unchanged file should not be reloaded. Got %v", rewriteRulesReloads.values)
+	}
+	// An invalid file keeps the previous rules
+	if rules := reload("rules:\n  - action: nonExisting\n"); len(rules) != 2 || rewriteRulesReloads.values["failure"] != 1 {
+		t.Errorf("Expecting the previous rules to be kept, got %d rules", len(rules))
+	}
+	// A missing file keeps the previous rules
+	os.Remove(path)
+	if fi := reloadRewriteRules(path, loaded); fi != loaded || len(rewriteRules) != 2 {
+		t.Error("Expecting the previous rules to be kept when the file is missing")
+	}
+
+	// The watcher stops when requested
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchRewriteRules(path, loaded, stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("The watcher should stop when requested")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// nagiosOutputEscaper escapes the multi-line outputs the same way Nagios does
+// in status.dat and Livestatus
+var nagiosOutputEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+// writeStatusDatBlock writes a block of status.dat with its attributes in the
+// given order
+func writeStatusDatBlock(w io.Writer, name string, attrs [][2]string) {
+	fmt.Fprintf(w, "%s {\n", name)
+	for _, attr := range attrs {
+		fmt.Fprintf(w, "\t%s=%s\n", attr[0], nagiosOutputEscaper.Replace(attr[1]))
+	}
+	fmt.Fprint(w, "\t}\n\n")
+}
+
+// checkMaxAttempts returns the number of attempts after which the state of
+// the check becomes HARD, as configured for the event handlers
+func checkMaxAttempts(host, service string) uint16 {
+	if eventHandlers == nil {
+		return 1
+	}
+	return eventHandlers.maxAttempts(cFields.get(host, service))
+}
+
+// statusDatBool converts a boolean to the integer used by status.dat
+func statusDatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// statusDatBlock is a block of status.dat with its attributes in order
+type statusDatBlock struct {
+	name  string
+	attrs [][2]string
+}
+
+// writeStatusDat writes the content of the cache in the format of the Nagios
+// status.dat file: one hoststatus block per host and one servicestatus block
+// per check. The hosts without host check result are reported UP
+func writeStatusDat(w io.Writer, now time.Time) error {
+	// The blocks are built under the cache lock, which is released before
+	// writing them
+	blocks := statusDatCheckBlocks(now)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# NAGIOS STATUS FILE\n#\n# Generated by nscapi %s\n\n", version)
+	writeStatusDatBlock(bw, "info", [][2]string{
+		{"created", fmt.Sprint(now.Unix())},
+		{"version", version},
+	})
+	writeStatusDatBlock(bw, "programstatus", [][2]string{
+		{"nagios_pid", fmt.Sprint(os.Getpid())},
+		{"program_start", fmt.Sprint(startTime.Unix())},
+		{"active_service_checks_enabled", "0"},
+		{"passive_service_checks_enabled", "1"},
+		{"enable_notifications", "1"},
+		{"enable_event_handlers", "1"},
+	})
+	for _, block := range blocks {
+		writeStatusDatBlock(bw, block.name, block.attrs)
+	}
+	return bw.Flush()
+}
+
+// statusDatCheckBlocks returns the hoststatus and servicestatus blocks of the
+// checks of the cache, sorted by host and service
+func statusDatCheckBlocks(now time.Time) []statusDatBlock {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	var blocks []statusDatBlock
+	hosts := make([]string, 0, len(cache))
+	for host := range cache {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		services := make([]string, 0, len(cache[host]))
+		for svc := range cache[host] {
+			services = append(services, svc)
+		}
+		sort.Strings(services)
+		hostEntry := hostStatus(host)
+		_, _, hostPerfdata := splitPluginOutput(hostEntry.output)
+		blocks = append(blocks, statusDatBlock{"hoststatus", [][2]string{
+			{"host_name", host},
+			{"check_type", "1"},
+			{"current_state", fmt.Sprint(hostEntry.state)},
+			{"state_type", "1"},
+			{"plugin_output", hostEntry.shortOutput},
+			{"long_plugin_output", hostEntry.longOutput},
+			{"performance_data", hostPerfdata},
+			{"has_been_checked", "1"},
+			{"last_check", fmt.Sprint(hostEntry.timestamp)},
+			{"last_state_change", fmt.Sprint(hostEntry.statusFirstSeen)},
+			{"last_update", fmt.Sprint(now.Unix())},
+			{"problem_has_been_acknowledged", statusDatBool(hostEntry.acknowledged)},
+			{"active_checks_enabled", "0"},
+			{"passive_checks_enabled", "1"},
+		}})
+		for _, svc := range services {
+			entry := cache[host][svc]
+			_, _, perfdata := splitPluginOutput(entry.output)
+			max := checkMaxAttempts(host, svc)
+			attempt := entry.attempt
+			if attempt > max {
+				attempt = max
+			}
+			hard := "0"
+			if stateType(entry.state, entry.attempt, max) == "HARD" {
+				hard = "1"
+			}
+			blocks = append(blocks, statusDatBlock{"servicestatus", [][2]string{
+				{"host_name", host},
+				{"service_description", svc},
+				{"check_type", "1"},
+				{"current_state", fmt.Sprint(entry.state)},
+				{"state_type", hard},
+				{"current_attempt", fmt.Sprint(attempt)},
+				{"max_attempts", fmt.Sprint(max)},
+				{"plugin_output", entry.shortOutput},
+				{"long_plugin_output", entry.longOutput},
+				{"performance_data", perfdata},
+				{"has_been_checked", "1"},
+				{"last_check", fmt.Sprint(entry.timestamp)},
+				{"last_state_change", fmt.Sprint(entry.statusFirstSeen)},
+				{"last_update", fmt.Sprint(now.Unix())},
+				{"problem_has_been_acknowledged", statusDatBool(entry.acknowledged)},
+				{"active_checks_enabled", "0"},
+				{"passive_checks_enabled", "1"},
+				{"notifications_enabled", "1"},
+			}})
+		}
+	}
+	return blocks
+}
+
+// saveStatusDat writes the status.dat file atomically: the content is written
+// in a temporary file of the same directory which then replaces the previous
+// file, so readers never see a partial file
+func saveStatusDat(path string, now time.Time) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".status.dat")
+	if err != nil {
+		return err
+	}
+	err = writeStatusDat(tmp, now)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// initStatusDat periodically writes the status.dat file. An empty path
+// disables it
+func initStatusDat(path string, interval time.Duration) {
+	if path == "" {
+		return
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		if err := saveStatusDat(path, time.Now()); err != nil {
+			log.Printf("Unable to write %s: %s", path, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// statusDatHandler takes care of the path /status.dat that serves the content
+// of the cache in the Nagios status.dat format
+func statusDatHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeStatusDat(w, time.Now())
+}
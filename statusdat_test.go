@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteStatusDat(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	updateCacheEntry("web01", "apache", "CRITICAL - down|time=0.1s;1;2\nprocess \\ not found", 1484527962, 2)
+	updateCacheEntry("web01", "apache", "CRITICAL - still down|time=0.1s;1;2", 1484527972, 2)
+	updateCacheEntry("web01", "load", "OK", 1484527965, 0)
+	acknowledgeCacheEntry("web01", "apache")
+
+	var b bytes.Buffer
+	writeStatusDat(&b, time.Unix(1484528000, 0))
+	for _, expected := range []string{
+		"info {\n\tcreated=1484528000\n\tversion=" + version + "\n\t}\n",
+		"hoststatus {\n\thost_name=web01\n\tcheck_type=1\n\tcurrent_state=0\n\tstate_type=1\n\tplugin_output=Passive results received for 2 services\n\tlong_plugin_output=\n\tperformance_data=\n\thas_been_checked=1\n\tlast_check=1484527972\n\tlast_state_change=1484527962\n",
+		"servicestatus {\n\thost_name=web01\n\tservice_description=apache\n\tcheck_type=1\n\tcurrent_state=2\n\tstate_type=1\n\tcurrent_attempt=1\n\tmax_attempts=1\n\tplugin_output=CRITICAL - still down\n\tlong_plugin_output=\n\tperformance_data=time=0.1s;1;2\n\thas_been_checked=1\n\tlast_check=1484527972\n\tlast_state_change=1484527962\n\tlast_update=1484528000\n\tproblem_has_been_acknowledged=1\n",
+		"servicestatus {\n\thost_name=web01\n\tservice_description=load\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("Missing %q in:\n%s", expected, b.String())
+		}
+	}
+	if strings.Index(b.String(), "service_description=apache") > strings.Index(b.String(), "service_description=load") {
+		t.Error("The services should be sorted")
+	}
+
+	// The host checks give the state of the hosts
+	updateCacheEntry("web03", "", "PING CRITICAL - 100% loss|rta=0ms", 1484527990, 1)
+	acknowledgeCacheEntry("web03", "")
+	b.Reset()
+	writeStatusDat(&b, time.Unix(1484528000, 0))
+	expected := "hoststatus {\n\thost_name=web03\n\tcheck_type=1\n\tcurrent_state=1\n\tstate_type=1\n\tplugin_output=PING CRITICAL - 100% loss\n\tlong_plugin_output=\n\tperformance_data=rta=0ms\n\thas_been_checked=1\n\tlast_check=1484527990\n\tlast_state_change=1484527990\n\tlast_update=1484528000\n\tproblem_has_been_acknowledged=1\n"
+	if !strings.Contains(b.String(), expected) || strings.Contains(b.String(), "service_description=\n") {
+		t.Errorf("Missing %q without service block in:\n%s", expected, b.String())
+	}
+
+	// The long output is escaped like Nagios does
+	updateCacheEntry("web02", "apache", "CRITICAL - down|time=0.1s;1;2\nprocess \\ not found\nport closed", 1484527962, 2)
+	b.Reset()
+	writeStatusDat(&b, time.Unix(1484528000, 0))
+	if !strings.Contains(b.String(), "\tlong_plugin_output=process \\\\ not found\\nport closed\n") {
+		t.Errorf("Long output not escaped in:\n%s", b.String())
+	}
+}
+
+func TestSaveStatusDat(t *testing.T) {
+	initCache()
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+	dir, err := ioutil.TempDir("", "nscapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.dat")
+	if err := saveStatusDat(path, time.Unix(1484528000, 0)); err != nil {
+		t.Fatalf("saveStatusDat returned: %s", err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "service_description=apache") {
+		t.Errorf("Unexpected content:\n%s", content)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("The temporary file should have been renamed. Found %d files", len(files))
+	}
+	if err := saveStatusDat(filepath.Join(dir, "nonExisting", "status.dat"), time.Now()); err == nil {
+		t.Error("Expecting an error when the directory does not exist")
+	}
+}
+
+func TestStatusDatHandler(t *testing.T) {
+	initCache()
+	updateCacheEntry("web01", "apache", "OK", 1484527962, 0)
+	w := httptest.NewRecorder()
+	statusDatHandler(w, httptest.NewRequest("GET", "/status.dat", nil))
+	if !strings.Contains(w.Body.String(), "servicestatus {\n\thost_name=web01\n\tservice_description=apache\n") {
+		t.Errorf("Unexpected status.dat:\n%s", w.Body.String())
+	}
+}
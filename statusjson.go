@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Result codes of the Nagios JSON CGIs
+const (
+	statusJSONSuccess            = 0
+	statusJSONOptionInvalid      = 3
+	statusJSONOptionMissing      = 4
+	statusJSONOptionValueInvalid = 6
+)
+
+var statusJSONResultTexts = map[int]string{
+	statusJSONSuccess:            "Success",
+	statusJSONOptionInvalid:      "Option Invalid",
+	statusJSONOptionMissing:      "Option Missing",
+	statusJSONOptionValueInvalid: "Option Value Invalid",
+}
+
+// Status bitmasks used by the Nagios JSON CGIs
+var (
+	statusJSONHostStatuses    = map[string]int{"pending": 1, "up": 2, "down": 4, "unreachable": 8}
+	statusJSONServiceStatuses = map[string]int{"pending": 1, "ok": 2, "warning": 4, "unknown": 8, "critical": 16}
+)
+
+// statusJSONServiceStatus returns the status bitmask of a service state
+func statusJSONServiceStatus(state int16) int {
+	switch state {
+	case 0:
+		return 2
+	case 1:
+		return 4
+	case 2:
+		return 16
+	}
+	return 8
+}
+
+// parseStatusJSONStatuses parses a space-separated list of statuses such as
+// "warning critical" into a bitmask. An empty list matches every status
+func parseStatusJSONStatuses(value string, statuses map[string]int) (int, bool) {
+	mask := 0
+	for _, name := range strings.Fields(value) {
+		bit, ok := statuses[name]
+		if !ok {
+			return 0, false
+		}
+		mask |= bit
+	}
+	if mask == 0 {
+		mask = ^0
+	}
+	return mask, true
+}
+
+// statusJSONMillis converts a timestamp in seconds to the milliseconds used by
+// the JSON CGIs
+func statusJSONMillis(ts uint32) int64 {
+	return int64(ts) * 1000
+}
+
+// statusJSONService returns the service object of the JSON CGIs for a check
+func statusJSONService(host, svc string, entry *serviceEntry, now time.Time) map[string]interface{} {
+	_, _, perfdata := splitPluginOutput(entry.output)
+	max := checkMaxAttempts(host, svc)
+	attempt := entry.attempt
+	if attempt > max {
+		attempt = max
+	}
+	stateTypeCode := 0
+	if stateType(entry.state, entry.attempt, max) == "HARD" {
+		stateTypeCode = 1
+	}
+	return map[string]interface{}{
+		"host_name":                     host,
+		"description":                   svc,
+		"plugin_output":                 entry.shortOutput,
+		"long_plugin_output":            entry.longOutput,
+		"perf_data":                     perfdata,
+		"max_attempts":                  max,
+		"current_attempt":               attempt,
+		"status":                        statusJSONServiceStatus(entry.state),
+		"last_update":                   now.UnixNano() / int64(time.Millisecond),
+		"has_been_checked":              true,
+		"should_be_scheduled":           false,
+		"last_check":                    statusJSONMillis(entry.timestamp),
+		"check_type":                    1,
+		"checks_enabled":                false,
+		"last_state_change":             statusJSONMillis(entry.statusFirstSeen),
+		"state_type":                    stateTypeCode,
+		"notifications_enabled":         true,
+		"problem_has_been_acknowledged": entry.acknowledged,
+		"accept_passive_checks":         true,
+		"event_handler_enabled":         eventHandlers != nil,
+		"flap_detection_enabled":        false,
+		"is_flapping":                   false,
+		"scheduled_downtime_depth":      0,
+		"clock_skew":                    hostClockSkew(host),
+	}
+}
+
+// statusJSONHostStatus returns the bit of the status of a host
+func statusJSONHostStatus(entry *serviceEntry) int {
+	return statusJSONHostStatuses[strings.ToLower(hostStatusString(entry.state))]
+}
+
+// statusJSONHost returns the host object of the JSON CGIs. The hosts without
+// host check result are UP. The clock skew of the host, not part of the Nagios
+// objects, is null when no result has been received from it
+func statusJSONHost(host string, now time.Time) map[string]interface{} {
+	entry := hostStatus(host)
+	_, _, perfdata := splitPluginOutput(entry.output)
+	return map[string]interface{}{
+		"name":                          host,
+		"plugin_output":                 entry.shortOutput,
+		"long_plugin_output":            entry.longOutput,
+		"perf_data":                     perfdata,
+		"max_attempts":                  1,
+		"current_attempt":               1,
+		"status":                        statusJSONHostStatus(entry),
+		"last_update":                   now.UnixNano() / int64(time.Millisecond),
+		"has_been_checked":              true,
+		"should_be_scheduled":           false,
+		"last_check":                    statusJSONMillis(entry.timestamp),
+		"check_type":                    1,
+		"checks_enabled":                false,
+		"last_state_change":             statusJSONMillis(entry.statusFirstSeen),
+		"state_type":                    1,
+		"notifications_enabled":         true,
+		"problem_has_been_acknowledged": entry.acknowledged,
+		"accept_passive_checks":         true,
+		"scheduled_downtime_depth":      0,
+		"clock_skew":                    hostClockSkew(host),
+	}
+}
+
+// statusJSONQuery is a query to the statusjson.cgi emulation
+type statusJSONQuery struct {
+	query              string
+	details            bool
+	hostname           string
+	hostgroup          string
+	serviceDescription string
+	hostStatus         int
+	serviceStatus      int
+}
+
+// hostMatches returns whether the host is selected by the query
+func (sq *statusJSONQuery) hostMatches(host string) bool {
+	return (sq.hostname == "" || sq.hostname == host) &&
+		(sq.hostgroup == "" || sq.hostgroup == hostgroupOf(host)) &&
+		sq.hostStatus&statusJSONHostStatus(hostStatus(host)) != 0
+}
+
+// serviceMatches returns whether the check is selected by the query
+func (sq *statusJSONQuery) serviceMatches(host, svc string, entry *serviceEntry) bool {
+	return sq.hostMatches(host) &&
+		(sq.serviceDescription == "" || sq.serviceDescription == svc) &&
+		sq.serviceStatus&statusJSONServiceStatus(entry.state) != 0
+}
+
+// run executes the query on the cache and returns its data along with the
+// result code and message
+func (sq *statusJSONQuery) run(now time.Time) (map[string]interface{}, int, string) {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	data := make(map[string]interface{})
+	switch sq.query {
+	case "hostcount":
+		count := map[string]int{"up": 0, "down": 0, "unreachable": 0, "pending": 0}
+		for host := range cache {
+			if sq.hostMatches(host) {
+				count[strings.ToLower(hostStatusString(hostStatus(host).state))]++
+			}
+		}
+		data["count"] = count
+	case "servicecount":
+		count := map[string]int{"ok": 0, "warning": 0, "critical": 0, "unknown": 0, "pending": 0}
+		for host, svcs := range cache {
+			for svc, entry := range svcs {
+				if sq.serviceMatches(host, svc, entry) {
+					count[strings.ToLower(statusString(entry.state))]++
+				}
+			}
+		}
+		data["count"] = count
+	case "hostlist":
+		list := make(map[string]interface{})
+		for host := range cache {
+			if !sq.hostMatches(host) {
+				continue
+			}
+			if sq.details {
+				list[host] = statusJSONHost(host, now)
+			} else {
+				list[host] = statusJSONHostStatus(hostStatus(host))
+			}
+		}
+		data["hostlist"] = list
+	case "servicelist":
+		list := make(map[string]map[string]interface{})
+		for host, svcs := range cache {
+			for svc, entry := range svcs {
+				if !sq.serviceMatches(host, svc, entry) {
+					continue
+				}
+				if list[host] == nil {
+					list[host] = make(map[string]interface{})
+				}
+				if sq.details {
+					list[host][svc] = statusJSONService(host, svc, entry, now)
+				} else {
+					list[host][svc] = statusJSONServiceStatus(entry.state)
+				}
+			}
+		}
+		data["servicelist"] = list
+	case "host":
+		if sq.hostname == "" {
+			return nil, statusJSONOptionMissing, "Host information requested, but no host name specified."
+		}
+		_, ok := cache[sq.hostname]
+		if !ok {
+			return nil, statusJSONOptionValueInvalid, "The host '" + sq.hostname + "' could not be found."
+		}
+		data["host"] = statusJSONHost(sq.hostname, now)
+	case "service":
+		if sq.hostname == "" || sq.serviceDescription == "" {
+			return nil, statusJSONOptionMissing, "Service information requested, but no host name or service description specified."
+		}
+		entry, ok := cache[sq.hostname][sq.serviceDescription]
+		if !ok {
+			return nil, statusJSONOptionValueInvalid, "The service '" + sq.serviceDescription + "' on host '" + sq.hostname + "' could not be found."
+		}
+		data["service"] = statusJSONService(sq.hostname, sq.serviceDescription, entry, now)
+	default:
+		return nil, statusJSONOptionInvalid, "The query '" + sq.query + "' is not supported by nscapi."
+	}
+	return data, statusJSONSuccess, ""
+}
+
+// parseStatusJSONQuery reads the options of a statusjson.cgi request
+func parseStatusJSONQuery(r *http.Request) (*statusJSONQuery, int, string) {
+	sq := &statusJSONQuery{
+		query:              r.FormValue("query"),
+		details:            r.FormValue("details") == "true",
+		hostname:           r.FormValue("hostname"),
+		hostgroup:          r.FormValue("hostgroup"),
+		serviceDescription: r.FormValue("servicedescription"),
+	}
+	if sq.query == "" {
+		return sq, statusJSONOptionMissing, "The query option is required."
+	}
+	var ok bool
+	if sq.hostStatus, ok = parseStatusJSONStatuses(r.FormValue("hoststatus"), statusJSONHostStatuses); !ok {
+		return sq, statusJSONOptionValueInvalid, "Invalid hoststatus option."
+	}
+	if sq.serviceStatus, ok = parseStatusJSONStatuses(r.FormValue("servicestatus"), statusJSONServiceStatuses); !ok {
+		return sq, statusJSONOptionValueInvalid, "Invalid servicestatus option."
+	}
+	return sq, statusJSONSuccess, ""
+}
+
+// statusJSONHandler emulates the statusjson.cgi of Nagios Core 4 for the
+// hostlist, servicelist, host, service, hostcount and servicecount queries so
+// that the tools speaking the Nagios JSON CGI API can use nscapi. Like Nagios,
+// the errors are reported in the result rather than as HTTP status codes
+func statusJSONHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	sq, code, message := parseStatusJSONQuery(r)
+	var data map[string]interface{}
+	if code == statusJSONSuccess {
+		data, code, message = sq.run(now)
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	selectors := make(map[string]interface{})
+	for _, name := range []string{"hostname", "hostgroup", "servicedescription", "hoststatus", "servicestatus"} {
+		if value := r.FormValue(name); value != "" {
+			selectors[name] = value
+		}
+	}
+	data["selectors"] = selectors
+	var lastUpdate int64
+	if ts := lastIngestion.value(); ts > 0 {
+		lastUpdate = int64(ts) * 1000
+	}
+	resp := map[string]interface{}{
+		"format_version": 0,
+		"result": map[string]interface{}{
+			"query_time":       now.UnixNano() / int64(time.Millisecond),
+			"cgi":              "statusjson.cgi",
+			"user":             "nscapi",
+			"query":            sq.query,
+			"query_status":     "released",
+			"program_start":    startTime.Unix() * 1000,
+			"last_data_update": lastUpdate,
+			"type_code":        code,
+			"type_text":        statusJSONResultTexts[code],
+			"message":          message,
+		},
+		"data": data,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// statusJSONResponse is the part of the statusjson.cgi response checked by the
+// tests
+type statusJSONResponse struct {
+	Result struct {
+		Query    string `json:"query"`
+		TypeCode int    `json:"type_code"`
+		TypeText string `json:"type_text"`
+	} `json:"result"`
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+func TestParseStatusJSONStatuses(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected int
+		ok       bool
+	}{
+		{"", ^0, true},
+		{"warning critical", 20, true},
+		{"ok", 2, true},
+		{"degraded", 0, false},
+	}
+	for _, tt := range cases {
+		mask, ok := parseStatusJSONStatuses(tt.value, statusJSONServiceStatuses)
+		if ok != tt.ok || mask != tt.expected {
+			t.Errorf("Expecting %d, %t for %q. Got %d, %t", tt.expected, tt.ok, tt.value, mask, ok)
+		}
+	}
+}
+
+func TestStatusJSONHandler(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	updateCacheEntry("web01", "apache", "OK - running|time=0.1s", 1484527962, 0)
+	updateCacheEntry("web01", "disk", "DISK WARNING - 85% used\n/var 85%", 1484527963, 1)
+	updateCacheEntry("web02", "apache", "CRITICAL - down", 1484527964, 2)
+	updateCacheEntry("db01", "mysql", "UNKNOWN - no data", 1484527965, 3)
+
+	cases := []struct {
+		query    string
+		typeCode int
+		key      string
+		expected interface{}
+	}{
+		{"query=hostcount", 0, "count", map[string]interface{}{"up": 3.0, "down": 0.0, "unreachable": 0.0, "pending": 0.0}},
+		{"query=hostcount&hostgroup=web", 0, "count", map[string]interface{}{"up": 2.0, "down": 0.0, "unreachable": 0.0, "pending": 0.0}},
+		{"query=hostcount&hoststatus=down", 0, "count", map[string]interface{}{"up": 0.0, "down": 0.0, "unreachable": 0.0, "pending": 0.0}},
+		{"query=servicecount", 0, "count", map[string]interface{}{"ok": 1.0, "warning": 1.0, "critical": 1.0, "unknown": 1.0, "pending": 0.0}},
+		{"query=servicecount&hostname=web01", 0, "count", map[string]interface{}{"ok": 1.0, "warning": 1.0, "critical": 0.0, "unknown": 0.0, "pending": 0.0}},
+		{"query=hostlist", 0, "hostlist", map[string]interface{}{"web01": 2.0, "web02": 2.0, "db01": 2.0}},
+		{"query=servicelist&servicestatus=warning+critical", 0, "servicelist", map[string]interface{}{
+			"web01": map[string]interface{}{"disk": 4.0},
+			"web02": map[string]interface{}{"apache": 16.0},
+		}},
+		{"query=servicelist&servicedescription=apache", 0, "servicelist", map[string]interface{}{
+			"web01": map[string]interface{}{"apache": 2.0},
+			"web02": map[string]interface{}{"apache": 16.0},
+		}},
+		{"query=host", 4, "host", nil},
+		{"query=host&hostname=nonExisting", 6, "host", nil},
+		{"query=service&hostname=web01", 4, "service", nil},
+		{"query=service&hostname=web01&servicedescription=nonExisting", 6, "service", nil},
+		{"query=servicelist&servicestatus=degraded", 6, "servicelist", nil},
+		{"query=commentlist", 3, "commentlist", nil},
+		{"", 4, "", nil},
+	}
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		statusJSONHandler(w, httptest.NewRequest("GET", "/cgi-bin/statusjson.cgi?"+tt.query, nil))
+		var resp statusJSONResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: invalid JSON: %s", tt.query, err)
+			continue
+		}
+		if resp.Result.TypeCode != tt.typeCode {
+			t.Errorf("%s: expecting type code %d. Got %d (%s)", tt.query, tt.typeCode, resp.Result.TypeCode, resp.Result.TypeText)
+		}
+		if tt.expected == nil {
+			if _, ok := resp.Data[tt.key]; ok && tt.key != "" {
+				t.Errorf("%s: no %s expected in the data", tt.query, tt.key)
+			}
+			continue
+		}
+		var data interface{}
+		json.Unmarshal(resp.Data[tt.key], &data)
+		if !reflect.DeepEqual(data, tt.expected) {
+			t.Errorf("%s: expecting %v. Got %v", tt.query, tt.expected, data)
+		}
+	}
+}
+
+func TestStatusJSONHandlerDetails(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	updateCacheEntry("web01", "disk", "DISK WARNING - 85% used|used=85%;80;90\n/var 85%", 1484527963, 1)
+	updateCacheEntry("web01", "disk", "DISK WARNING - 86% used|used=86%;80;90\n/var 86%", 1484527973, 1)
+	acknowledgeCacheEntry("web01", "disk")
+
+	w := httptest.NewRecorder()
+	statusJSONHandler(w, httptest.NewRequest("GET", "/cgi-bin/statusjson.cgi?query=service&hostname=web01&servicedescription=disk", nil))
+	var resp statusJSONResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON: %s", err)
+	}
+	var svc map[string]interface{}
+	json.Unmarshal(resp.Data["service"], &svc)
+	expected := map[string]interface{}{
+		"host_name":                     "web01",
+		"description":                   "disk",
+		"plugin_output":                 "DISK WARNING - 86% used",
+		"long_plugin_output":            "/var 86%",
+		"perf_data":                     "used=86%;80;90",
+		"status":                        4.0,
+		"last_check":                    1484527973000.0,
+		"last_state_change":             1484527963000.0,
+		"current_attempt":               1.0,
+		"max_attempts":                  1.0,
+		"state_type":                    1.0,
+		"problem_has_been_acknowledged": true,
+	}
+	for key, value := range expected {
+		if svc[key] != value {
+			t.Errorf("Expecting %s to be %v. Got %v", key, value, svc[key])
+		}
+	}
+
+	// The clock skew is reported for the hosts without host check
+	hostClockSkews["web01"] = &clockSkew{Samples: 1, Last: 5, Min: 5, Max: 5, Mean: 5}
+	w = httptest.NewRecorder()
+	statusJSONHandler(w, httptest.NewRequest("GET", "/cgi-bin/statusjson.cgi?query=hostlist&details=true", nil))
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var hosts map[string]map[string]interface{}
+	json.Unmarshal(resp.Data["hostlist"], &hosts)
+	if hosts["web01"]["name"] != "web01" || hosts["web01"]["status"] != 2.0 || hosts["web01"]["last_check"] != 1484527973000.0 {
+		t.Errorf("Unexpected host details: %v", hosts["web01"])
+	}
+	expectedSkew := map[string]interface{}{"samples": 1.0, "last": 5.0, "min": 5.0, "max": 5.0, "mean": 5.0}
+	if !reflect.DeepEqual(hosts["web01"]["clock_skew"], expectedSkew) {
+		t.Errorf("Wrong clock skew in the host details. Expecting %v, got %v", expectedSkew, hosts["web01"]["clock_skew"])
+	}
+}
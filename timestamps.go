@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"time"
+)
+
+// Reasons for which the check results can be rejected, used as label of
+// nscapi_results_rejected_total
+const (
+	rejectedOutOfOrder = "out_of_order"
+	rejectedTooOld     = "too_old"
+	rejectedFuture     = "future"
+	rejectedRewrite    = "rewrite_drop"
+	rejectedFilter     = "filter_deny"
+)
+
+// Policies applied to the timestamps set in the future beyond maxFutureSkew
+const (
+	futureAccept = "accept"
+	futureClamp  = "clamp"
+	futureReject = "reject"
+)
+
+var (
+	// rejectOutOfOrder makes the cache worker ignore the results older than the
+	// result already in the cache for the same check
+	rejectOutOfOrder bool
+	// maxPacketAge is the maximum age of a result when it is received, like
+	// max_packet_age in nsca.cfg. 0 disables the check
+	maxPacketAge time.Duration
+	// maxFutureSkew is the tolerance given to the timestamps set in the future
+	// before futureTimestamps applies
+	maxFutureSkew time.Duration
+	// futureTimestamps is the policy applied to the timestamps set too far in
+	// the future: accept, clamp to the receive time or reject
+	futureTimestamps = futureAccept
+)
+
+// Clocks that can drive the timestamps of the cache
+const (
+	clockClient = "client"
+	clockServer = "server"
+)
+
+// timestampClock selects the clock driving the timestamp and the time of the
+// last status change of the checks, and therefore their age: the timestamp
+// set by the client or the time the result was received by nscapi
+var timestampClock = clockClient
+
+// hostClockSkews contains the clock skew of each host of the cache. It is
+// protected by the cache lock
+var hostClockSkews map[string]*clockSkew
+
+// clockSkew summarizes the difference in seconds between the timestamps set
+// by the clients of a host and the time nscapi received their results, a
+// positive skew being a client clock ahead of nscapi. The skew includes the
+// time the results spent in transit
+type clockSkew struct {
+	Samples uint64  `json:"samples"`
+	Last    int64   `json:"last"`
+	Min     int64   `json:"min"`
+	Max     int64   `json:"max"`
+	Mean    float64 `json:"mean"`
+}
+
+// add adds the skew of a result to the statistics
+func (s *clockSkew) add(skew int64) {
+	if s.Samples == 0 || skew < s.Min {
+		s.Min = skew
+	}
+	if s.Samples == 0 || skew > s.Max {
+		s.Max = skew
+	}
+	s.Samples++
+	s.Last = skew
+	s.Mean += (float64(skew) - s.Mean) / float64(s.Samples)
+}
+
+// recordClockSkew adds the difference between the timestamp of a result and
+// its receive time to the clock skew of the host
+func recordClockSkew(p *nsca.DataPacket, receivedAt time.Time) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	skew, ok := hostClockSkews[p.HostName]
+	if !ok {
+		skew = &clockSkew{}
+		hostClockSkews[p.HostName] = skew
+	}
+	skew.add(int64(p.Timestamp) - receivedAt.Unix())
+}
+
+// hostClockSkew returns a copy of the clock skew of a host, nil when no result
+// has been received from it. The cache lock must be held by the caller
+func hostClockSkew(host string) *clockSkew {
+	skew, ok := hostClockSkews[host]
+	if !ok {
+		return nil
+	}
+	c := *skew
+	return &c
+}
+
+// parseTimestampClock checks the clock driving the timestamps of the cache
+func parseTimestampClock(clock string) (string, error) {
+	switch clock {
+	case clockClient, clockServer:
+		return clock, nil
+	}
+	return "", fmt.Errorf("invalid clock '%s', expecting %s or %s", clock, clockClient, clockServer)
+}
+
+// parseFutureTimestamps checks the policy applied to the timestamps set in the
+// future
+func parseFutureTimestamps(policy string) (string, error) {
+	switch policy {
+	case futureAccept, futureClamp, futureReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid policy '%s', expecting %s, %s or %s", policy, futureAccept, futureClamp, futureReject)
+}
+
+// checkTimestamp applies the timestamp policies to a result received at the
+// given time. It returns the reason why the result is rejected, empty when it
+// is accepted. A timestamp clamped to the receive time is updated in the
+// packet
+func checkTimestamp(p *nsca.DataPacket, receivedAt time.Time) string {
+	ts := time.Unix(int64(p.Timestamp), 0)
+	if ts.After(receivedAt.Add(maxFutureSkew)) {
+		switch futureTimestamps {
+		case futureReject:
+			return rejectedFuture
+		case futureClamp:
+			p.Timestamp = uint32(receivedAt.Unix())
+			timestampsClamped.inc()
+			return ""
+		}
+	}
+	if maxPacketAge > 0 && receivedAt.Sub(ts) > maxPacketAge {
+		return rejectedTooOld
+	}
+	return ""
+}
+
+// isOutOfOrder returns whether a result is older than the result in the cache
+// for the same check, comparing the timestamps set by the client
+func isOutOfOrder(p *nsca.DataPacket) bool {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	entry, ok := hostCache[p.HostName]
+	if p.Service != "" {
+		entry, ok = cache[p.HostName][p.Service]
+	}
+	return ok && p.Timestamp < entry.clientTimestamp
+}
+
+// acceptResult records the clock skew of the host of a result taken from the
+// queue, before any clamping, then applies the timestamp policies and counts
+// the rejected results per reason
+func acceptResult(qp *queuedPacket) bool {
+	recordClockSkew(qp.packet, qp.receivedAt)
+	reason := checkTimestamp(qp.packet, qp.receivedAt)
+	if reason == "" && rejectOutOfOrder && isOutOfOrder(qp.packet) {
+		reason = rejectedOutOfOrder
+	}
+	if reason == "" {
+		return true
+	}
+	resultsRejected.inc(reason)
+	return false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"testing"
+	"time"
+)
+
+func TestParseFutureTimestamps(t *testing.T) {
+	for _, policy := range []string{"accept", "clamp", "reject"} {
+		if p, err := parseFutureTimestamps(policy); err != nil || p != policy {
+			t.Errorf("%s: unexpected policy %s or error %v", policy, p, err)
+		}
+	}
+	if _, err := parseFutureTimestamps("drop"); err == nil {
+		t.Error("Expecting an error for an unknown policy")
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	defer func() {
+		maxPacketAge, maxFutureSkew, futureTimestamps = 0, 0, futureAccept
+	}()
+	now := time.Unix(1484527962, 0)
+	cases := []struct {
+		name      string
+		maxAge    time.Duration
+		maxSkew   time.Duration
+		future    string
+		timestamp uint32
+		reason    string
+		expected  uint32
+	}{
+		{"defaults", 0, 0, futureAccept, 1484527962 + 3600, "", 1484527962 + 3600},
+		{"old result without maximum age", 0, 0, futureAccept, 1484527962 - 3600, "", 1484527962 - 3600},
+		{"too old", 30 * time.Second, 0, futureAccept, 1484527962 - 31, rejectedTooOld, 1484527962 - 31},
+		{"within the maximum age", 30 * time.Second, 0, futureAccept, 1484527962 - 30, "", 1484527962 - 30},
+		{"future rejected", 0, 10 * time.Second, futureReject, 1484527962 + 11, rejectedFuture, 1484527962 + 11},
+		{"future within the skew", 0, 10 * time.Second, futureReject, 1484527962 + 10, "", 1484527962 + 10},
+		{"future clamped", 0, 10 * time.Second, futureClamp, 1484527962 + 11, "", 1484527962},
+		{"clamped before the age check", 30 * time.Second, 0, futureClamp, 1484527962 + 3600, "", 1484527962},
+	}
+	for _, tt := range cases {
+		maxPacketAge, maxFutureSkew, futureTimestamps = tt.maxAge, tt.maxSkew, tt.future
+		p := &nsca.DataPacket{HostName: "host01", Service: "disk", Timestamp: tt.timestamp}
+		if reason := checkTimestamp(p, now); reason != tt.reason {
+			t.Errorf("%s: expecting reason %q, got %q", tt.name, tt.reason, reason)
+		}
+		if p.Timestamp != tt.expected {
+			t.Errorf("%s: expecting timestamp %d, got %d", tt.name, tt.expected, p.Timestamp)
+		}
+	}
+}
+
+func TestRejectOutOfOrder(t *testing.T) {
+	initCache()
+	eventHandlers = nil
+	q = lfc.NewQueue()
+	resultsRejected = labeledCounter{}
+	rejectOutOfOrder = true
+	defer func() { rejectOutOfOrder = false }()
+
+	cases := []struct {
+		service   string
+		output    string
+		timestamp uint32
+		expected  string
+	}{
+		{"disk", "DISK OK", 1484527962, "DISK OK"},
+		{"disk", "DISK WARNING", 1484527972, "DISK WARNING"},
+		// Delayed result older than the cached one
+		{"disk", "DISK CRITICAL", 1484527965, "DISK WARNING"},
+		// Same timestamp as the cached result
+		{"disk", "DISK OK", 1484527972, "DISK OK"},
+		{"", "PING OK", 1484527972, "PING OK"},
+		{"", "PING CRITICAL", 1484527970, "PING OK"},
+	}
+	for _, tt := range cases {
+		queueResult(&nsca.DataPacket{HostName: "host01", Service: tt.service, PluginOutput: tt.output, Timestamp: tt.timestamp}, "nsca")
+		cacheWorker(false)
+		entry := hostCache["host01"]
+		if tt.service != "" {
+			entry = cache["host01"][tt.service]
+		}
+		if entry.output != tt.expected {
+			t.Errorf("%s at %d: expecting output %s, got %s", tt.output, tt.timestamp, tt.expected, entry.output)
+		}
+	}
+	if n := resultsRejected.values[rejectedOutOfOrder]; n != 2 {
+		t.Errorf("Expecting 2 results rejected as out of order, got %d", n)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	var s clockSkew
+	for _, skew := range []int64{4, -2, 10} {
+		s.add(skew)
+	}
+	expected := clockSkew{Samples: 3, Last: 10, Min: -2, Max: 10, Mean: 4}
+	if s != expected {
+		t.Errorf("Expecting %+v, got %+v", expected, s)
+	}
+	if _, err := parseTimestampClock("local"); err == nil {
+		t.Error("Expecting an error for an unknown clock")
+	}
+}
+
+func TestTimestampClock(t *testing.T) {
+	defer func() { timestampClock, futureTimestamps = clockClient, futureAccept }()
+	received := time.Unix(1484527962, 0)
+	for _, clock := range []string{clockClient, clockServer} {
+		initCache()
+		eventHandlers = nil
+		q = lfc.NewQueue()
+		timestampClock, futureTimestamps = clock, futureClamp
+		// The host clock is 100s ahead, the clamped timestamp being the receive
+		// time
+		q.Enqueue(&queuedPacket{packet: &nsca.DataPacket{HostName: "host01", Service: "disk", PluginOutput: "DISK OK", Timestamp: 1484527962 + 100}, receivedAt: received})
+		q.Enqueue(&queuedPacket{packet: &nsca.DataPacket{HostName: "host01", Service: "load", PluginOutput: "LOAD OK", Timestamp: 1484527962 - 20}, receivedAt: received})
+		cacheWorker(false)
+
+		expectedSkew := clockSkew{Samples: 2, Last: -20, Min: -20, Max: 100, Mean: 40}
+		if s := hostClockSkews["host01"]; s == nil || *s != expectedSkew {
+			t.Errorf("%s: expecting the clock skew %+v, got %+v", clock, expectedSkew, s)
+		}
+		load := cache["host01"]["load"]
+		if load.clientTimestamp != 1484527942 || load.receivedAt != 1484527962 {
+			t.Errorf("%s: wrong client timestamp %d or receive time %d", clock, load.clientTimestamp, load.receivedAt)
+		}
+		expected := uint32(1484527942)
+		if clock == clockServer {
+			expected = 1484527962
+		}
+		if load.timestamp != expected || load.statusFirstSeen != expected {
+			t.Errorf("%s: expecting the timestamps to be %d, got %d and %d", clock, expected, load.timestamp, load.statusFirstSeen)
+		}
+		if disk := cache["host01"]["disk"]; disk.clientTimestamp != 1484527962 {
+			t.Errorf("%s: expecting the clamped timestamp, got %d", clock, disk.clientTimestamp)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	nsca "github.com/tubemogul/nscatools"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zabbixHeader starts the packets of the Zabbix protocol. It is followed by
+// the flags and the little-endian data length
+const zabbixHeader = "ZBXD"
+
+// zabbixCompressedFlag is set in the flags of the compressed packets, which are
+// not supported
+const zabbixCompressedFlag = 0x02
+
+// zabbixTimeout is the time given to a sender to send its request
+const zabbixTimeout = 10 * time.Second
+
+// zabbixRules maps the Zabbix items to the nscapi checks. The first matching
+// rule applies
+var zabbixRules []*zabbixRule
+
+// zabbixConfig is the content of the Zabbix mapping file
+type zabbixConfig struct {
+	Items []*zabbixRule `yaml:"items"`
+}
+
+// zabbixRule maps the items whose key matches a regular expression to a
+// service. The state is either looked up in States, computed from the Warning
+// and Critical thresholds or, when none of them is set, the value itself
+type zabbixRule struct {
+	// Key is the regular expression matching the whole item key
+	Key string `yaml:"key"`
+	// Service is the name of the service, which can refer to the groups of Key
+	// ($1, ${name}). Default to the item key
+	Service string `yaml:"service"`
+	// States gives the state of each value. The other values are UNKNOWN
+	States map[string]int16 `yaml:"states"`
+	// Warning and Critical are the thresholds on the numeric values
+	Warning  *float64 `yaml:"warning"`
+	Critical *float64 `yaml:"critical"`
+	// Below makes the thresholds alert on the values below them instead of
+	// above
+	Below bool `yaml:"below"`
+	re    *regexp.Regexp
+}
+
+// zabbixItem is a value sent by zabbix_sender
+type zabbixItem struct {
+	Host  string      `json:"host"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Clock int64       `json:"clock"`
+}
+
+// zabbixRequest is a request of zabbix_sender
+type zabbixRequest struct {
+	Request string        `json:"request"`
+	Data    []*zabbixItem `json:"data"`
+}
+
+// zabbixResponse is the response to zabbix_sender
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// defaultZabbixRules is used without mapping file: the item key is the service
+// and the value the state
+var defaultZabbixRules = []*zabbixRule{{Key: ".*", re: regexp.MustCompile(`^(?:.*)$`)}}
+
+// loadZabbixRules reads the yaml mapping file. An empty path gives the default
+// rules
+func loadZabbixRules(path string) ([]*zabbixRule, error) {
+	if path == "" {
+		return defaultZabbixRules, nil
+	}
+	fc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &zabbixConfig{}
+	if err = yaml.Unmarshal(fc, conf); err != nil {
+		return nil, err
+	}
+	for i, rule := range conf.Items {
+		if rule == nil || rule.Key == "" {
+			return nil, fmt.Errorf("item mapping %d has no key", i)
+		}
+		if rule.re, err = regexp.Compile("^(?:" + rule.Key + ")$"); err != nil {
+			return nil, fmt.Errorf("item mapping %s: %s", rule.Key, err)
+		}
+		for value, state := range rule.States {
+			if state < 0 || state > 3 {
+				return nil, fmt.Errorf("item mapping %s: invalid state %d for the value %s", rule.Key, state, value)
+			}
+		}
+	}
+	return conf.Items, nil
+}
+
+// state returns the state of a value according to the rule
+func (rule *zabbixRule) state(value string) (int16, error) {
+	if rule.States != nil {
+		if state, ok := rule.States[value]; ok {
+			return state, nil
+		}
+		return 3, nil
+	}
+	if rule.Warning == nil && rule.Critical == nil {
+		state, err := strconv.ParseInt(value, 10, 16)
+		if err != nil || state < 0 || state > 3 {
+			return 0, fmt.Errorf("value '%s' is not a state", value)
+		}
+		return int16(state), nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value '%s' is not a number", value)
+	}
+	exceeds := func(threshold *float64) bool {
+		if threshold == nil {
+			return false
+		}
+		if rule.Below {
+			return v <= *threshold
+		}
+		return v >= *threshold
+	}
+	switch {
+	case exceeds(rule.Critical):
+		return 2, nil
+	case exceeds(rule.Warning):
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// zabbixPacket turns a Zabbix item into the packet handled by the cache worker
+// using the first matching rule
+func zabbixPacket(rules []*zabbixRule, item *zabbixItem, now time.Time) (*nsca.DataPacket, error) {
+	if item.Host == "" || item.Key == "" {
+		return nil, fmt.Errorf("missing host or key")
+	}
+	value := jsonScalarString(item.Value)
+	for _, rule := range rules {
+		match := rule.re.FindStringSubmatchIndex(item.Key)
+		if match == nil {
+			continue
+		}
+		service := item.Key
+		if rule.Service != "" {
+			service = string(rule.re.ExpandString(nil, rule.Service, item.Key, match))
+		}
+		state, err := rule.state(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", item.Key, err)
+		}
+		output := fmt.Sprintf("%s - %s = %s", strings.ToUpper(statusString(state)), item.Key, value)
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			output += fmt.Sprintf("|'%s'=%s", strings.Replace(item.Key, "'", "''", -1), value)
+		}
+		p := &nsca.DataPacket{HostName: item.Host, Service: service, State: state, PluginOutput: output, Timestamp: uint32(now.Unix())}
+		if item.Clock > 0 {
+			p.Timestamp = uint32(item.Clock)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("%s: no matching item mapping", item.Key)
+}
+
+// readZabbixPacket reads the data of a packet of the Zabbix protocol
+func readZabbixPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != zabbixHeader {
+		return nil, fmt.Errorf("invalid header %q", header[:5])
+	}
+	if header[4]&zabbixCompressedFlag != 0 {
+		return nil, fmt.Errorf("compressed packets are not supported")
+	}
+	length := binary.LittleEndian.Uint32(header[5:9])
+	if length > resultsMaxBodySize {
+		return nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// writeZabbixPacket writes the data in a packet of the Zabbix protocol
+func writeZabbixPacket(w io.Writer, data []byte) error {
+	var packet bytes.Buffer
+	packet.WriteString(zabbixHeader)
+	packet.WriteByte(0x01)
+	binary.Write(&packet, binary.LittleEndian, uint64(len(data)))
+	packet.Write(data)
+	_, err := w.Write(packet.Bytes())
+	return err
+}
+
+// processZabbixRequest feeds the items of a sender data request into the queue
+func processZabbixRequest(data []byte) *zabbixResponse {
+	start := time.Now()
+	var req zabbixRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return &zabbixResponse{Response: "failed", Info: fmt.Sprintf("invalid JSON: %s", err)}
+	}
+	if req.Request != "sender data" {
+		return &zabbixResponse{Response: "failed", Info: fmt.Sprintf("unsupported request '%s'", req.Request)}
+	}
+	processed := 0
+	for _, item := range req.Data {
+		if item == nil {
+			continue
+		}
+		p, err := zabbixPacket(zabbixRules, item, start)
+		if err != nil {
+			log.Printf("Ignoring the Zabbix item of %s: %s", item.Host, err)
+			continue
+		}
+		queueResult(p, "zabbix")
+		processed++
+	}
+	return &zabbixResponse{
+		Response: "success",
+		Info: fmt.Sprintf("processed: %d; failed: %d; total: %d; seconds spent: %f",
+			processed, len(req.Data)-processed, len(req.Data), time.Since(start).Seconds()),
+	}
+}
+
+// handleZabbixConn answers the request of a zabbix_sender connection
+func handleZabbixConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(zabbixTimeout))
+	data, err := readZabbixPacket(conn)
+	if err != nil {
+		log.Printf("Invalid Zabbix request from %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	resp, _ := json.Marshal(processZabbixRequest(data))
+	writeZabbixPacket(conn, resp)
+}
+
+// initZabbix loads the mapping file and starts the Zabbix sender listener. An
+// empty address disables it
+func initZabbix(address, mappingPath string) error {
+	if address == "" {
+		return nil
+	}
+	rules, err := loadZabbixRules(mappingPath)
+	if err != nil {
+		return err
+	}
+	zabbixRules = rules
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go serveZabbix(ln)
+	return nil
+}
+
+// serveZabbix accepts the zabbix_sender connections
+func serveZabbix(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Zabbix listener stopped: %s", err)
+			return
+		}
+		go handleZabbixConn(conn)
+	}
+}
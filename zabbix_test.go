@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/PurpureGecko/go-lfc"
+	nsca "github.com/tubemogul/nscatools"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadZabbixRules(t *testing.T) {
+	rules, err := loadZabbixRules("testData/zabbix.yaml")
+	if err != nil || len(rules) != 4 {
+		t.Fatalf("Expecting 4 item mappings. Got %d: %v", len(rules), err)
+	}
+	if rules, err := loadZabbixRules(""); err != nil || !reflect.DeepEqual(rules, defaultZabbixRules) {
+		t.Errorf("Expecting the default item mapping without file. Got %v: %v", rules, err)
+	}
+	if _, err := loadZabbixRules("testData/nonExisting.yaml"); err == nil {
+		t.Error("Expecting an error for a missing file")
+	}
+}
+
+func TestZabbixPacket(t *testing.T) {
+	rules, err := loadZabbixRules("testData/zabbix.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1484527970, 0)
+	cases := []struct {
+		rules    []*zabbixRule
+		item     zabbixItem
+		expected *nsca.DataPacket
+	}{
+		{rules, zabbixItem{Host: "web01", Key: "apache.running", Value: "0", Clock: 1484527962},
+			&nsca.DataPacket{HostName: "web01", Service: "apache", State: 2, PluginOutput: "CRITICAL - apache.running = 0|'apache.running'=0", Timestamp: 1484527962}},
+		{rules, zabbixItem{Host: "web01", Key: "apache.running", Value: "maybe"},
+			&nsca.DataPacket{HostName: "web01", Service: "apache", State: 3, PluginOutput: "UNKNOWN - apache.running = maybe", Timestamp: 1484527970}},
+		{rules, zabbixItem{Host: "web01", Key: "vfs.fs.size[/var,pused]", Value: 85.5},
+			&nsca.DataPacket{HostName: "web01", Service: "disk /var", State: 1, PluginOutput: "WARNING - vfs.fs.size[/var,pused] = 85.5|'vfs.fs.size[/var,pused]'=85.5", Timestamp: 1484527970}},
+		{rules, zabbixItem{Host: "db01", Key: "mysql.connections.free", Value: "2"},
+			&nsca.DataPacket{HostName: "db01", Service: "mysql connections", State: 2, PluginOutput: "CRITICAL - mysql.connections.free = 2|'mysql.connections.free'=2", Timestamp: 1484527970}},
+		{rules, zabbixItem{Host: "db01", Key: "mysql.connections.free", Value: "50"},
+			&nsca.DataPacket{HostName: "db01", Service: "mysql connections", State: 0, PluginOutput: "OK - mysql.connections.free = 50|'mysql.connections.free'=50", Timestamp: 1484527970}},
+		{rules, zabbixItem{Host: "db01", Key: "nagios.backup", Value: "1"},
+			&nsca.DataPacket{HostName: "db01", Service: "backup", State: 1, PluginOutput: "WARNING - nagios.backup = 1|'nagios.backup'=1", Timestamp: 1484527970}},
+		{defaultZabbixRules, zabbixItem{Host: "db01", Key: "backup", Value: "3"},
+			&nsca.DataPacket{HostName: "db01", Service: "backup", State: 3, PluginOutput: "UNKNOWN - backup = 3|'backup'=3", Timestamp: 1484527970}},
+		{rules, zabbixItem{Host: "web01", Key: "vfs.fs.size[/var,pused]", Value: "full"}, nil},
+		{rules, zabbixItem{Host: "db01", Key: "nagios.backup", Value: "7"}, nil},
+		{rules, zabbixItem{Host: "db01", Key: "system.cpu.load"}, nil},
+		{rules, zabbixItem{Key: "apache.running", Value: "1"}, nil},
+	}
+	for _, tt := range cases {
+		p, err := zabbixPacket(tt.rules, &tt.item, now)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expecting an error. Got %+v", tt.item.Key, p)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(p, tt.expected) {
+			t.Errorf("%s: expecting %+v. Got %+v: %v", tt.item.Key, tt.expected, p, err)
+		}
+	}
+}
+
+func TestZabbixListener(t *testing.T) {
+	q = lfc.NewQueue()
+	if err := initZabbix("", ""); err != nil {
+		t.Errorf("An empty address should disable the Zabbix listener. Got %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	zabbixRules = defaultZabbixRules
+	go serveZabbix(ln)
+
+	cases := []struct {
+		request string
+		prefix  string
+		queued  int
+	}{
+		{`{"request":"sender data","data":[{"host":"web01","key":"apache","value":"2","clock":1484527962},{"host":"web01","key":"disk","value":"full"}]}`,
+			`{"response":"success","info":"processed: 1; failed: 1; total: 2; seconds spent: `, 1},
+		{`{"request":"active checks","host":"web01"}`, `{"response":"failed","info":"unsupported request 'active checks'"}`, 0},
+		{`{"request":`, `{"response":"failed","info":"invalid JSON: `, 0},
+	}
+	for _, tt := range cases {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeZabbixPacket(conn, []byte(tt.request))
+		resp, err := readZabbixPacket(conn)
+		conn.Close()
+		if err != nil || !strings.HasPrefix(string(resp), tt.prefix) {
+			t.Errorf("Expecting a response starting with %s. Got %s: %v", tt.prefix, resp, err)
+		}
+		if q.Len() != tt.queued {
+			t.Errorf("Expecting %d results in the queue. Got %d", tt.queued, q.Len())
+		}
+		for i := 0; i < tt.queued; i++ {
+			q.Dequeue()
+		}
+	}
+}
+
+func TestReadZabbixPacket(t *testing.T) {
+	header := []byte("ZBXD\x03\x05\x00\x00\x00\x00\x00\x00\x00")
+	if _, err := readZabbixPacket(strings.NewReader(string(header) + "abcde")); err == nil {
+		t.Error("Expecting an error for a compressed packet")
+	}
+	if _, err := readZabbixPacket(strings.NewReader("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("Expecting an error for an invalid header")
+	}
+	binary.LittleEndian.PutUint32(header[5:9], resultsMaxBodySize+1)
+	header[4] = 0x01
+	if _, err := readZabbixPacket(strings.NewReader(string(header))); err == nil {
+		t.Error("Expecting an error for a packet too large")
+	}
+}